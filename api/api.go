@@ -8,6 +8,7 @@ import (
     "errors"
     "fmt"
     "strconv"
+    "sync"
     "time"
 )
 
@@ -20,8 +21,25 @@ var (
     ErrNoOffer = errors.New("table is not offered on given date")
     ErrNoPayInfo = errors.New("no payment info on account")
     ErrImperva = errors.New("imperva challenge detected: cookies expired or invalid")
+    ErrPartyTooLarge = errors.New("party size is larger than the venue accepts online")
+    ErrRateLimited = errors.New("rate limited by reservation service")
+    ErrPaymentRequired = errors.New("payment required to book")
+    ErrServiceUnavailable = errors.New("reservation service is unavailable, possibly for maintenance")
+    ErrAlreadyBooked = errors.New("already have a reservation at this venue for this date")
+    ErrNoCookies = errors.New("no cookies stored for venue: refresh or import them")
+    ErrBudgetExhausted = errors.New("drop attempt budget exhausted")
+    ErrTimeout = errors.New("reservation service did not respond in time")
+    ErrPaymentDeclined = errors.New("every matching slot was declined for payment")
 )
 
+// RetryableErrors are errors worth trying again, e.g. on the next scheduler
+// pass. Callers may append to it to change the policy.
+var RetryableErrors = []error{ErrNetwork, ErrImperva, ErrRateLimited, ErrServiceUnavailable, ErrNoCookies, ErrTimeout}
+
+// TerminalErrors will fail the same way if retried. They take precedence
+// over RetryableErrors.
+var TerminalErrors = []error{ErrLoginWrong, ErrNoPayInfo, ErrPaymentRequired, ErrPartyTooLarge, ErrAlreadyBooked}
+
 // NetworkError wraps ErrNetwork with additional context about what failed
 type NetworkError struct {
     Step    string // e.g., "find", "detail", "book"
@@ -40,11 +58,181 @@ func (e *NetworkError) Unwrap() error {
     return ErrNetwork
 }
 
+// Is lets a NetworkError match the sentinel for its HTTP status
+func (e *NetworkError) Is(target error) bool {
+    switch target {
+    case ErrRateLimited:
+        return e.Status == 429
+    case ErrPaymentRequired:
+        return e.Status == 402
+    }
+    return false
+}
+
 // NewNetworkError creates a new NetworkError with context
 func NewNetworkError(step string, status int, message string) *NetworkError {
     return &NetworkError{Step: step, Status: status, Message: message}
 }
 
+// ServiceUnavailableError wraps ErrServiceUnavailable with how long the
+// service asked clients to wait, if it said
+type ServiceUnavailableError struct {
+    RetryAfter time.Duration // From the Retry-After header, 0 if absent
+}
+
+func (e *ServiceUnavailableError) Error() string {
+    if e.RetryAfter > 0 {
+        return fmt.Sprintf("%s (retry after %s)", ErrServiceUnavailable.Error(), e.RetryAfter)
+    }
+    return ErrServiceUnavailable.Error()
+}
+
+func (e *ServiceUnavailableError) Unwrap() error {
+    return ErrServiceUnavailable
+}
+
+// AvailableSlot describes a slot that was open when no requested slot matched
+type AvailableSlot struct {
+    Time        time.Time
+    TableType   string
+    ConfigToken string  // Identifies the slot to ReserveParam.ConfigToken
+    Deposit     float64 // Deposit the venue charges to book the slot, 0 if none
+    PartySize   int     // With ReserveParam.PartySizes, the party size the slot is for
+}
+
+// NoTableError wraps ErrNoTable with the slots that were open at the venue
+type NoTableError struct {
+    Available       []AvailableSlot
+    NotifyAvailable bool   // The venue offers a notify (waitlist) option for the date
+    BookFailure     string // Why the last matching slot tried couldn't be booked, if any was tried
+}
+
+func (e *NoTableError) Error() string {
+    msg := ErrNoTable.Error()
+    if len(e.Available) > 0 {
+        msg = fmt.Sprintf("%s (%d other slots open)", msg, len(e.Available))
+    }
+    if e.NotifyAvailable {
+        msg += " (notify available)"
+    }
+    if e.BookFailure != "" {
+        msg += " (last book failure: " + e.BookFailure + ")"
+    }
+    return msg
+}
+
+func (e *NoTableError) Unwrap() error {
+    return ErrNoTable
+}
+
+// PaymentDeclinedError wraps ErrPaymentDeclined with what Resy said about the last slot
+type PaymentDeclinedError struct {
+    Reason string // Resy's message for the last declined slot, if it sent one
+}
+
+func (e *PaymentDeclinedError) Error() string {
+    if e.Reason != "" {
+        return ErrPaymentDeclined.Error() + " (last: " + e.Reason + ")"
+    }
+    return ErrPaymentDeclined.Error()
+}
+
+func (e *PaymentDeclinedError) Unwrap() error {
+    return ErrPaymentDeclined
+}
+
+/*
+Name: DropBudget
+Type: API Input Struct
+Purpose: Bound the requests and time one reservation attempt may
+spend, across every find retry, details and book request, so a
+competitive drop stays as aggressive as intended and no more
+Note: The clock starts with the first request. Share one budget
+between the Reserve calls of a single drop (e.g. fallback dates)
+to bound them together. A nil budget is unlimited.
+*/
+type DropBudget struct {
+    MaxRequests int           // 0 means no request limit
+    MaxDuration time.Duration // 0 means no time limit
+
+    mu      sync.Mutex
+    used    int
+    started time.Time
+}
+
+// NewDropBudget returns a budget of maxRequests requests over maxDuration,
+// or nil if both are 0
+func NewDropBudget(maxRequests int, maxDuration time.Duration) *DropBudget {
+    if maxRequests <= 0 && maxDuration <= 0 {
+        return nil
+    }
+    return &DropBudget{MaxRequests: maxRequests, MaxDuration: maxDuration}
+}
+
+// Spend takes one request from the budget, or returns ErrBudgetExhausted
+func (b *DropBudget) Spend() error {
+    if b == nil {
+        return nil
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+
+    if b.started.IsZero() {
+        b.started = time.Now()
+    }
+    if b.MaxRequests > 0 && b.used >= b.MaxRequests {
+        return fmt.Errorf("%w: all %d requests used", ErrBudgetExhausted, b.MaxRequests)
+    }
+    if b.MaxDuration > 0 && time.Since(b.started) >= b.MaxDuration {
+        return fmt.Errorf("%w: %s elapsed", ErrBudgetExhausted, b.MaxDuration)
+    }
+    b.used++
+    return nil
+}
+
+// Used returns how many requests have been taken from the budget
+func (b *DropBudget) Used() int {
+    if b == nil {
+        return 0
+    }
+    b.mu.Lock()
+    defer b.mu.Unlock()
+    return b.used
+}
+
+/*
+Name: IsRetryable
+Type: API Func
+Purpose: Classify an error as worth retrying or terminal, so the
+scheduler and HTTP handlers share one retry policy
+Note: Terminal errors win over retryable ones. A NetworkError is
+retryable for a 5xx or 429 status and terminal for any other 4xx;
+with no status it falls back to ErrNetwork, which is retryable.
+Errors in neither list are not retried.
+*/
+func IsRetryable(err error) bool {
+    if err == nil {
+        return false
+    }
+    for _, terminal := range TerminalErrors {
+        if errors.Is(err, terminal) {
+            return false
+        }
+    }
+
+    var netErr *NetworkError
+    if errors.As(err, &netErr) && netErr.Status >= 400 {
+        return netErr.Status >= 500 || netErr.Status == 429
+    }
+
+    for _, retryable := range RetryableErrors {
+        if errors.Is(err, retryable) {
+            return true
+        }
+    }
+    return false
+}
+
 
 /*
 Name: LoginParam
@@ -88,6 +276,7 @@ type LoginResponse struct {
     Email           string 
     PaymentMethodID int64  
     AuthToken       string 
+    AuthTokens      map[string]string // Other tokens the login returned, keyed by response field name
 }
 
 /*
@@ -104,9 +293,14 @@ type SearchParam struct {
 Name: SeachResponse
 Type: API Func Output Struct
 Purpose: Output information from 'Search' api function 
+Note: Skipped counts hits the service returned that could not be
+parsed into results, with a reason for each in Warnings, so a
+short result list can be told apart from a partial one
 */
 type SearchResponse struct {
-    Results []SearchResult
+    Results  []SearchResult
+    Skipped  int
+    Warnings []string
 }
 
 /*
@@ -143,13 +337,55 @@ const (
 Name: ReserveParam
 Type: API Func Input Struct
 Purpose: Input information to the 'Reserve' api function 
+Note: TableFlexibility maps a table type to the maximum distance
+a slot may be from a requested time and still be accepted for that
+table type. Table types without an entry only accept the exact
+requested time, unless AllowClosest is set, in which case they
+accept the closest slot within the default window.
+When DryRun is set, the slot that would be booked is returned
+without holding or booking it.
+FindPartySize, when set, is the party size used to search for
+slots; the slot is still held and booked for PartySize. Searching
+with a nearby size can surface slots the exact size doesn't list,
+but the booking may then be refused if the venue won't seat
+PartySize at that table.
+ConfigToken, when set, names the exact slot to book (from a
+find response), so find and slot matching are skipped and
+ReservationTimes[0] should be that slot's time. TableTypes,
+TableFlexibility and FindPartySize are then ignored.
+ListMatches returns every slot that matches, best first, in
+ReserveResponse.Matches without holding or booking any of them.
+Budget, when set, caps the requests the attempt may send; once
+it runs out Reserve fails with ErrBudgetExhausted.
+PartySizes lists other sizes the party could be. Slots are then
+searched for PartySize and each of them at once, and the best
+match across all sizes is booked, preferring PartySize and then
+the order given when matches rank equally. FindPartySize is then
+ignored.
+EarliestTime and LatestTime, when either is set, accept any slot
+between them (inclusive) on the requested date instead of a
+tolerance around each requested time, so TableFlexibility,
+AllowClosest and MaxTimeWindow are ignored. A zero bound leaves
+that side open. Slots in the window are still ranked by table
+preference, then by closeness to the requested times.
 */
 type ReserveParam struct {
     VenueID          int64
     ReservationTimes []time.Time
     PartySize        int
     TableTypes       []TableType
+    TableFlexibility map[TableType]time.Duration
     LoginResp        LoginResponse
+    DryRun           bool
+    FindPartySize    int    // Optional, party size to search slots with; 0 means PartySize
+    ConfigToken      string // Optional, book this slot directly instead of searching
+    Budget           *DropBudget // Optional, shared cap on requests and time
+    ListMatches      bool   // Optional, list the matching slots instead of booking one
+    AllowClosest     bool   // Optional, book the closest slot when the exact time is taken
+    MaxTimeWindow    time.Duration // Optional, with AllowClosest, how far the closest slot may be; 0 means 30 minutes
+    PartySizes       []int  // Optional, other party sizes to search alongside PartySize
+    EarliestTime     time.Time // Optional, earliest acceptable slot
+    LatestTime       time.Time // Optional, latest acceptable slot
 }
 
 /*
@@ -158,7 +394,36 @@ Type: API Func Output Struct
 Purpose: Output information from the 'Reserve' api function 
 */
 type ReserveResponse struct {
-    ReservationTime time.Time
+    ReservationTime    time.Time
+    ConfirmedPartySize int    // Party size Resy reported for the booking, 0 if not reported
+    ConfirmedDate      string // Date (YYYY-MM-DD) Resy reported for the booking, empty if not reported
+    Matches            []AvailableSlot // With ListMatches, every matching slot, best first
+    ReservationID      string // Resy's ID for the booking, empty if not reported
+    ResyToken          string // Token that cancels the booking, see CancelParam
+    BookedPartySize    int    // With PartySizes, the party size the slot was found and booked for
+    VenueMismatch      bool   // The find response didn't list VenueID, so the slot came from the first venue it did list
+    BookedVenueID      int64  // Venue the slot came from: VenueID, or with VenueMismatch the first listed venue's (0 if unknown)
+}
+
+/*
+Name: CancelParam
+Type: API Func Input Struct
+Purpose: Input information to the 'Cancel' api function
+Note: ResyToken identifies the booking; Resy returns it when the
+booking is made
+*/
+type CancelParam struct {
+    ResyToken       string
+    AuthToken       string
+}
+
+/*
+Name: CancelResponse
+Type: API Func Output Struct
+Purpose: Output information from the 'Cancel' api function
+*/
+type CancelResponse struct {
+    Refund          bool // The venue refunded the deposit or fee, if one was paid
 }
 
 /*
@@ -172,6 +437,7 @@ type API interface {
     Login(params LoginParam) (*LoginResponse, error)
     Search(params SearchParam) (*SearchResponse, error)
     Reserve(params ReserveParam) (*ReserveResponse, error)
+    Cancel(params CancelParam) (*CancelResponse, error)
     AuthMinExpire() (time.Duration)
 }
 
@@ -191,5 +457,8 @@ func (sr *SearchResponse) ToString() (string) {
         respStr += "\t\tLocality: " + e.Locality + "\n"
         respStr += "\t\tNeighborhood: " + e.Neighborhood +"\n"
     }
+    if sr.Skipped > 0 {
+        respStr += "\n(" + strconv.Itoa(sr.Skipped) + " results could not be read and were skipped)\n"
+    }
     return respStr
 }
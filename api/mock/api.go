@@ -0,0 +1,159 @@
+package mock
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/21Bruce/resolved-server/api"
+	"github.com/21Bruce/resolved-server/logging"
+)
+
+/*
+Name: API
+Type: API interface struct
+Purpose: This struct is an offline implementation of the api
+interface for local development. It never contacts Resy.
+Note: Outcomes are chosen from the input so every path can be
+exercised on demand:
+  - Login fails with ErrLoginWrong when the password is "wrong"
+  - Reserve fails with ErrPartyTooLarge for parties over 8
+  - Reserve fails with ErrImperva when the first requested time
+    is at :13 past the hour
+  - Reserve fails with a NoTableError when the first requested
+    time is at :45 past the hour, listing slots 30 minutes either
+    side as open
+  - with ListMatches, any other Reserve lists the first requested
+    time as the only matching slot
+  - any other Reserve books the first requested time
+  - Cancel always succeeds, with a refund unless the resy token
+    is "no-refund"
+*/
+type API struct{}
+
+// maxPartySize is the largest party the mock venues accept online
+const maxPartySize = 8
+
+// mockVenues are the canned search results, matching the venues the app knows about
+var mockVenues = []api.SearchResult{
+	{VenueID: 89607, Name: "Crevette", Region: "NY", Locality: "New York", Neighborhood: "West Village"},
+	{VenueID: 89678, Name: "Farzi NewYork", Region: "NY", Locality: "New York", Neighborhood: "Midtown"},
+	{VenueID: 92807, Name: "Nonna Dora's Tribeca", Region: "NY", Locality: "New York", Neighborhood: "Tribeca"},
+}
+
+/*
+Name: New
+Type: Constructor Func
+Purpose: Create a mock API client
+*/
+func New() *API {
+	return &API{}
+}
+
+/*
+Name: Login
+Type: API Func
+Purpose: Return a fake login for any credentials except the
+password "wrong"
+*/
+func (a *API) Login(params api.LoginParam) (*api.LoginResponse, error) {
+	logging.Info("Mock login", "email", params.Email)
+	if params.Password == "wrong" {
+		return nil, api.ErrLoginWrong
+	}
+	return &api.LoginResponse{
+		ID:              1,
+		FirstName:       "Mock",
+		LastName:        "User",
+		Email:           params.Email,
+		PaymentMethodID: 1,
+		AuthToken:       "mock-auth-token",
+	}, nil
+}
+
+/*
+Name: Search
+Type: API Func
+Purpose: Return the canned venues whose name contains the search
+name, ignoring case
+*/
+func (a *API) Search(params api.SearchParam) (*api.SearchResponse, error) {
+	logging.Info("Mock search", "name", params.Name)
+	results := make([]api.SearchResult, 0, len(mockVenues))
+	for _, venue := range mockVenues {
+		if params.Limit > 0 && len(results) >= params.Limit {
+			break
+		}
+		if strings.Contains(strings.ToLower(venue.Name), strings.ToLower(params.Name)) {
+			results = append(results, venue)
+		}
+	}
+	return &api.SearchResponse{Results: results}, nil
+}
+
+/*
+Name: Reserve
+Type: API Func
+Purpose: Simulate a booking, with the outcome chosen from the
+party size and first requested time as described on API
+*/
+func (a *API) Reserve(params api.ReserveParam) (*api.ReserveResponse, error) {
+	if len(params.ReservationTimes) == 0 {
+		return nil, api.ErrTimeNull
+	}
+	reservationTime := params.ReservationTimes[0]
+	logging.Info("Mock reserve", "venue_id", params.VenueID, "party_size", params.PartySize,
+		"reservation_time", reservationTime.Format(time.RFC3339), "dry_run", params.DryRun)
+
+	if params.PartySize > maxPartySize {
+		return nil, api.ErrPartyTooLarge
+	}
+
+	switch reservationTime.Minute() {
+	case 13:
+		return nil, api.ErrImperva
+	case 45:
+		return nil, &api.NoTableError{Available: []api.AvailableSlot{
+			{Time: reservationTime.Add(-30 * time.Minute), TableType: string(api.DiningRoom)},
+			{Time: reservationTime.Add(30 * time.Minute), TableType: string(api.Bar)},
+		}}
+	}
+
+	if params.ListMatches {
+		slot := api.AvailableSlot{Time: reservationTime, TableType: string(api.DiningRoom), ConfigToken: "mock-config-token"}
+		return &api.ReserveResponse{ReservationTime: reservationTime, Matches: []api.AvailableSlot{slot}}, nil
+	}
+
+	// Report the date as the venue would, in NYC time
+	venueTime := reservationTime
+	if nycLocation, err := time.LoadLocation("America/New_York"); err == nil {
+		venueTime = reservationTime.In(nycLocation)
+	}
+
+	return &api.ReserveResponse{
+		ReservationTime:    reservationTime,
+		ConfirmedPartySize: params.PartySize,
+		ConfirmedDate:      venueTime.Format("2006-01-02"),
+		ReservationID:      strconv.FormatInt(reservationTime.Unix(), 10),
+		ResyToken:          "mock-resy-token",
+	}, nil
+}
+
+/*
+Name: Cancel
+Type: API Func
+Purpose: Simulate cancelling a booking
+*/
+func (a *API) Cancel(params api.CancelParam) (*api.CancelResponse, error) {
+	logging.Info("Mock cancel", "resy_token", params.ResyToken)
+	return &api.CancelResponse{Refund: params.ResyToken != "no-refund"}, nil
+}
+
+/*
+Name: AuthMinExpire
+Type: API Func
+Purpose: Match the resy client's auth token lifetime
+*/
+func (a *API) AuthMinExpire() time.Duration {
+	return 6 * 24 * time.Hour
+}
@@ -8,16 +8,23 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/21Bruce/resolved-server/api"
 	"github.com/21Bruce/resolved-server/config"
+	"github.com/21Bruce/resolved-server/logging"
 	"github.com/21Bruce/resolved-server/store"
 )
 
@@ -35,6 +42,136 @@ type API struct {
 	APIKey    string
 	Cookies   []*http.Cookie // Imperva cookies for bypassing WAF
 	UserAgent string         // User agent matching the cookies
+
+	cookieSet   int             // Index of the venue cookie set loaded from the store
+	cookieVenue int64           // Venue the in-memory cookies belong to, 0 if set by hand
+	debugBuf    *bytes.Buffer   // Collects debugf output during a Reserve call, nil otherwise
+	budget      *api.DropBudget // Request budget of a Reserve call's copy, see callCopy; nil otherwise
+	client      *http.Client    // Shared by all of this client's requests; set by GetDefaultAPI and never changed
+}
+
+// errSlotUnusable marks failures that rule out a single slot
+// rather than the whole reservation attempt
+var errSlotUnusable = errors.New("slot cannot be booked")
+
+// errSlotPaymentDeclined marks a slot whose book request Resy refused with
+// a 402; it is always wrapped together with errSlotUnusable
+var errSlotPaymentDeclined = errors.New("book request declined for payment (HTTP 402)")
+
+// Shared by every API client so concurrent drops can't burst past the
+// configured number of in-flight Resy requests; nil means unlimited
+var (
+	requestSlotsOnce sync.Once
+	requestSlots     chan struct{}
+)
+
+// defaultMaxTimeDiff is how far a slot may be from a requested time
+// when closest matches are allowed and no per-table-type flexibility
+// is configured
+const defaultMaxTimeDiff = 30 * time.Minute
+
+/*
+Name: maxTimeDiffFor
+Type: Internal Func
+Purpose: Return how far a slot of a table type may be from a
+requested time and still be booked
+Note: An explicit TableFlexibility entry always applies. Otherwise
+only exact times match unless AllowClosest is set, in which case
+the window is MaxTimeWindow, or defaultMaxTimeDiff if that is 0.
+*/
+func maxTimeDiffFor(params api.ReserveParam, tableType api.TableType) time.Duration {
+	if tolerance, ok := params.TableFlexibility[tableType]; ok && tolerance >= 0 {
+		return tolerance
+	}
+	if params.AllowClosest {
+		if params.MaxTimeWindow > 0 {
+			return params.MaxTimeWindow
+		}
+		return defaultMaxTimeDiff
+	}
+	return 0
+}
+
+/*
+Name: httpClient
+Type: Internal Func
+Purpose: Return the HTTP client all of this API's Resy requests
+share, so connections to Resy are reused
+Note: The client is built once by GetDefaultAPI, with
+RESY_REQUEST_TIMEOUT, and only read afterwards, since the API is
+shared by concurrent requests. An API made some other way gets a
+new client per call rather than having one stored on it.
+*/
+func (a *API) httpClient() *http.Client {
+	if a.client != nil {
+		return a.client
+	}
+	return &http.Client{Timeout: config.Get().RequestTimeout}
+}
+
+/*
+Name: doLimited
+Type: Internal Func
+Purpose: Send a request once one of the RESY_MAX_CONCURRENT_REQUESTS
+slots shared by all clients is free
+Note: The slot is held until the response headers arrive. Transport
+errors are classified by classifyTransportError.
+*/
+func doLimited(client *http.Client, req *http.Request) (*http.Response, error) {
+	requestSlotsOnce.Do(func() {
+		if limit := config.Get().MaxConcurrentRequests; limit > 0 {
+			requestSlots = make(chan struct{}, limit)
+		}
+	})
+	if requestSlots == nil {
+		resp, err := client.Do(req)
+		return resp, classifyTransportError(err)
+	}
+
+	select {
+	case requestSlots <- struct{}{}:
+	case <-req.Context().Done():
+		return nil, req.Context().Err()
+	}
+	defer func() { <-requestSlots }()
+	resp, err := client.Do(req)
+	return resp, classifyTransportError(err)
+}
+
+/*
+Name: classifyTransportError
+Type: Internal Func
+Purpose: Tell a request that timed out, which a retry may well
+fix, apart from a refused connection, which means Resy is down
+Note: Timeouts wrap api.ErrTimeout and refusals api.ErrNetwork;
+other errors are returned unchanged
+*/
+func classifyTransportError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return fmt.Errorf("%w: %w", api.ErrTimeout, err)
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return fmt.Errorf("%w: %w", api.ErrNetwork, err)
+	}
+	return err
+}
+
+/*
+Name: doBudgeted
+Type: Internal Func
+Purpose: Send a request through doLimited once it has been taken
+from the current Reserve call's drop budget
+*/
+func (a *API) doBudgeted(client *http.Client, req *http.Request) (*http.Response, error) {
+	if err := a.budget.Spend(); err != nil {
+		a.debugf("Not sending %s %s: %v\n", req.Method, req.URL.Path, err)
+		return nil, err
+	}
+	return doLimited(client, req)
 }
 
 /*
@@ -98,11 +235,15 @@ func (a *API) SetCookies(cookies []*http.Cookie, userAgent string) {
 Name: addCookiesToRequest
 Type: Internal Func
 Purpose: Add Imperva cookies and user agent to HTTP request
+Note: Only cookies whose domain applies to the request host are
+added, so a cookie scoped to www.resy.com is not sent to
+api.resy.com while one scoped to .resy.com is sent to both
 */
 func (a *API) addCookiesToRequest(req *http.Request) {
-	// Add cookies to request
-	if len(a.Cookies) > 0 {
-		for _, cookie := range a.Cookies {
+	// Add cookies that apply to the request host
+	host := req.URL.Hostname()
+	for _, cookie := range a.Cookies {
+		if store.CookieDomainMatches(cookie.Domain, host) {
 			req.AddCookie(cookie)
 		}
 	}
@@ -111,6 +252,29 @@ func (a *API) addCookiesToRequest(req *http.Request) {
 	if a.UserAgent != "" {
 		req.Header.Set("User-Agent", a.UserAgent)
 	}
+
+	applyExtraHeaders(req)
+}
+
+/*
+Name: applyExtraHeaders
+Type: Internal Func
+Purpose: Set the client version headers and the operator-configured
+extra headers on an outbound Resy request
+Note: Version headers come from RESY_CLIENT_HEADERS, copied from
+resy.com's own client in a browser's network tab; none are sent
+unless it is set. Extra headers come from RESY_EXTRA_HEADERS so a header Resy
+starts requiring can be added without a code change. Both replace
+any value the request already has, and extra headers win over
+version headers of the same name.
+*/
+func applyExtraHeaders(req *http.Request) {
+	for name, value := range config.Get().ClientHeaders {
+		req.Header.Set(name, value)
+	}
+	for name, value := range config.Get().ExtraHeaders {
+		req.Header.Set(name, value)
+	}
 }
 
 /*
@@ -121,7 +285,7 @@ Purpose: Extract cookies from HTTP response headers and update API client cookie
 func (a *API) extractCookiesFromResponse(resp *http.Response) {
 	// Check if this is an Imperva response
 	if resp.Header.Get("X-Cdn") == "Imperva" || resp.Header.Get("Server") == "nginx" {
-		fmt.Println("Detected Imperva challenge response, extracting cookies...")
+		a.debugf("Detected Imperva challenge response, extracting cookies...\n")
 
 		// Parse Set-Cookie headers
 		for _, cookieStr := range resp.Header.Values("Set-Cookie") {
@@ -151,7 +315,7 @@ func (a *API) extractCookiesFromResponse(resp *http.Response) {
 						for i := 1; i < len(parts); i++ {
 							part := strings.TrimSpace(parts[i])
 							if strings.HasPrefix(strings.ToLower(part), "domain=") {
-								cookie.Domain = strings.TrimPrefix(part, "domain=")
+								cookie.Domain = store.NormalizeCookieDomain(part[len("domain="):])
 							} else if strings.HasPrefix(strings.ToLower(part), "path=") {
 								cookie.Path = strings.TrimPrefix(part, "path=")
 							} else if strings.ToLower(part) == "secure" {
@@ -167,29 +331,104 @@ func (a *API) extractCookiesFromResponse(resp *http.Response) {
 							}
 						}
 
-						// Add or update cookie
-						found := false
-						for i, existingCookie := range a.Cookies {
-							if existingCookie.Name == cookie.Name {
-								a.Cookies[i] = cookie
-								found = true
-								break
-							}
-						}
-						if !found {
-							a.Cookies = append(a.Cookies, cookie)
-						}
+						a.addCookie(cookie)
 
-						fmt.Printf("Extracted Imperva cookie: %s\n", cookie.Name)
+						a.debugf("Extracted Imperva cookie: %s\n", cookie.Name)
 					}
 				}
 			}
 		}
 
 		if len(a.Cookies) > 0 {
-			fmt.Printf("Updated API client with %d Imperva cookies from challenge response\n", len(a.Cookies))
+			a.debugf("Updated API client with %d Imperva cookies from challenge response\n", len(a.Cookies))
+		}
+	}
+}
+
+/*
+Name: addCookie
+Type: Internal Func
+Purpose: Add a cookie to the client, replacing any with the same
+name
+Note: Imperva names session cookies per site and session, so a
+long-lived client keeps learning new names. Beyond RESY_MAX_COOKIES
+the oldest cookies are dropped.
+*/
+func (a *API) addCookie(cookie *http.Cookie) {
+	for i, existingCookie := range a.Cookies {
+		if existingCookie.Name == cookie.Name {
+			a.Cookies[i] = cookie
+			return
+		}
+	}
+	a.Cookies = append(a.Cookies, cookie)
+
+	if limit := config.Get().MaxCookies; limit > 0 && len(a.Cookies) > limit {
+		a.debugf("Dropping %d oldest cookies to stay within %d\n", len(a.Cookies)-limit, limit)
+		a.Cookies = append([]*http.Cookie(nil), a.Cookies[len(a.Cookies)-limit:]...)
+	}
+}
+
+/*
+Name: setAuthHeaders
+Type: Internal Func
+Purpose: Set the user auth token headers on a find, details
+or book request
+Note: Resy's web client has sent the universal token as both
+X-Resy-Universal-Auth and X-Resy-Universal-Auth-Token, so by
+default both are sent. The set is configurable through
+RESY_UNIVERSAL_AUTH_HEADER in case Resy starts rejecting one.
+*/
+func setAuthHeaders(req *http.Request, authToken string) {
+	req.Header.Set("X-Resy-Auth-Token", authToken)
+	switch config.Get().UniversalAuthHeader {
+	case config.UniversalAuthHeaderToken:
+		req.Header.Set("X-Resy-Universal-Auth-Token", authToken)
+	case config.UniversalAuthHeaderPlain:
+		req.Header.Set("X-Resy-Universal-Auth", authToken)
+	default:
+		req.Header.Set("X-Resy-Universal-Auth", authToken)
+		req.Header.Set("X-Resy-Universal-Auth-Token", authToken)
+	}
+}
+
+/*
+Name: extraAuthTokens
+Type: Internal Func
+Purpose: Collect the token fields of a login response other than
+"token", e.g. a separate universal or legacy token
+Note: Returns nil when the response has none
+*/
+func extraAuthTokens(jsonMap map[string]interface{}) map[string]string {
+	var tokens map[string]string
+	for key, value := range jsonMap {
+		token, ok := value.(string)
+		if !ok || token == "" || key == "token" || !strings.HasSuffix(strings.ToLower(key), "token") {
+			continue
+		}
+		if tokens == nil {
+			tokens = make(map[string]string)
 		}
+		tokens[key] = token
 	}
+	return tokens
+}
+
+/*
+Name: authTokenFor
+Type: Internal Func
+Purpose: Pick the auth token to send on a request step ("find",
+"detail" or "book")
+Note: RESY_AUTH_TOKEN_FIELDS names the login response field to use
+per step. Steps without an entry, and fields the login didn't
+return, use the main token.
+*/
+func authTokenFor(step string, login api.LoginResponse) string {
+	field := config.Get().AuthTokenFields[step]
+	if token := login.AuthTokens[field]; field != "" && token != "" {
+		return token
+	}
+	return login.AuthToken
 }
 
 /*
@@ -213,6 +452,54 @@ func isImpervaChallenge(resp *http.Response) bool {
 	return false
 }
 
+/*
+Name: serviceUnavailableError
+Type: Internal Func
+Purpose: Check if an HTTP response is Resy itself being down,
+e.g. for maintenance, rather than an Imperva challenge
+Note: Returns nil if it isn't. Imperva challenge pages mention
+Incapsula; a 503 whose body mentions maintenance, or that didn't
+come through Imperva at all, is treated as the service being down.
+The body is read and replaced so the caller can still read it.
+*/
+func serviceUnavailableError(resp *http.Response) error {
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		return nil
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	lowerBody := strings.ToLower(string(body))
+	if strings.Contains(lowerBody, "incapsula") {
+		return nil
+	}
+	if !strings.Contains(lowerBody, "maintenance") && resp.Header.Get("X-Cdn") == "Imperva" {
+		return nil
+	}
+	return &api.ServiceUnavailableError{RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After"))}
+}
+
+/*
+Name: parseRetryAfter
+Type: Internal Func
+Purpose: Parse a Retry-After header given in seconds or as an
+HTTP date, returning 0 if it is absent or invalid
+*/
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil && at.After(time.Now()) {
+		return time.Until(at)
+	}
+	return 0
+}
+
 /*
 Name: doRequestWithRetry
 Type: Internal Func
@@ -230,11 +517,17 @@ func (a *API) doRequestWithRetry(client *http.Client, req *http.Request, bodyByt
 	originalMethod := req.Method
 
 	var lastImpervaResponse bool
+	// Whether Imperva challenged this request at all, for the venue's stats
+	challenged := false
+
+	// Each of the venue's other cookie sets gets a full round of retries
+	rotations := 0
+	maxRotations := config.Get().CookieSetsPerVenue - 1
 
 	for attempt := 0; attempt <= maxRetries; attempt++ {
-		// On retry, recreate the request with the body
-		if attempt > 0 {
-			fmt.Printf("Retrying request (attempt %d/%d) with updated cookies...\n", attempt+1, maxRetries+1)
+		// On retry, or the first try with a rotated cookie set, recreate the request with the body
+		if attempt > 0 || rotations > 0 {
+			a.debugf("Retrying request (attempt %d/%d) with updated cookies...\n", attempt+1, maxRetries+1)
 
 			// Recreate request with body for POST requests
 			if bodyBytes != nil {
@@ -244,12 +537,17 @@ func (a *API) doRequestWithRetry(client *http.Client, req *http.Request, bodyByt
 					return nil, fmt.Errorf("failed to recreate request: %w", err)
 				}
 
-				// Copy headers from original request
+				// Copy headers from original request, except the cookies which are re-added below
 				for key, values := range originalHeaders {
+					if key == "Cookie" {
+						continue
+					}
 					for _, value := range values {
 						req.Header.Add(key, value)
 					}
 				}
+			} else {
+				req.Header.Del("Cookie")
 			}
 
 			// Re-add cookies in case they were updated
@@ -259,15 +557,23 @@ func (a *API) doRequestWithRetry(client *http.Client, req *http.Request, bodyByt
 			time.Sleep(1 * time.Second)
 		}
 
-		resp, err := client.Do(req)
+		resp, err := a.doBudgeted(client, req)
 		if err != nil {
 			return nil, err
 		}
 
+		// Resy being down won't be fixed by new cookies, so don't spend retries on it
+		if unavailableErr := serviceUnavailableError(resp); unavailableErr != nil {
+			resp.Body.Close()
+			a.debugf("Resy is unavailable (status %d), not retrying: %v\n", resp.StatusCode, unavailableErr)
+			return nil, unavailableErr
+		}
+
 		// Check if this is an Imperva challenge
 		if isImpervaChallenge(resp) {
-			fmt.Printf("Received Imperva challenge (status %d), extracting cookies and retrying...\n", resp.StatusCode)
+			a.debugf("Received Imperva challenge (status %d), extracting cookies and retrying...\n", resp.StatusCode)
 			lastImpervaResponse = true
+			challenged = true
 
 			// Extract cookies from response
 			a.extractCookiesFromResponse(resp)
@@ -276,15 +582,26 @@ func (a *API) doRequestWithRetry(client *http.Client, req *http.Request, bodyByt
 			if attempt < maxRetries {
 				resp.Body.Close()
 				continue
+			} else if rotations < maxRotations && a.rotateCookieSet(venueID) {
+				// This cookie set looks revoked; start over with the venue's next set
+				resp.Body.Close()
+				rotations++
+				// -1 so the loop's increment gives the new set a full round
+				attempt = -1
+				continue
 			} else {
 				// Retries exhausted - return ErrImperva
 				resp.Body.Close()
-				fmt.Println("Retries exhausted, Imperva challenge not resolved. Please refresh cookies via /admin/cookies/import")
+				a.debugf("Retries exhausted, Imperva challenge not resolved. Please refresh cookies via /admin/cookies/import\n")
+				a.recordImpervaChallenge(venueID, false)
 				return nil, api.ErrImperva
 			}
 		}
 
 		lastImpervaResponse = false
+		if challenged {
+			a.recordImpervaChallenge(venueID, true)
+		}
 		return resp, nil
 	}
 
@@ -294,22 +611,88 @@ func (a *API) doRequestWithRetry(client *http.Client, req *http.Request, bodyByt
 	return nil, fmt.Errorf("max retries exceeded")
 }
 
+/*
+Name: recordImpervaChallenge
+Type: Internal Func
+Purpose: Count a challenged request in the venue's stats, and
+whether retrying resolved it
+Note: Requests not made for a venue, such as login, aren't counted.
+A failure to record is only logged.
+*/
+func (a *API) recordImpervaChallenge(venueID int64, resolved bool) {
+	if venueID == 0 {
+		return
+	}
+	if err := store.RecordImpervaChallenge(context.Background(), venueID, resolved); err != nil {
+		a.debugf("Failed to record Imperva challenge for venue %d: %v\n", venueID, err)
+	}
+}
+
 /*
 Name: LoadCookiesFromStore
 Type: API Func
 Purpose: Load cookies from Redis store for a venue
+Note: When a venue has several cookie sets, the active
+set is used, or the next stored one if it has expired.
+Cookies held for a different venue are dropped first, even
+if this venue has none stored; cookies set by hand are kept.
+Note: Reserve calls this on its per-call copy, so the shared
+API's cookies are never replaced.
 */
 func (a *API) LoadCookiesFromStore(venueID int64) error {
+	// Another venue's cookies, including those picked up from its challenges,
+	// must not be sent for this one
+	if a.cookieVenue != 0 && a.cookieVenue != venueID {
+		a.Cookies = nil
+	}
+	a.cookieVenue = venueID
+
 	ctx := context.Background()
-	cookieData, err := store.GetCookies(ctx, venueID)
+	cookieData, set, err := store.GetHealthyCookieSet(ctx, venueID, config.Get().CookieSetsPerVenue)
 	if err != nil {
 		return err
 	}
 	a.SetCookies(cookieData.Cookies, cookieData.UserAgent)
-	fmt.Printf("Loaded %d cookies from store for venue %d\n", len(cookieData.Cookies), venueID)
+	a.cookieSet = set
+	a.debugf("Loaded %d cookies from store for venue %d (set %d)\n", len(cookieData.Cookies), venueID, set)
 	return nil
 }
 
+/*
+Name: rotateCookieSet
+Type: Internal Func
+Purpose: Drop the current cookie set for a venue after Imperva
+rejected it and switch to the venue's next stored set
+Note: Returns false if the venue has no other set to use. The
+dropped set is re-fetched by the cookie refresh loop. Like
+LoadCookiesFromStore, this only runs on a per-call copy.
+*/
+func (a *API) rotateCookieSet(venueID int64) bool {
+	poolSize := config.Get().CookieSetsPerVenue
+	if venueID == 0 || poolSize <= 1 {
+		return false
+	}
+
+	ctx := context.Background()
+	if err := store.DeleteCookieSet(ctx, venueID, a.cookieSet); err != nil {
+		a.debugf("Error deleting rejected cookie set %d for venue %d: %v\n", a.cookieSet, venueID, err)
+	}
+	if err := store.SetActiveCookieSet(ctx, venueID, (a.cookieSet+1)%poolSize); err != nil {
+		a.debugf("Error advancing active cookie set for venue %d: %v\n", venueID, err)
+	}
+
+	cookieData, set, err := store.GetHealthyCookieSet(ctx, venueID, poolSize)
+	if err != nil {
+		a.debugf("No other cookie set available for venue %d: %v\n", venueID, err)
+		return false
+	}
+
+	a.debugf("Rotating venue %d from cookie set %d to set %d\n", venueID, a.cookieSet, set)
+	a.SetCookies(cookieData.Cookies, cookieData.UserAgent)
+	a.cookieSet = set
+	return true
+}
+
 /*
 Name: GetDefaultAPI
 Type: External Func
@@ -319,6 +702,7 @@ working API struct
 func GetDefaultAPI() API {
 	return API{
 		APIKey: config.Get().ResyAPIKey,
+		client: &http.Client{Timeout: config.Get().RequestTimeout},
 	}
 }
 
@@ -336,23 +720,42 @@ func (a *API) Login(params api.LoginParam) (*api.LoginResponse, error) {
 	bodyStr := `email=` + email + `&password=` + password
 	bodyBytes := []byte(bodyStr)
 
-	request, err := http.NewRequest("POST", authUrl, bytes.NewBuffer(bodyBytes))
-	if err != nil {
-		return nil, err
-	}
+	// Cookies picked up from challenges belong to this call, not to the shared API
+	a = a.callCopy()
+	client := a.httpClient()
+	retries := config.Get().LoginRetries
 
-	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	request.Header.Set("Authorization", `ResyAPI api_key="`+a.APIKey+`"`)
+	// Retry transient failures (connection errors and non-Imperva 5xx);
+	// Imperva challenges are retried inside doRequestWithRetry
+	var response *http.Response
+	for attempt := 0; ; attempt++ {
+		request, err := http.NewRequest("POST", authUrl, bytes.NewBuffer(bodyBytes))
+		if err != nil {
+			return nil, err
+		}
 
-	// Add Imperva cookies and user agent
-	a.addCookiesToRequest(request)
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		request.Header.Set("Authorization", `ResyAPI api_key="`+a.APIKey+`"`)
 
-	client := &http.Client{}
-	response, err := client.Do(request)
+		// Add Imperva cookies and user agent
+		a.addCookiesToRequest(request)
 
-	if err != nil {
-		return nil, err
+		response, err = a.doRequestWithRetry(client, request, bodyBytes, retries, 0)
+		transient := (err != nil && !errors.Is(err, api.ErrImperva) && !errors.Is(err, api.ErrServiceUnavailable)) || (err == nil && response.StatusCode >= 500)
+		if !transient || attempt >= retries {
+			if err != nil {
+				return nil, err
+			}
+			break
+		}
+
+		if response != nil {
+			response.Body.Close()
+		}
+		a.debugf("Transient login failure, retrying (attempt %d/%d)\n", attempt+2, retries+1)
+		time.Sleep(time.Duration(attempt+1) * time.Second)
 	}
+	defer response.Body.Close()
 
 	// Resy servers return a 419 is the auth parameters were invalid
 	if response.StatusCode == 419 {
@@ -363,8 +766,6 @@ func (a *API) Login(params api.LoginParam) (*api.LoginResponse, error) {
 		return nil, api.ErrNetwork
 	}
 
-	defer response.Body.Close()
-
 	responseBody, err := io.ReadAll(response.Body)
 
 	if err != nil {
@@ -389,6 +790,7 @@ func (a *API) Login(params api.LoginParam) (*api.LoginResponse, error) {
 		Email:           jsonMap["em_address"].(string),
 		PaymentMethodID: int64(jsonMap["payment_method_id"].(float64)),
 		AuthToken:       jsonMap["token"].(string),
+		AuthTokens:      extraAuthTokens(jsonMap),
 	}
 
 	return &loginResponse, nil
@@ -419,8 +821,8 @@ func (a *API) Search(params api.SearchParam) (*api.SearchResponse, error) {
 	// Add Imperva cookies and user agent
 	a.addCookiesToRequest(request)
 
-	client := &http.Client{}
-	response, err := client.Do(request)
+	client := a.httpClient()
+	response, err := doLimited(client, request)
 
 	if err != nil {
 		return nil, err
@@ -430,7 +832,7 @@ func (a *API) Search(params api.SearchParam) (*api.SearchResponse, error) {
 
 	if isCodeFail(response.StatusCode) {
 		responseBody, _ := io.ReadAll(response.Body)
-		fmt.Printf("Search request failed with status code: %d, body: %s\n", response.StatusCode, string(responseBody))
+		a.debugf("Search request failed with status code: %d, body: %s\n", response.StatusCode, string(responseBody))
 		return nil, api.ErrNetwork
 	}
 
@@ -442,33 +844,33 @@ func (a *API) Search(params api.SearchParam) (*api.SearchResponse, error) {
 	var jsonTopLevelMap map[string]interface{}
 	err = json.Unmarshal(responseBody, &jsonTopLevelMap)
 	if err != nil {
-		fmt.Printf("Error unmarshaling search response: %v, body: %s\n", err, string(responseBody))
+		a.debugf("Error unmarshaling search response: %v, body: %s\n", err, string(responseBody))
 		return nil, err
 	}
 
 	// Check if "search" key exists
 	searchValue, ok := jsonTopLevelMap["search"]
 	if !ok {
-		fmt.Printf("Search response missing 'search' key. Response: %s\n", string(responseBody))
+		a.debugf("Search response missing 'search' key. Response: %s\n", string(responseBody))
 		return nil, api.ErrNetwork
 	}
 
 	jsonSearchMap, ok := searchValue.(map[string]interface{})
 	if !ok {
-		fmt.Printf("Search response 'search' is not a map. Response: %s\n", string(responseBody))
+		a.debugf("Search response 'search' is not a map. Response: %s\n", string(responseBody))
 		return nil, api.ErrNetwork
 	}
 
 	// Check if "hits" key exists
 	hitsValue, ok := jsonSearchMap["hits"]
 	if !ok {
-		fmt.Printf("Search response missing 'hits' key. Response: %s\n", string(responseBody))
+		a.debugf("Search response missing 'hits' key. Response: %s\n", string(responseBody))
 		return nil, api.ErrNetwork
 	}
 
 	jsonHitsMap, ok := hitsValue.([]interface{})
 	if !ok {
-		fmt.Printf("Search response 'hits' is not an array. Response: %s\n", string(responseBody))
+		a.debugf("Search response 'hits' is not an array. Response: %s\n", string(responseBody))
 		return nil, api.ErrNetwork
 	}
 
@@ -483,23 +885,27 @@ func (a *API) Search(params api.SearchParam) (*api.SearchResponse, error) {
 	}
 
 	searchResults := make([]api.SearchResult, 0, limit)
+	var warnings []string
 	for i := 0; i < limit; i++ {
 		jsonHitMap, ok := jsonHitsMap[i].(map[string]interface{})
 		if !ok {
-			fmt.Printf("Hit %d is not a map, skipping\n", i)
+			a.debugf("Hit %d is not a map, skipping\n", i)
+			warnings = append(warnings, fmt.Sprintf("result %d skipped: not an object", i))
 			continue
 		}
 
 		// Safely extract fields with nil checks
 		objectID, ok := jsonHitMap["objectID"].(string)
 		if !ok {
-			fmt.Printf("Hit %d missing or invalid objectID, skipping\n", i)
+			a.debugf("Hit %d missing or invalid objectID, skipping\n", i)
+			warnings = append(warnings, fmt.Sprintf("result %d skipped: missing or invalid venue ID", i))
 			continue
 		}
 
 		venueID, err := strconv.ParseInt(objectID, 10, 64)
 		if err != nil {
-			fmt.Printf("Error parsing venueID %s: %v, skipping\n", objectID, err)
+			a.debugf("Error parsing venueID %s: %v, skipping\n", objectID, err)
+			warnings = append(warnings, fmt.Sprintf("result %d skipped: invalid venue ID %q", i, objectID))
 			continue
 		}
 
@@ -518,38 +924,97 @@ func (a *API) Search(params api.SearchParam) (*api.SearchResponse, error) {
 	}
 
 	searchResponse := api.SearchResponse{
-		Results: searchResults,
+		Results:  searchResults,
+		Skipped:  len(warnings),
+		Warnings: warnings,
 	}
 
 	return &searchResponse, nil
 }
 
+/*
+Name: debugf
+Type: Internal Func
+Purpose: Write verbose request/response detail
+Note: Secrets are masked with logging.RedactSensitive. During
+Reserve the output is buffered whatever LOG_LEVEL is, and only
+logged if the attempt fails; otherwise each line is a debug log
+entry, dropped unless LOG_LEVEL is debug
+*/
+func (a *API) debugf(format string, args ...interface{}) {
+	if a.debugBuf == nil && !logging.DebugEnabled() {
+		return
+	}
+	line := logging.RedactSensitive(fmt.Sprintf(format, args...))
+	if a.debugBuf != nil {
+		a.debugBuf.WriteString(line)
+		return
+	}
+	logging.Debug(strings.TrimRight(line, "\n"))
+}
+
 /*
 Name: Reserve
 Type: API Func
 Purpose: Resy implementation of the Reserve api func
+Note: The outcome is logged at info (success) or error (failure).
+With RESY_DEBUG_LOG "failure" the full request/response log is
+held back and logged at error with a failure, at any LOG_LEVEL;
+with "always" it is logged at debug as it happens
 */
 func (a *API) Reserve(params api.ReserveParam) (*api.ReserveResponse, error) {
-	fmt.Println("Starting Reserve function")
-	defer fmt.Println("Exiting Reserve function")
+	// The debug log and request budget belong to this call, not to the shared API
+	call := a.callCopy()
+	call.budget = params.Budget
+	var debugLog *bytes.Buffer
+	if config.Get().ResyDebugLog != config.ResyDebugLogAlways {
+		debugLog = &bytes.Buffer{}
+		call.debugBuf = debugLog
+	}
+	resp, err := call.reserve(params)
+
+	if err != nil {
+		if debugLog != nil {
+			logging.Error("Reserve debug log", "venue_id", params.VenueID, "log", debugLog.String())
+		}
+		logging.Error("Reserve failed", "venue_id", params.VenueID, "error", logging.RedactSensitive(err.Error()))
+		return nil, err
+	}
+	logging.Info("Reserve succeeded", "venue_id", params.VenueID, "party_size", params.PartySize,
+		"reservation_time", resp.ReservationTime.Format(time.RFC3339), "dry_run", params.DryRun)
+	return resp, nil
+}
+
+/*
+Name: reserve
+Type: Internal Func
+Purpose: Perform a Reserve attempt, logging through debugf
+*/
+func (a *API) reserve(params api.ReserveParam) (*api.ReserveResponse, error) {
+	a.debugf("Starting Reserve function\n")
+	defer a.debugf("Exiting Reserve function\n")
 
 	// Try to load cookies from Redis store for this venue
 	if err := a.LoadCookiesFromStore(params.VenueID); err != nil {
-		fmt.Printf("Warning: Could not load cookies from store for venue %d: %v\n", params.VenueID, err)
+		// Without cookies the find step is all but certain to hit Imperva
+		if errors.Is(err, store.ErrNoCookies) && config.Get().RequireCookies {
+			return nil, api.ErrNoCookies
+		}
+		a.debugf("Warning: Could not load cookies from store for venue %d: %v\n", params.VenueID, err)
 		// Continue anyway - cookies might have been set manually or we'll get Imperva error
 	}
 
 	// Converting fields to URL query format
 	// IMPORTANT: Convert to NYC timezone before extracting date components
 	// The reservation time is stored in UTC, but Resy expects the date in NYC timezone
-	fmt.Println("Converting reservation times to date string")
+	a.debugf("Converting reservation times to date string\n")
 	nycLocation, err := time.LoadLocation("America/New_York")
 	if err != nil {
-		fmt.Printf("Error loading NYC timezone: %v, using UTC\n", err)
+		a.debugf("Error loading NYC timezone: %v, using UTC\n", err)
 		nycLocation = time.UTC
 	}
 	reservationTimeNYC := params.ReservationTimes[0].In(nycLocation)
-	fmt.Printf("Reservation time in NYC: %s\n", reservationTimeNYC.Format("2006-01-02 15:04:05 MST"))
+	a.debugf("Reservation time in NYC: %s\n", reservationTimeNYC.Format("2006-01-02 15:04:05 MST"))
 
 	year := strconv.Itoa(reservationTimeNYC.Year())
 	monthInt := int(reservationTimeNYC.Month())
@@ -560,152 +1025,113 @@ func (a *API) Reserve(params api.ReserveParam) (*api.ReserveResponse, error) {
 	day := fmt.Sprintf("%02d", dayInt)
 
 	date := year + "-" + month + "-" + day
-	fmt.Printf("Formatted date: %s\n", date)
-	fmt.Printf("Using venue_id: %d\n", params.VenueID)
+	a.debugf("Formatted date: %s\n", date)
+	a.debugf("Using venue_id: %d\n", params.VenueID)
 
-	// Use JSON body for find request (Resy API expects application/json)
-	requestBody := map[string]interface{}{
-		"day":        date,
-		"venue_id":   params.VenueID,
-		"party_size": params.PartySize,
-		"lat":        0,
-		"long":       0,
+	// A caller that already picked a slot skips find and matching entirely
+	if params.ConfigToken != "" {
+		return a.reserveConfigToken(params, date)
 	}
-	bodyBytes, err := json.Marshal(requestBody)
-	if err != nil {
-		fmt.Printf("Error marshaling find request body: %v\n", err)
-		return nil, err
+
+	// A flexible party searches every size it could be before booking
+	if len(params.PartySizes) > 0 {
+		return a.reservePartySizes(params, nycLocation)
 	}
-	fmt.Printf("Find request body: %s\n", string(bodyBytes))
 
-	findUrl := "https://api.resy.com/4/find"
-	fmt.Printf("Find URL: %s\n", findUrl)
+	// Find may search with a different party size than is booked; details and book always use PartySize
+	findPartySize := params.FindPartySize
+	if findPartySize <= 0 {
+		findPartySize = params.PartySize
+	}
+	if findPartySize != params.PartySize {
+		a.debugf("Searching slots for party size %d, booking for %d\n", findPartySize, params.PartySize)
+	}
 
-	request, err := http.NewRequest("POST", findUrl, bytes.NewBuffer(bodyBytes))
+	request, bodyBytes, err := a.newFindRequest(params, date, findPartySize)
 	if err != nil {
-		fmt.Printf("Error creating find request: %v\n", err)
 		return nil, err
 	}
 
-	// Setting headers - Important: User-Agent needed to bypass Imperva WAF
-	fmt.Println("Setting headers for find request")
-	request.Header.Set("Content-Type", "application/json")
-	request.Header.Set("Authorization", `ResyAPI api_key="`+a.APIKey+`"`)
-	request.Header.Set("X-Resy-Auth-Token", params.LoginResp.AuthToken)
-	request.Header.Set("X-Resy-Universal-Auth-Token", params.LoginResp.AuthToken)
-	request.Header.Set("Referer", "https://resy.com/")
-	request.Header.Set("Origin", "https://resy.com")
-
-	// Add Imperva cookies and user agent (will override default User-Agent if set)
-	a.addCookiesToRequest(request)
-
-	// Fallback to default User-Agent if not set via cookies
-	if a.UserAgent == "" {
-		request.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
-	}
-
-	// POST Variations (uncomment to try if GET fails):
-	//
-	// Option A: POST with auth token in body (form-encoded)
-	// bodyStr := fmt.Sprintf("day=%s&venue_id=%d&party_size=%d&x-resy-auth-token=%s",
-	//     url.QueryEscape(date), params.VenueID, params.PartySize, url.QueryEscape(params.LoginResp.AuthToken))
-	// request, err = http.NewRequest("POST", "https://api.resy.com/4/find", bytes.NewBuffer([]byte(bodyStr)))
-	// request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	//
-	// Option B: POST with JSON body
-	// requestBody := map[string]interface{}{
-	//     "day": date,
-	//     "venue_id": params.VenueID,
-	//     "party_size": params.PartySize,
-	//     "x-resy-auth-token": params.LoginResp.AuthToken,
-	// }
-	// jsonBody, _ := json.Marshal(requestBody)
-	// request, err = http.NewRequest("POST", "https://api.resy.com/4/find", bytes.NewBuffer(jsonBody))
-	// request.Header.Set("Content-Type", "application/json")
-	//
-	// Option C: Add User-Agent header (as book endpoint uses)
-	// request.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
-	//
-	// Option D: Try X-Resy-Universal-Auth instead of X-Resy-Universal-Auth-Token (as book endpoint uses)
-	// request.Header.Set("X-Resy-Universal-Auth", params.LoginResp.AuthToken)
-	// Remove or comment out: request.Header.Set("X-Resy-Universal-Auth-Token", ...)
-
 	// Enhanced debugging: Print all request details
-	fmt.Println("=== REQUEST DEBUG INFO ===")
-	fmt.Printf("Method: %s\n", request.Method)
-	fmt.Printf("URL: %s\n", request.URL.String())
-	fmt.Println("Headers:")
+	a.debugf("=== REQUEST DEBUG INFO ===\n")
+	a.debugf("Method: %s\n", request.Method)
+	a.debugf("URL: %s\n", request.URL.String())
+	a.debugf("Headers:\n")
 	for key, values := range request.Header {
 		for _, value := range values {
 			// Mask auth token in logs for security
 			if strings.Contains(key, "Auth") {
-				fmt.Printf("  %s: %s\n", key, "***REDACTED***")
+				a.debugf("  %s: %s\n", key, "***REDACTED***")
 			} else {
-				fmt.Printf("  %s: %s\n", key, value)
+				a.debugf("  %s: %s\n", key, value)
 			}
 		}
 	}
-	fmt.Println("==========================")
+	a.debugf("==========================\n")
 
-	client := &http.Client{}
-	fmt.Println("Sending find request")
+	client := a.httpClient()
+	a.debugf("Sending find request\n")
 
 	// Use retry logic for Imperva challenges (pass bodyBytes to recreate request on retry, and venueID for fallback)
 	response, err := a.doRequestWithRetry(client, request, bodyBytes, 2, params.VenueID)
 	if err != nil {
-		fmt.Printf("Error sending find request: %v\n", err)
+		a.debugf("Error sending find request: %v\n", err)
 		return nil, err
 	}
-	fmt.Printf("Received find response with status code: %d\n", response.StatusCode)
+	a.debugf("Received find response with status code: %d\n", response.StatusCode)
 
 	// Enhanced debugging: Print response headers
-	fmt.Println("=== RESPONSE DEBUG INFO ===")
-	fmt.Printf("Status Code: %d\n", response.StatusCode)
-	fmt.Println("Response Headers:")
+	a.debugf("=== RESPONSE DEBUG INFO ===\n")
+	a.debugf("Status Code: %d\n", response.StatusCode)
+	a.debugf("Response Headers:\n")
 	for key, values := range response.Header {
 		for _, value := range values {
-			fmt.Printf("  %s: %s\n", key, value)
+			a.debugf("  %s: %s\n", key, value)
 		}
 	}
-	fmt.Println("===========================")
+	a.debugf("===========================\n")
 
 	defer response.Body.Close()
 
 	// Always read the response body, even on error, to see what the API says
 	responseBody, err := io.ReadAll(response.Body)
 	if err != nil {
-		fmt.Printf("Error reading find response body: %v\n", err)
+		a.debugf("Error reading find response body: %v\n", err)
 		return nil, err
 	}
-	fmt.Printf("Find response body: %s\n", string(responseBody))
+	a.debugf("Find response body: %s\n", string(responseBody))
 
 	if isCodeFail(response.StatusCode) {
-		fmt.Printf("Find request failed with status code: %d\n", response.StatusCode)
-		fmt.Printf("Error details: %s\n", string(responseBody))
+		a.debugf("Find request failed with status code: %d\n", response.StatusCode)
+		a.debugf("Error details: %s\n", string(responseBody))
 
 		// Enhanced error parsing: Try to extract detailed error information
 		errorMsg := string(responseBody)
 		var errorMap map[string]interface{}
 		if json.Unmarshal(responseBody, &errorMap) == nil {
-			fmt.Println("=== PARSED ERROR DETAILS ===")
+			a.debugf("=== PARSED ERROR DETAILS ===\n")
 			for key, value := range errorMap {
-				fmt.Printf("  %s: %v\n", key, value)
+				a.debugf("  %s: %v\n", key, value)
 			}
-			fmt.Println("============================")
+			a.debugf("============================\n")
 
 			if message, ok := errorMap["message"].(string); ok {
-				fmt.Printf("API error message: %s\n", message)
+				a.debugf("API error message: %s\n", message)
 				errorMsg = message
 			}
 			if errorType, ok := errorMap["type"].(string); ok {
-				fmt.Printf("API error type: %s\n", errorType)
+				a.debugf("API error type: %s\n", errorType)
 			}
 			if errors, ok := errorMap["errors"].(map[string]interface{}); ok {
-				fmt.Printf("API errors object: %v\n", errors)
+				a.debugf("API errors object: %v\n", errors)
+			}
+			if isPartyTooLarge(errorMap) {
+				a.debugf("Party size %d is larger than venue %d accepts online\n", params.PartySize, params.VenueID)
+				return nil, api.ErrPartyTooLarge
 			}
 		} else {
 			// If not JSON, print raw response
-			fmt.Printf("Response is not JSON, raw content: %s\n", string(responseBody))
+			a.debugf("Response is not JSON, raw content: %s\n", string(responseBody))
 		}
 
 		return nil, api.NewNetworkError("find", response.StatusCode, errorMsg)
@@ -714,441 +1140,1017 @@ func (a *API) Reserve(params api.ReserveParam) (*api.ReserveResponse, error) {
 	var jsonTopLevelMap map[string]interface{}
 	err = json.Unmarshal(responseBody, &jsonTopLevelMap)
 	if err != nil {
-		fmt.Printf("Error unmarshaling find response JSON: %v\n", err)
+		a.debugf("Error unmarshaling find response JSON: %v\n", err)
 		return nil, err
 	}
 
 	// Navigate JSON structure
-	fmt.Println("Parsing JSON response for venues and slots")
+	a.debugf("Parsing JSON response for venues and slots\n")
 	jsonResultsMap, ok := jsonTopLevelMap["results"].(map[string]interface{})
 	if !ok {
-		fmt.Println("Error: 'results' key not found or invalid in JSON response")
+		a.debugf("Error: 'results' key not found or invalid in JSON response\n")
 		return nil, api.NewNetworkError("find", 0, "invalid response: 'results' key not found")
 	}
 
 	jsonVenuesList, ok := jsonResultsMap["venues"].([]interface{})
 	if !ok {
-		fmt.Println("Error: 'venues' key not found or invalid in JSON response")
+		a.debugf("Error: 'venues' key not found or invalid in JSON response\n")
 		return nil, api.NewNetworkError("find", 0, "invalid response: 'venues' key not found")
 	}
 
 	if len(jsonVenuesList) == 0 {
-		fmt.Println("No venues found in the response")
+		a.debugf("No venues found in the response\n")
 		return nil, api.ErrNoOffer
 	}
 
-	// Find the venue that matches the requested venue ID
-	var jsonVenueMap map[string]interface{}
+	// Collect every venue block that matches the requested venue ID. Resy
+	// can return the same venue more than once (e.g. different configs), so
+	// all matching blocks are kept and their slots merged below.
+	var jsonVenueMaps []map[string]interface{}
 	for i, v := range jsonVenuesList {
 		venue, ok := v.(map[string]interface{})
 		if !ok {
-			fmt.Printf("Skipping invalid venue structure at index %d\n", i)
+			a.debugf("Skipping invalid venue structure at index %d\n", i)
 			continue
 		}
 
-		// Try to extract venue ID from the response structure
-		// Resy API returns venue info nested under "venue" key
-		if venueInfo, ok := venue["venue"].(map[string]interface{}); ok {
-			if idInfo, ok := venueInfo["id"].(map[string]interface{}); ok {
-				if resyID, ok := idInfo["resy"].(float64); ok {
-					fmt.Printf("Found venue at index %d with ID %d\n", i, int64(resyID))
-					if int64(resyID) == params.VenueID {
-						fmt.Printf("Matched requested venue ID %d\n", params.VenueID)
-						jsonVenueMap = venue
-						break
-					}
-				}
+		if resyID, ok := venueBlockID(venue); ok {
+			a.debugf("Found venue at index %d with ID %d\n", i, resyID)
+			if resyID == params.VenueID {
+				a.debugf("Matched requested venue ID %d\n", params.VenueID)
+				jsonVenueMaps = append(jsonVenueMaps, venue)
 			}
 		}
 	}
 
-	// If no matching venue found, log warning and fall back to first venue
-	if jsonVenueMap == nil {
-		fmt.Printf("Warning: Could not find venue matching ID %d in response, using first venue\n", params.VenueID)
-		var ok bool
-		jsonVenueMap, ok = jsonVenuesList[0].(map[string]interface{})
+	// If no matching venue found, fall back to the first venue if allowed, and
+	// flag the response so the caller knows the booking may be elsewhere
+	venueMismatch := false
+	bookedVenueID := params.VenueID
+	if len(jsonVenueMaps) == 0 {
+		if !config.Get().FirstVenueFallback {
+			a.debugf("Could not find venue matching ID %d in response, not falling back to first venue\n", params.VenueID)
+			return nil, api.ErrNoOffer
+		}
+		a.debugf("Warning: Could not find venue matching ID %d in response, using first venue\n", params.VenueID)
+		jsonVenueMap, ok := jsonVenuesList[0].(map[string]interface{})
 		if !ok {
-			fmt.Println("Error: Invalid venue structure in JSON response")
+			a.debugf("Error: Invalid venue structure in JSON response\n")
 			return nil, api.NewNetworkError("find", 0, "invalid response: venue structure is invalid")
 		}
+		jsonVenueMaps = append(jsonVenueMaps, jsonVenueMap)
+		venueMismatch = true
+		bookedVenueID, _ = venueBlockID(jsonVenueMap)
+	} else if len(jsonVenueMaps) > 1 {
+		a.debugf("Venue ID %d appears in %d venue blocks, merging their slots\n", params.VenueID, len(jsonVenueMaps))
 	}
 
-	jsonSlotsList, ok := jsonVenueMap["slots"].([]interface{})
-	if !ok {
-		fmt.Println("Error: 'slots' key not found or invalid in venue JSON")
-		return nil, api.NewNetworkError("find", 0, "invalid response: 'slots' key not found in venue")
+	jsonSlotsList, err := mergeVenueSlots(jsonVenueMaps)
+	if err != nil {
+		a.debugf("Error: 'slots' invalid in venue JSON\n")
+		return nil, err
 	}
 
-	fmt.Printf("Number of slots available: %d\n", len(jsonSlotsList))
-
-	// Iterate over table types and reservation times
-	// If no table types specified, match any slot based on time only
-	hasTableTypePreference := len(params.TableTypes) > 0
+	notifyAvailable := venueNotifyAvailable(jsonVenueMaps)
+	if len(jsonSlotsList) == 0 {
+		a.debugf("No slots in venue response (notify available: %t)\n", notifyAvailable)
+		return nil, &api.NoTableError{NotifyAvailable: notifyAvailable}
+	}
 
-	for k := 0; k < len(params.TableTypes) || (!hasTableTypePreference && k == 0); k++ {
-		var currentTableType api.TableType
-		if hasTableTypePreference {
-			currentTableType = params.TableTypes[k]
-			fmt.Printf("Searching for table type: %s\n", currentTableType)
-		} else {
-			fmt.Printf("No table type preference provided. Matching any slot based on time only.\n")
-		}
+	a.debugf("Number of slots available: %d\n", len(jsonSlotsList))
 
-		for i := 0; i < len(params.ReservationTimes); i++ {
-			currentTime := params.ReservationTimes[i]
-			fmt.Printf("Checking reservation time: %s\n", currentTime.Format("2006-01-02 15:04:00"))
-
-			// First pass: Try to find exact match, then closest match within window
-			var bestSlot map[string]interface{}
-			var bestSlotIndex int = -1
-			var bestSlotTime time.Time
-			var bestSlotConfigToken string
-			var bestTimeDiff time.Duration = 31 * time.Minute // Track smallest time difference found (start larger than max)
-			const maxTimeDiff = 30 * time.Minute              // Maximum allowed time difference
-			foundExactMatch := false
-
-			fmt.Printf("Starting slot search for time %s (total slots: %d)\n", currentTime.Format("15:04"), len(jsonSlotsList))
-
-			for j := 0; j < len(jsonSlotsList); j++ {
-				fmt.Printf("Evaluating slot %d\n", j)
-				jsonSlotMap, ok := jsonSlotsList[j].(map[string]interface{})
-				if !ok {
-					fmt.Printf("Error: Invalid slot structure at index %d\n", j)
-					continue
-				}
+	// Remember every open slot so a failed match can report what was available
+	availableSlots := collectAvailableSlots(jsonSlotsList, nycLocation)
 
-				jsonDateMap, ok := jsonSlotMap["date"].(map[string]interface{})
-				if !ok {
-					fmt.Printf("Error: 'date' key missing or invalid in slot %d\n", j)
-					continue
-				}
+	// Every qualifying slot, best first: by table type preference, then
+	// requested time, then closeness to it. Each is tried in turn until one
+	// books, so a slot Resy refuses (e.g. with a 402) doesn't end the attempt.
+	candidates := rankMatches(availableSlots, params, nycLocation)
+	a.debugf("%d candidate slots match the request\n", len(candidates))
 
-				startRaw, ok := jsonDateMap["start"].(string)
-				if !ok {
-					fmt.Printf("Error: 'start' key missing or invalid in slot %d\n", j)
-					continue
-				}
-				fmt.Printf("Slot start time: %s\n", startRaw)
+	if params.ListMatches {
+		a.debugf("Listing %d matching slots without booking\n", len(candidates))
+		if len(candidates) == 0 {
+			return nil, &api.NoTableError{Available: availableSlots, NotifyAvailable: notifyAvailable}
+		}
+		return &api.ReserveResponse{ReservationTime: candidates[0].Time, Matches: candidates, VenueMismatch: venueMismatch, BookedVenueID: bookedVenueID}, nil
+	}
 
-				startFields := strings.Split(startRaw, " ")
-				if len(startFields) != 2 {
-					fmt.Printf("Error: Unexpected 'start' format in slot %d\n", j)
-					continue
-				}
+	if len(candidates) > 0 && params.DryRun {
+		a.debugf("Dry run: would book slot at %s, skipping detail and book requests\n", candidates[0].Time.Format("15:04"))
+		return &api.ReserveResponse{ReservationTime: candidates[0].Time, VenueMismatch: venueMismatch, BookedVenueID: bookedVenueID}, nil
+	}
 
-				dateStr := startFields[0]
-				timeFields := strings.Split(startFields[1], ":")
-				if len(timeFields) != 3 {
-					fmt.Printf("Error: Unexpected time format in slot %d\n", j)
-					continue
-				}
+	// Every table type and time stays in play after a failed book, up to
+	// RESY_MAX_BOOK_CANDIDATES slots
+	if limit := config.Get().MaxBookCandidates; limit > 0 && len(candidates) > limit {
+		a.debugf("Trying only the best %d of %d candidate slots\n", limit, len(candidates))
+		candidates = candidates[:limit]
+	}
 
-				// Parse the slot's full date/time
-				// NOTE: Resy API returns times in the venue's local timezone (NYC), not UTC
-				// We need to parse it as NYC time and compare with the requested time in NYC
-				dateTimeStr := dateStr + " " + timeFields[0] + ":" + timeFields[1] + ":00"
-				slotTime, err := time.ParseInLocation("2006-01-02 15:04:05", dateTimeStr, nycLocation)
-				if err != nil {
-					fmt.Printf("Error parsing slot time: %v\n", err)
-					continue
-				}
-				fmt.Printf("Parsed slot time (NYC): %s\n", slotTime.Format("2006-01-02 15:04:05 MST"))
-
-				// Convert currentTime to NYC for comparison
-				currentTimeNYC := currentTime.In(nycLocation)
-
-				// Check if the slot is on the same date as the requested time (in NYC timezone)
-				slotDateStr := slotTime.Format("2006-01-02")
-				currentDateStr := currentTimeNYC.Format("2006-01-02")
-				if slotTime.Year() != currentTimeNYC.Year() ||
-					slotTime.Month() != currentTimeNYC.Month() ||
-					slotTime.Day() != currentTimeNYC.Day() {
-					fmt.Printf("Slot %d date %s doesn't match requested date %s, skipping\n",
-						j, slotDateStr, currentDateStr)
-					continue
-				}
-				fmt.Printf("Slot %d date matches: %s\n", j, slotDateStr)
+	declined := 0
+	var lastBookErr error
+	for i, slot := range candidates {
+		a.debugf("Trying candidate %d of %d: %s (%s)\n", i+1, len(candidates), slot.Time.Format("15:04"), slot.TableType)
+		resp, err := a.bookSlot(client, params, slot.ConfigToken, date, slot.Time)
+		if errors.Is(err, errSlotUnusable) {
+			if errors.Is(err, errSlotPaymentDeclined) {
+				declined++
+			}
+			a.debugf("Skipping slot: %v\n", err)
+			lastBookErr = err
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		resp.VenueMismatch, resp.BookedVenueID = venueMismatch, bookedVenueID
+		return resp, nil
+	}
 
-				// Check if the slot matches the desired time (exact match) using NYC times
-				timeMatches := slotTime.Hour() == currentTimeNYC.Hour() && slotTime.Minute() == currentTimeNYC.Minute()
+	if declined > 0 && declined == len(candidates) {
+		a.debugf("Every candidate slot was declined for payment\n")
+		// Pass on what Resy said about the last one
+		reason := strings.TrimPrefix(bookFailure(lastBookErr), errSlotPaymentDeclined.Error())
+		return nil, &api.PaymentDeclinedError{Reason: strings.TrimPrefix(reason, ": ")}
+	}
 
-				// Get config map to check table type
-				jsonConfigMap, ok := jsonSlotMap["config"].(map[string]interface{})
-				if !ok {
-					fmt.Printf("Error: 'config' key missing or invalid in slot %d\n", j)
-					continue
-				}
+	// If no candidate could be booked
+	a.debugf("No available tables found for the given parameters\n")
+	return nil, &api.NoTableError{Available: availableSlots, NotifyAvailable: notifyAvailable, BookFailure: bookFailure(lastBookErr)}
+}
 
-				// Check table type if preference is specified
-				if hasTableTypePreference {
-					tableType, ok := jsonConfigMap["type"].(string)
-					if !ok {
-						fmt.Printf("Error: 'type' key missing or invalid in config of slot %d\n", j)
-						continue
-					}
-					fmt.Printf("Slot %d table type: %s\n", j, tableType)
+/*
+Name: newFindRequest
+Type: Internal Func
+Purpose: Build the find request for a venue's slots on date,
+returning its body too so it can be resent on a retry
+*/
+func (a *API) newFindRequest(params api.ReserveParam, date string, partySize int) (*http.Request, []byte, error) {
+	// Use JSON body for find request (Resy API expects application/json)
+	requestBody := map[string]interface{}{
+		"day":        date,
+		"venue_id":   params.VenueID,
+		"party_size": partySize,
+		"lat":        0,
+		"long":       0,
+	}
+	bodyBytes, err := json.Marshal(requestBody)
+	if err != nil {
+		a.debugf("Error marshaling find request body: %v\n", err)
+		return nil, nil, err
+	}
+	a.debugf("Find request body: %s\n", string(bodyBytes))
 
-					if !strings.Contains(strings.ToLower(tableType), string(currentTableType)) {
-						fmt.Printf("Slot %d table type '%s' doesn't match preference '%s', skipping\n", j, tableType, currentTableType)
-						continue
-					}
-				} else {
-					// Just log the table type for debugging
-					if tableType, ok := jsonConfigMap["type"].(string); ok {
-						fmt.Printf("Slot %d table type: %s (no preference, accepting any)\n", j, tableType)
-					}
-				}
+	findUrl := "https://api.resy.com/4/find"
+	a.debugf("Find URL: %s\n", findUrl)
 
-				// If exact time match, use it immediately
-				if timeMatches {
-					fmt.Printf("Found exact match at slot %d for time %s\n", j, currentTimeNYC.Format("15:04"))
-					bestSlot = jsonSlotMap
-					bestSlotIndex = j
-					bestSlotTime = slotTime
-					configToken, ok := jsonConfigMap["token"].(string)
-					if ok {
-						bestSlotConfigToken = configToken
-					}
-					foundExactMatch = true
-					break
-				}
+	request, err := http.NewRequest("POST", findUrl, bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		a.debugf("Error creating find request: %v\n", err)
+		return nil, nil, err
+	}
 
-				// If no exact match yet, track the closest slot within the time window
-				// Compare using NYC times since slots are in NYC timezone
-				if !foundExactMatch {
-					timeDiff := slotTime.Sub(currentTimeNYC)
-					absTimeDiff := timeDiff
-					if absTimeDiff < 0 {
-						absTimeDiff = -absTimeDiff // Use absolute value
-					}
-					fmt.Printf("Slot %d time difference from requested: %v (absolute: %v)\n", j, timeDiff, absTimeDiff)
-
-					// Only consider slots within the max time window and that are better than current best
-					if absTimeDiff <= maxTimeDiff && absTimeDiff < bestTimeDiff {
-						bestTimeDiff = absTimeDiff
-						bestSlot = jsonSlotMap
-						bestSlotIndex = j
-						bestSlotTime = slotTime
-						configToken, ok := jsonConfigMap["token"].(string)
-						if ok {
-							bestSlotConfigToken = configToken
-						}
-						fmt.Printf("Found closer slot at index %d (time difference: %v, slot time: %s)\n",
-							j, absTimeDiff, slotTime.Format("15:04"))
-					}
-				}
+	// Setting headers - Important: User-Agent needed to bypass Imperva WAF
+	a.debugf("Setting headers for find request\n")
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", `ResyAPI api_key="`+a.APIKey+`"`)
+	setAuthHeaders(request, authTokenFor("find", params.LoginResp))
+	request.Header.Set("Referer", "https://resy.com/")
+	request.Header.Set("Origin", "https://resy.com")
+
+	// Add Imperva cookies and user agent (will override default User-Agent if set)
+	a.addCookiesToRequest(request)
+
+	// Fallback to default User-Agent if not set via cookies
+	if a.UserAgent == "" {
+		request.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
+	}
+
+	// POST Variations (uncomment to try if GET fails):
+	//
+	// Option A: POST with auth token in body (form-encoded)
+	// bodyStr := fmt.Sprintf("day=%s&venue_id=%d&party_size=%d&x-resy-auth-token=%s",
+	//     url.QueryEscape(date), params.VenueID, params.PartySize, url.QueryEscape(params.LoginResp.AuthToken))
+	// request, err = http.NewRequest("POST", "https://api.resy.com/4/find", bytes.NewBuffer([]byte(bodyStr)))
+	// request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	//
+	// Option B: POST with JSON body
+	// requestBody := map[string]interface{}{
+	//     "day": date,
+	//     "venue_id": params.VenueID,
+	//     "party_size": params.PartySize,
+	//     "x-resy-auth-token": params.LoginResp.AuthToken,
+	// }
+	// jsonBody, _ := json.Marshal(requestBody)
+	// request, err = http.NewRequest("POST", "https://api.resy.com/4/find", bytes.NewBuffer(jsonBody))
+	// request.Header.Set("Content-Type", "application/json")
+	//
+	// Option C: Add User-Agent header (as book endpoint uses)
+	// request.Header.Set("User-Agent", "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/91.0.4472.124 Safari/537.36")
+
+	return request, bodyBytes, nil
+}
+
+/*
+Name: reservePartySizes
+Type: Internal Func
+Purpose: Search slots for PartySize and each of PartySizes at once,
+then book the best match across all of them
+Note: At most PARTY_SIZE_SEARCH_CONCURRENCY searches run at a time,
+each on its own copy of the client so their cookies and logs stay
+apart; their requests still share the global request limit. Matches
+are ranked together, ties going to PartySize and then the order of
+PartySizes. A match that can no longer be booked falls through to
+the next. If no size has a match, the first size's error is
+returned.
+*/
+func (a *API) reservePartySizes(params api.ReserveParam, location *time.Location) (*api.ReserveResponse, error) {
+	sizes := []int{params.PartySize}
+	for _, size := range params.PartySizes {
+		if size > 0 && !slices.Contains(sizes, size) {
+			sizes = append(sizes, size)
+		}
+	}
+	a.debugf("Searching party sizes %v at once\n", sizes)
+
+	type sizeResult struct {
+		resp *api.ReserveResponse
+		err  error
+		log  *bytes.Buffer
+	}
+	results := make([]sizeResult, len(sizes))
+	limit := make(chan struct{}, max(config.Get().PartySizeSearchConcurrency, 1))
+	var wg sync.WaitGroup
+	for i, size := range sizes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			limit <- struct{}{}
+			defer func() { <-limit }()
+
+			search := a.searchCopy()
+			sizeParams := params
+			sizeParams.PartySize = size
+			sizeParams.FindPartySize = 0
+			sizeParams.PartySizes = nil
+			sizeParams.ListMatches = true
+			resp, err := search.reserve(sizeParams)
+			results[i] = sizeResult{resp: resp, err: err, log: search.debugBuf}
+		}()
+	}
+	wg.Wait()
+
+	var candidates []api.AvailableSlot
+	var firstErr error
+	for i, result := range results {
+		a.debugf("=== Party size %d search ===\n%s=== End party size %d search ===\n", sizes[i], result.log.String(), sizes[i])
+		if result.err != nil {
+			if firstErr == nil {
+				firstErr = result.err
 			}
+			continue
+		}
+		for _, slot := range result.resp.Matches {
+			slot.PartySize = sizes[i]
+			candidates = append(candidates, slot)
+		}
+	}
+	// The search for a size tells which venue its slots came from
+	searchFor := func(size int) *api.ReserveResponse {
+		return results[slices.Index(sizes, size)].resp
+	}
 
-			// Summary of slot search
-			fmt.Printf("Slot search complete. Found %d slots total.\n", len(jsonSlotsList))
-			currentTimeNYC := currentTime.In(nycLocation)
-			if bestSlotIndex >= 0 {
-				if foundExactMatch {
-					fmt.Printf("✓ Using exact match at slot %d for time %s NYC\n", bestSlotIndex, currentTimeNYC.Format("15:04"))
-				} else {
-					fmt.Printf("✓ No exact match found. Using closest available slot at %s (requested: %s NYC, difference: %v)\n",
-						bestSlotTime.Format("15:04"), currentTimeNYC.Format("15:04"), bestTimeDiff)
-				}
-			} else {
-				fmt.Printf("✗ No suitable slot found within %v of requested time %s NYC\n", maxTimeDiff, currentTimeNYC.Format("15:04"))
+	// Ranking is stable, so equal matches keep the order of sizes
+	matches := rankMatches(candidates, params, location)
+	if len(matches) == 0 {
+		if firstErr == nil {
+			firstErr = &api.NoTableError{}
+		}
+		return nil, firstErr
+	}
+	a.debugf("Found %d matches across party sizes, best for party of %d at %s\n", len(matches), matches[0].PartySize, matches[0].Time.Format("15:04"))
+
+	best := searchFor(matches[0].PartySize)
+	if params.ListMatches {
+		return &api.ReserveResponse{ReservationTime: matches[0].Time, Matches: matches, BookedPartySize: matches[0].PartySize,
+			VenueMismatch: best.VenueMismatch, BookedVenueID: best.BookedVenueID}, nil
+	}
+	if params.DryRun {
+		return &api.ReserveResponse{ReservationTime: matches[0].Time, BookedPartySize: matches[0].PartySize,
+			VenueMismatch: best.VenueMismatch, BookedVenueID: best.BookedVenueID}, nil
+	}
+
+	var bookFailed string
+	for _, slot := range matches {
+		bookParams := params
+		bookParams.PartySize = slot.PartySize
+		bookParams.FindPartySize = 0
+		bookParams.PartySizes = nil
+		bookParams.ConfigToken = slot.ConfigToken
+		bookParams.ReservationTimes = []time.Time{slot.Time}
+		resp, err := a.reserve(bookParams)
+		if errors.Is(err, api.ErrNoTable) {
+			a.debugf("Match for party of %d at %s could not be booked, trying the next\n", slot.PartySize, slot.Time.Format("15:04"))
+			var noTableErr *api.NoTableError
+			if errors.As(err, &noTableErr) && noTableErr.BookFailure != "" {
+				bookFailed = noTableErr.BookFailure
 			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		resp.BookedPartySize = slot.PartySize
+		search := searchFor(slot.PartySize)
+		resp.VenueMismatch, resp.BookedVenueID = search.VenueMismatch, search.BookedVenueID
+		return resp, nil
+	}
+	return nil, &api.NoTableError{BookFailure: bookFailed}
+}
 
-			// If we found a slot (exact or closest), proceed with booking
-			if bestSlotIndex >= 0 {
+/*
+Name: callCopy
+Type: Internal Func
+Purpose: Copy the client for one call, so the call's cookies,
+debug log and request budget aren't shared with calls running at
+the same time
+Note: The copy takes a's budget, so searches run for one Reserve
+call spend from the same budget.
+Note: The server shares one API between every HTTP handler and
+the scheduler, so per-call state must never be written to it
+*/
+func (a *API) callCopy() *API {
+	return &API{
+		APIKey:      a.APIKey,
+		Cookies:     slices.Clone(a.Cookies),
+		UserAgent:   a.UserAgent,
+		cookieSet:   a.cookieSet,
+		cookieVenue: a.cookieVenue,
+		budget:      a.budget,
+		client:      a.httpClient(),
+	}
+}
 
-				configToken := bestSlotConfigToken
-				if configToken == "" {
-					jsonConfigMap, ok := bestSlot["config"].(map[string]interface{})
-					if !ok {
-						fmt.Printf("Error: 'config' key missing in best slot\n")
-						continue
-					}
-					configToken, ok = jsonConfigMap["token"].(string)
-					if !ok {
-						fmt.Printf("Error: 'token' key missing in best slot config\n")
-						continue
-					}
-				}
+/*
+Name: searchCopy
+Type: Internal Func
+Purpose: Copy the client for a search that runs alongside others,
+with its own cookies and debug log
+*/
+func (a *API) searchCopy() *API {
+	search := a.callCopy()
+	search.debugBuf = &bytes.Buffer{}
+	return search
+}
 
-				detailUrl := "https://api.resy.com/3/details"
-				fmt.Printf("Detail URL: %s\n", detailUrl)
+/*
+Name: reserveConfigToken
+Type: Internal Func
+Purpose: Book the slot named by params.ConfigToken directly,
+without a find request
+Note: The slot is reported as booked at the first reservation
+time, which should be the slot's own time. A token Resy no longer
+accepts for the slot is reported as ErrNoTable.
+*/
+func (a *API) reserveConfigToken(params api.ReserveParam, date string) (*api.ReserveResponse, error) {
+	slotTime := params.ReservationTimes[0]
+	if params.DryRun {
+		a.debugf("Dry run: would book config token slot at %s, skipping detail and book requests\n", slotTime.Format("15:04"))
+		return &api.ReserveResponse{ReservationTime: slotTime}, nil
+	}
 
-				// Prepare the request body
-				requestBody := map[string]string{
-					"commit":     strconv.Itoa(1),                // Convert integer 1 to string
-					"config_id":  configToken,                    // Assuming configToken is already a string
-					"day":        date,                           // Assuming date is already a string
-					"party_size": strconv.Itoa(params.PartySize), // Convert PartySize (an int) to string
-				}
-				jsonBody, err := json.Marshal(requestBody)
+	a.debugf("Booking slot by config token, skipping find\n")
+	resp, err := a.bookSlot(a.httpClient(), params, params.ConfigToken, date, slotTime)
+	if errors.Is(err, errSlotUnusable) {
+		a.debugf("Config token slot could not be booked: %v\n", err)
+		return nil, &api.NoTableError{BookFailure: bookFailure(err)}
+	}
+	return resp, err
+}
 
-				if err != nil {
-					fmt.Printf("Error marshaling request body: %v\n", err)
-					continue
-				}
-				fmt.Printf("Request Body: %s\n", string(jsonBody)) // Add this line
+/*
+Name: bookSlot
+Type: Internal Func
+Purpose: Run the details and book steps for one slot, given its
+config token, and return the confirmed booking
+Note: Failures that only rule out this slot wrap errSlotUnusable,
+so callers can move on to the next candidate. Timeouts and refused
+connections are returned as they are, since Resy may have booked.
+*/
+func (a *API) bookSlot(client *http.Client, params api.ReserveParam, configToken string, date string, slotTime time.Time) (*api.ReserveResponse, error) {
+	bookToken, echo, err := a.requestBookToken(client, authTokenFor("detail", params.LoginResp), configToken, date, params.PartySize)
+	if err != nil {
+		return nil, err
+	}
 
-				requestDetail, err := http.NewRequest("POST", detailUrl, bytes.NewBuffer(jsonBody))
-				if err != nil {
-					fmt.Printf("Error creating detail request: %v\n", err)
-					continue
-				}
+	bookStatus, responseBookBody, err := a.book(client, bookToken, params)
 
-				// Setting headers for detail request
-				// Set the appropriate headers
-				requestDetail.Header.Set("Content-Type", "application/json")
-				requestDetail.Header.Set("Authorization", "ResyAPI api_key=\"VbWk7s3L4KiK5fzlO7JD3Q5EYolJI7n5\"")
+	// The book token can expire between the details and book calls during a slow
+	// drop; get a fresh one from the details step and try the book again
+	for retry := 1; err == nil && isBookTokenExpired(bookStatus, responseBookBody) && retry <= config.Get().BookTokenRetries; retry++ {
+		a.debugf("Book token expired, requesting a fresh one (retry %d/%d)\n", retry, config.Get().BookTokenRetries)
+		bookToken, echo, err = a.requestBookToken(client, authTokenFor("detail", params.LoginResp), configToken, date, params.PartySize)
+		if errors.Is(err, errSlotUnusable) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+		bookStatus, responseBookBody, err = a.book(client, bookToken, params)
+	}
+	if errors.Is(err, errSlotUnusable) || errors.Is(err, api.ErrBudgetExhausted) {
+		return nil, err
+	} else if errors.Is(err, api.ErrTimeout) || errors.Is(err, api.ErrNetwork) {
+		// A timed-out book may still have gone through, so don't move on to another slot
+		a.debugf("Book request did not complete: %v\n", err)
+		return nil, err
+	} else if err != nil {
+		a.debugf("Error booking slot: %v\n", err)
+		return nil, fmt.Errorf("%w: %v", errSlotUnusable, err)
+	}
 
-				// Add Imperva cookies and user agent
-				a.addCookiesToRequest(requestDetail)
+	if isCodeFail(bookStatus) {
+		a.debugf("Book request failed with status code: %d\n", bookStatus)
+		// Another slot won't help if the user is already booked for the day
+		if isAlreadyBooked(responseBookBody) {
+			return nil, api.ErrAlreadyBooked
+		}
+		// Say why, e.g. a declined card or a slot taken meanwhile, when Resy does
+		reason := bookErrorReason(responseBookBody)
+		if reason != "" {
+			a.debugf("Book error: %s\n", reason)
+			reason = ": " + reason
+		}
+		if bookStatus == http.StatusPaymentRequired {
+			a.debugf("Payment error (402) for slot at %s, will try next available slot if any\n", slotTime.Format("15:04"))
+			return nil, fmt.Errorf("%w: %w%s", errSlotUnusable, errSlotPaymentDeclined, reason)
+		}
+		return nil, fmt.Errorf("%w: book request failed with status %d%s", errSlotUnusable, bookStatus, reason)
+	}
 
-				// Fallback to default User-Agent if not set via cookies
-				if a.UserAgent == "" {
-					requestDetail.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
-				}
-				// Log the request headers
-				fmt.Println("Request Headers:")
-				for key, value := range requestDetail.Header {
-					fmt.Printf("%s: %s\n", key, strings.Join(value, ", "))
-				}
+	var bookTopLevelMap map[string]interface{}
+	err = json.Unmarshal(responseBookBody, &bookTopLevelMap)
+	if err != nil {
+		a.debugf("Error unmarshaling book response JSON: %v\n", err)
+		return nil, fmt.Errorf("%w: unreadable book response", errSlotUnusable)
+	}
 
-				fmt.Println("Sending detail request")
-				responseDetail, err := client.Do(requestDetail)
-				print(responseDetail)
-				if err != nil {
-					fmt.Printf("Error sending detail request: %v\n", err)
-					continue
-				}
-				fmt.Printf("Received detail response with status code: %d\n", responseDetail.StatusCode)
+	// Check if booking was successful
+	if _, ok := bookTopLevelMap["reservation_id"]; !ok {
+		a.debugf("Booking response does not contain confirmation\n")
+		a.debugf("Book response JSON: %v\n", bookTopLevelMap)
+		return nil, fmt.Errorf("%w: book response has no confirmation", errSlotUnusable)
+	}
 
-				if isCodeFail(responseDetail.StatusCode) {
-					responseDetailBody, err := io.ReadAll(responseDetail.Body)
-					if err != nil {
-						fmt.Printf("Error reading detail response body: %v\n", err)
-						continue
-					}
-					fmt.Printf("Detail response body: %s\n", string(responseDetailBody))
-					fmt.Printf("Detail request failed with status code: %d\n", responseDetail.StatusCode)
-					return nil, api.NewNetworkError("detail", responseDetail.StatusCode, string(responseDetailBody))
-				}
+	a.debugf("Booking confirmed successfully\n")
 
-				defer responseDetail.Body.Close()
+	// Prefer what the book response reports over the details step
+	echo = echo.merge(parseBookingEcho(bookTopLevelMap))
+	if echo.PartySize != 0 && echo.PartySize != params.PartySize {
+		a.debugf("Warning: booked party size %d differs from requested %d\n", echo.PartySize, params.PartySize)
+	}
+	if echo.Day != "" && echo.Day != date {
+		a.debugf("Warning: booked date %s differs from requested %s\n", echo.Day, date)
+	}
 
-				responseDetailBody, err := io.ReadAll(responseDetail.Body)
-				fmt.Printf("Detail response body: %s\n", string(responseDetailBody))
-				if err != nil {
-					fmt.Printf("Error reading detail response body: %v\n", err)
-					continue
-				}
-				fmt.Printf("Detail response body: %s\n", string(responseDetailBody))
+	resp := api.ReserveResponse{
+		ReservationTime:    slotTime,
+		ConfirmedPartySize: echo.PartySize,
+		ConfirmedDate:      echo.Day,
+		ReservationID:      bookingID(bookTopLevelMap["reservation_id"]),
+	}
+	resp.ResyToken, _ = bookTopLevelMap["resy_token"].(string)
+	return &resp, nil
+}
 
-				var detailTopLevelMap map[string]interface{}
-				err = json.Unmarshal(responseDetailBody, &detailTopLevelMap)
-				if err != nil {
-					fmt.Printf("Error unmarshaling detail response JSON: %v\n", err)
-					return nil, err
-				}
+/*
+Name: bookErrorReason
+Type: Internal Func
+Purpose: Pull the message and type out of a failed book
+response, as the find step does
+Note: Returns "" when the body isn't JSON or has neither. The
+type, when Resy sends one, comes first, e.g. "payment: card
+declined".
+*/
+func bookErrorReason(body []byte) string {
+	var errorMap map[string]interface{}
+	if json.Unmarshal(body, &errorMap) != nil {
+		return ""
+	}
+	message, _ := errorMap["message"].(string)
+	errorType, _ := errorMap["type"].(string)
+	message, errorType = strings.TrimSpace(message), strings.TrimSpace(errorType)
+	switch {
+	case message != "" && errorType != "":
+		return errorType + ": " + message
+	case message != "":
+		return message
+	default:
+		return errorType
+	}
+}
 
-				jsonBookTokenMap, ok := detailTopLevelMap["book_token"].(map[string]interface{})
-				if !ok {
-					fmt.Println("Error: 'book_token' key missing or invalid in detail JSON")
-					continue
-				}
+/*
+Name: bookFailure
+Type: Internal Func
+Purpose: Describe why a slot couldn't be booked, for
+api.NoTableError's BookFailure
+*/
+func bookFailure(err error) string {
+	if err == nil {
+		return ""
+	}
+	return strings.TrimPrefix(err.Error(), errSlotUnusable.Error()+": ")
+}
 
-				bookToken, ok := jsonBookTokenMap["value"].(string)
-				if !ok {
-					fmt.Println("Error: 'value' key missing or invalid in 'book_token'")
-					continue
-				}
-				fmt.Printf("Obtained book token: %s\n", bookToken)
+/*
+Name: bookingID
+Type: Internal Func
+Purpose: Format the reservation_id of a book response as a string
+Note: Resy sends the ID as a number; a string is kept as is
+*/
+func bookingID(v interface{}) string {
+	switch id := v.(type) {
+	case float64:
+		return strconv.FormatInt(int64(id), 10)
+	case string:
+		return id
+	}
+	return ""
+}
 
-				// Proceed to booking step
-				bookUrl := "https://api.resy.com/3/book"
-				fmt.Printf("Book URL: %s\n", bookUrl)
+/*
+Name: isPartyTooLarge
+Type: Internal Func
+Purpose: Check whether a find error response says the party is
+larger than the venue books online
+Note: Resy doesn't document this error, so it is matched loosely:
+an error keyed on 'party_size', or a message mentioning the party
+and a size limit
+*/
+func isPartyTooLarge(errorMap map[string]interface{}) bool {
+	if fieldErrors, ok := errorMap["errors"].(map[string]interface{}); ok {
+		if _, ok := fieldErrors["party_size"]; ok {
+			return true
+		}
+	}
 
-				bookField := "book_token=" + url.QueryEscape(bookToken)
-				paymentMethodStr := `{"id":` + strconv.FormatInt(params.LoginResp.PaymentMethodID, 10) + `}`
-				paymentMethodField := "struct_payment_method=" + url.QueryEscape(paymentMethodStr)
-				requestBookBodyStr := bookField + "&" + paymentMethodField + "&" + "source_id=resy.com-venue-details"
-				fmt.Printf("Book request body: %s\n", requestBookBodyStr)
+	message, _ := errorMap["message"].(string)
+	message = strings.ToLower(message)
+	if !strings.Contains(message, "party") {
+		return false
+	}
+	for _, word := range []string{"large", "exceed", "max", "too many"} {
+		if strings.Contains(message, word) {
+			return true
+		}
+	}
+	return false
+}
 
-				requestBook, err := http.NewRequest("POST", bookUrl, bytes.NewBuffer([]byte(requestBookBodyStr)))
-				if err != nil {
-					fmt.Printf("Error creating book request: %v\n", err)
-					continue
-				}
+/*
+Name: bookingEcho
+Type: Internal Struct
+Purpose: Hold the party size and date Resy reports back for a
+slot being booked, zero when not reported
+*/
+type bookingEcho struct {
+	PartySize int
+	Day       string
+}
 
-				// Setting headers for book request
-				fmt.Println("Setting headers for book request")
-				requestBook.Header.Set("Authorization", `ResyAPI api_key="`+a.APIKey+`"`)
-				requestBook.Header.Set("Content-Type", `application/x-www-form-urlencoded`)
-				requestBook.Header.Set("Host", `api.resy.com`)
-				requestBook.Header.Set("X-Resy-Auth-Token", params.LoginResp.AuthToken)
-				requestBook.Header.Set("X-Resy-Universal-Auth", params.LoginResp.AuthToken)
-				requestBook.Header.Set("Referer", "https://resy.com/")
-
-				// Add Imperva cookies and user agent
-				a.addCookiesToRequest(requestBook)
-
-				// Fallback to default User-Agent if not set via cookies
-				if a.UserAgent == "" {
-					requestBook.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
-				}
+/*
+Name: merge
+Type: Internal Func
+Purpose: Combine two echoes, preferring the values reported in
+other
+*/
+func (e bookingEcho) merge(other bookingEcho) bookingEcho {
+	if other.PartySize != 0 {
+		e.PartySize = other.PartySize
+	}
+	if other.Day != "" {
+		e.Day = other.Day
+	}
+	return e
+}
 
-				fmt.Println("Sending book request")
-				responseBook, err := client.Do(requestBook)
-				if err != nil {
-					fmt.Printf("Error sending book request: %v\n", err)
-					continue
+/*
+Name: parseBookingEcho
+Type: Internal Func
+Purpose: Extract the party size and date from a details or book
+response
+Note: Resy doesn't document where these are echoed, so the top
+level and a nested 'reservation' object are both checked for
+'party_size'/'num_seats' and 'day'/'date'
+*/
+func parseBookingEcho(jsonMap map[string]interface{}) bookingEcho {
+	var echo bookingEcho
+	maps := []map[string]interface{}{jsonMap}
+	if reservation, ok := jsonMap["reservation"].(map[string]interface{}); ok {
+		maps = append(maps, reservation)
+	}
+
+	for _, m := range maps {
+		for _, key := range []string{"party_size", "num_seats"} {
+			if echo.PartySize != 0 {
+				break
+			}
+			switch v := m[key].(type) {
+			case float64:
+				echo.PartySize = int(v)
+			case string:
+				echo.PartySize, _ = strconv.Atoi(v)
+			}
+		}
+		for _, key := range []string{"day", "date"} {
+			if echo.Day != "" {
+				break
+			}
+			// Dates may carry a time ("2025-12-01 19:00:00"); keep the day
+			if v, ok := m[key].(string); ok && len(v) >= 10 {
+				if _, err := time.Parse("2006-01-02", v[:10]); err == nil {
+					echo.Day = v[:10]
 				}
-				fmt.Printf("Received book response with status code: %d\n", responseBook.StatusCode)
+			}
+		}
+	}
+	return echo
+}
+
+/*
+Name: venueBlockID
+Type: Internal Func
+Purpose: Read the Resy venue ID of a venue block in a find response
+Note: Resy nests it as venue.id.resy
+*/
+func venueBlockID(venue map[string]interface{}) (int64, bool) {
+	venueInfo, ok := venue["venue"].(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	idInfo, ok := venueInfo["id"].(map[string]interface{})
+	if !ok {
+		return 0, false
+	}
+	resyID, ok := idInfo["resy"].(float64)
+	if !ok {
+		return 0, false
+	}
+	return int64(resyID), true
+}
+
+/*
+Name: mergeVenueSlots
+Type: Internal Func
+Purpose: Concatenate the slot lists of the find response venue
+blocks for one venue
+Note: Blocks without a slot list are skipped. Resy omits the
+key entirely when a venue has nothing open, so a block with no
+'slots' key counts as zero slots; an error is only returned when
+a block has a 'slots' value that is not a list
+*/
+func mergeVenueSlots(jsonVenueMaps []map[string]interface{}) ([]interface{}, error) {
+	var jsonSlotsList []interface{}
+	for _, jsonVenueMap := range jsonVenueMaps {
+		value, present := jsonVenueMap["slots"]
+		if !present || value == nil {
+			continue
+		}
+		slots, ok := value.([]interface{})
+		if !ok {
+			return nil, api.NewNetworkError("find", 0, "invalid response: 'slots' in venue is not a list")
+		}
+		jsonSlotsList = append(jsonSlotsList, slots...)
+	}
+	return jsonSlotsList, nil
+}
+
+/*
+Name: venueNotifyAvailable
+Type: Internal Func
+Purpose: Report whether any of the find response venue blocks
+offers a notify (waitlist) option for the requested date
+*/
+func venueNotifyAvailable(jsonVenueMaps []map[string]interface{}) bool {
+	for _, jsonVenueMap := range jsonVenueMaps {
+		if notifies, ok := jsonVenueMap["notifies"].([]interface{}); ok && len(notifies) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+Name: collectAvailableSlots
+Type: Internal Func
+Purpose: Extract the start time, table type, config token and
+deposit of every slot in a find response, skipping malformed slots
+*/
+func collectAvailableSlots(jsonSlotsList []interface{}, location *time.Location) []api.AvailableSlot {
+	slots := make([]api.AvailableSlot, 0, len(jsonSlotsList))
+	for _, s := range jsonSlotsList {
+		jsonSlotMap, ok := s.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		jsonDateMap, ok := jsonSlotMap["date"].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		startRaw, ok := jsonDateMap["start"].(string)
+		if !ok {
+			continue
+		}
+		slotTime, err := time.ParseInLocation("2006-01-02 15:04:05", startRaw, location)
+		if err != nil {
+			continue
+		}
+		var tableType, configToken string
+		if jsonConfigMap, ok := jsonSlotMap["config"].(map[string]interface{}); ok {
+			tableType, _ = jsonConfigMap["type"].(string)
+			configToken, _ = jsonConfigMap["token"].(string)
+		}
+		var deposit float64
+		if jsonPaymentMap, ok := jsonSlotMap["payment"].(map[string]interface{}); ok {
+			deposit, _ = jsonPaymentMap["deposit_fee"].(float64)
+		}
+		slots = append(slots, api.AvailableSlot{Time: slotTime, TableType: tableType, ConfigToken: configToken, Deposit: deposit})
+	}
+	return slots
+}
 
-				if isCodeFail(responseBook.StatusCode) {
-					fmt.Printf("Book request failed with status code: %d\n", responseBook.StatusCode)
+/*
+Name: rankMatches
+Type: Internal Func
+Purpose: List the slots the matcher in reserve would accept,
+in the order it would try them
+Note: Slots are ranked by table type preference, then requested
+time, then distance from that time. A slot matching several
+preferences is listed once, at its best rank.
+*/
+func rankMatches(slots []api.AvailableSlot, params api.ReserveParam, location *time.Location) []api.AvailableSlot {
+	tableTypes := params.TableTypes
+	if len(tableTypes) == 0 {
+		tableTypes = []api.TableType{""}
+	}
+
+	var matches []api.AvailableSlot
+	seen := make(map[int]bool)
+	for _, tableType := range tableTypes {
+		maxTimeDiff := maxTimeDiffFor(params, tableType)
+
+		for _, requested := range params.ReservationTimes {
+			requestedNYC := requested.In(location)
+			var group []int
+			for i, slot := range slots {
+				// A slot without a config token can't be booked
+				if seen[i] || slot.ConfigToken == "" {
 					continue
 				}
-
-				responseBookBody, err := io.ReadAll(responseBook.Body)
-				if err != nil {
-					fmt.Printf("Error reading book response body: %v\n", err)
+				slotNYC := slot.Time.In(location)
+				if slotNYC.Format("2006-01-02") != requestedNYC.Format("2006-01-02") {
 					continue
 				}
-				fmt.Printf("Book response body: %s\n", string(responseBookBody))
-
-				var bookTopLevelMap map[string]interface{}
-				err = json.Unmarshal(responseBookBody, &bookTopLevelMap)
-				if err != nil {
-					fmt.Printf("Error unmarshaling book response JSON: %v\n", err)
+				if tableType != "" && !strings.Contains(strings.ToLower(slot.TableType), string(tableType)) {
 					continue
 				}
-
-				// Check if booking was successful
-				if _, ok := bookTopLevelMap["reservation_id"]; ok {
-					fmt.Println("Booking confirmed successfully")
-					resp := api.ReserveResponse{
-						ReservationTime: bestSlotTime,
-					}
-					return &resp, nil
-				} else {
-					fmt.Println("Booking response does not contain confirmation")
-					fmt.Printf("Book response JSON: %v\n", bookTopLevelMap)
-					// If booking failed with 402, it might be a payment issue
-					// Try to continue to next slot if available
-					if responseBook.StatusCode == 402 {
-						fmt.Printf("Payment error (402) for slot at %s, will try next available slot if any\n", bestSlotTime.Format("15:04"))
+				if hasTimeWindow(params) {
+					if !inTimeWindow(params, slot.Time) {
+						continue
 					}
+				} else if absDuration(slotNYC.Sub(requestedNYC)) > maxTimeDiff {
 					continue
 				}
-			} else {
-				// No slot found within the time window
-				fmt.Printf("No available slot found within 30 minutes of requested time %s\n", currentTime.Format("15:04"))
+				group = append(group, i)
+			}
+
+			sort.SliceStable(group, func(x, y int) bool {
+				return absDuration(slots[group[x]].Time.Sub(requested)) < absDuration(slots[group[y]].Time.Sub(requested))
+			})
+			for _, i := range group {
+				seen[i] = true
+				matches = append(matches, slots[i])
 			}
 		}
 	}
+	return matches
+}
+
+/*
+Name: hasTimeWindow
+Type: Internal Func
+Purpose: Report whether slots are matched against an absolute
+window rather than a tolerance around each requested time
+*/
+func hasTimeWindow(params api.ReserveParam) bool {
+	return !params.EarliestTime.IsZero() || !params.LatestTime.IsZero()
+}
+
+/*
+Name: inTimeWindow
+Type: Internal Func
+Purpose: Report whether a slot time falls within EarliestTime
+and LatestTime, inclusive
+Note: A zero bound leaves that side open
+*/
+func inTimeWindow(params api.ReserveParam, t time.Time) bool {
+	if !params.EarliestTime.IsZero() && t.Before(params.EarliestTime) {
+		return false
+	}
+	if !params.LatestTime.IsZero() && t.After(params.LatestTime) {
+		return false
+	}
+	return true
+}
+
+// absDuration returns the absolute value of d
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+/*
+Name: requestBookToken
+Type: Internal Func
+Purpose: Run the details step for a slot's config token and
+return the book token for it
+Note: Errors wrapping errSlotUnusable mean only this slot can't
+be booked; any other error should abort the reservation
+*/
+func (a *API) requestBookToken(client *http.Client, authToken string, configToken string, date string, partySize int) (string, bookingEcho, error) {
+	detailUrl := "https://api.resy.com/3/details"
+	a.debugf("Detail URL: %s\n", detailUrl)
+
+	// Prepare the request body
+	requestBody := map[string]string{
+		"commit":     strconv.Itoa(1),         // Convert integer 1 to string
+		"config_id":  configToken,             // Assuming configToken is already a string
+		"day":        date,                    // Assuming date is already a string
+		"party_size": strconv.Itoa(partySize), // Convert PartySize (an int) to string
+	}
+	jsonBody, err := json.Marshal(requestBody)
+	if err != nil {
+		return "", bookingEcho{}, fmt.Errorf("%w: marshaling detail request body: %v", errSlotUnusable, err)
+	}
+	a.debugf("Request Body: %s\n", string(jsonBody))
+
+	requestDetail, err := http.NewRequest("POST", detailUrl, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return "", bookingEcho{}, fmt.Errorf("%w: creating detail request: %v", errSlotUnusable, err)
+	}
+
+	// Setting headers for detail request
+	requestDetail.Header.Set("Content-Type", "application/json")
+	requestDetail.Header.Set("Authorization", "ResyAPI api_key=\"VbWk7s3L4KiK5fzlO7JD3Q5EYolJI7n5\"")
+	setAuthHeaders(requestDetail, authToken)
+
+	// Add Imperva cookies and user agent
+	a.addCookiesToRequest(requestDetail)
+
+	// Fallback to default User-Agent if not set via cookies
+	if a.UserAgent == "" {
+		requestDetail.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
+	}
+	// Log the request headers
+	a.debugf("Request Headers:\n")
+	for key, value := range requestDetail.Header {
+		a.debugf("%s: %s\n", key, strings.Join(value, ", "))
+	}
+
+	a.debugf("Sending detail request\n")
+	responseDetail, err := a.doBudgeted(client, requestDetail)
+	if errors.Is(err, api.ErrBudgetExhausted) || errors.Is(err, api.ErrTimeout) || errors.Is(err, api.ErrNetwork) {
+		// Resy not answering isn't a problem with this slot
+		return "", bookingEcho{}, err
+	} else if err != nil {
+		return "", bookingEcho{}, fmt.Errorf("%w: sending detail request: %v", errSlotUnusable, err)
+	}
+	defer responseDetail.Body.Close()
+	if unavailableErr := serviceUnavailableError(responseDetail); unavailableErr != nil {
+		return "", bookingEcho{}, unavailableErr
+	}
+	a.debugf("Received detail response with status code: %d\n", responseDetail.StatusCode)
+
+	responseDetailBody, err := io.ReadAll(responseDetail.Body)
+	if err != nil {
+		return "", bookingEcho{}, fmt.Errorf("%w: reading detail response body: %v", errSlotUnusable, err)
+	}
+	a.debugf("Detail response body: %s\n", string(responseDetailBody))
+
+	if isCodeFail(responseDetail.StatusCode) {
+		a.debugf("Detail request failed with status code: %d\n", responseDetail.StatusCode)
+		return "", bookingEcho{}, api.NewNetworkError("detail", responseDetail.StatusCode, string(responseDetailBody))
+	}
+
+	var detailTopLevelMap map[string]interface{}
+	err = json.Unmarshal(responseDetailBody, &detailTopLevelMap)
+	if err != nil {
+		a.debugf("Error unmarshaling detail response JSON: %v\n", err)
+		return "", bookingEcho{}, err
+	}
+
+	jsonBookTokenMap, ok := detailTopLevelMap["book_token"].(map[string]interface{})
+	if !ok {
+		return "", bookingEcho{}, fmt.Errorf("%w: 'book_token' key missing or invalid in detail JSON", errSlotUnusable)
+	}
+
+	bookToken, ok := jsonBookTokenMap["value"].(string)
+	if !ok {
+		return "", bookingEcho{}, fmt.Errorf("%w: 'value' key missing or invalid in 'book_token'", errSlotUnusable)
+	}
+	a.debugf("Obtained book token (%d characters)\n", len(bookToken))
+
+	return bookToken, parseBookingEcho(detailTopLevelMap), nil
+}
+
+/*
+Name: book
+Type: Internal Func
+Purpose: Send the book request for a book token and return the
+response status code and body
+*/
+func (a *API) book(client *http.Client, bookToken string, params api.ReserveParam) (int, []byte, error) {
+	bookUrl := "https://api.resy.com/3/book"
+	a.debugf("Book URL: %s\n", bookUrl)
+
+	bookField := "book_token=" + url.QueryEscape(bookToken)
+	paymentMethodStr := `{"id":` + strconv.FormatInt(params.LoginResp.PaymentMethodID, 10) + `}`
+	paymentMethodField := "struct_payment_method=" + url.QueryEscape(paymentMethodStr)
+	requestBookBodyStr := bookField + "&" + paymentMethodField + "&" + "source_id=resy.com-venue-details"
+	a.debugf("Book request body: %s\n", requestBookBodyStr)
+
+	requestBook, err := http.NewRequest("POST", bookUrl, bytes.NewBuffer([]byte(requestBookBodyStr)))
+	if err != nil {
+		return 0, nil, fmt.Errorf("creating book request: %w", err)
+	}
+
+	// Setting headers for book request
+	a.debugf("Setting headers for book request\n")
+	requestBook.Header.Set("Authorization", `ResyAPI api_key="`+a.APIKey+`"`)
+	requestBook.Header.Set("Content-Type", `application/x-www-form-urlencoded`)
+	requestBook.Header.Set("Host", `api.resy.com`)
+	setAuthHeaders(requestBook, authTokenFor("book", params.LoginResp))
+	requestBook.Header.Set("Referer", "https://resy.com/")
+
+	// Add Imperva cookies and user agent
+	a.addCookiesToRequest(requestBook)
+
+	// Fallback to default User-Agent if not set via cookies
+	if a.UserAgent == "" {
+		requestBook.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
+	}
+
+	a.debugf("Sending book request\n")
+	responseBook, err := a.doBudgeted(client, requestBook)
+	if err != nil {
+		return 0, nil, fmt.Errorf("sending book request: %w", err)
+	}
+	defer responseBook.Body.Close()
+	a.debugf("Received book response with status code: %d\n", responseBook.StatusCode)
+
+	responseBookBody, err := io.ReadAll(responseBook.Body)
+	if err != nil {
+		return responseBook.StatusCode, nil, fmt.Errorf("reading book response body: %w", err)
+	}
+	a.debugf("Book response body: %s\n", string(responseBookBody))
+
+	return responseBook.StatusCode, responseBookBody, nil
+}
+
+/*
+Name: isAlreadyBooked
+Type: Internal Func
+Purpose: Check whether a failed book response says the user
+already has a reservation that conflicts with this one
+Note: Matched on wording rather than a status code, since the
+status Resy uses for this isn't documented. The phrases are kept
+narrow so a slot someone else just took ("already booked") isn't
+mistaken for the user's own reservation.
+*/
+func isAlreadyBooked(body []byte) bool {
+	lowerBody := strings.ToLower(string(body))
+	for _, phrase := range []string{"already have a reservation", "already has a reservation", "existing reservation", "duplicate reservation"} {
+		if strings.Contains(lowerBody, phrase) {
+			return true
+		}
+	}
+	return false
+}
 
-	// If no table was found after all iterations
-	fmt.Println("No available tables found for the given parameters")
-	return nil, api.ErrNoTable
+/*
+Name: isBookTokenExpired
+Type: Internal Func
+Purpose: Check whether a failed book response says the book
+token expired or is no longer valid
+*/
+func isBookTokenExpired(status int, body []byte) bool {
+	if !isCodeFail(status) {
+		return false
+	}
+	lowerBody := strings.ToLower(string(body))
+	mentionsToken := strings.Contains(lowerBody, "book_token") || strings.Contains(lowerBody, "book token")
+	return mentionsToken && (strings.Contains(lowerBody, "expired") || strings.Contains(lowerBody, "invalid"))
 }
 
 /*
@@ -1163,48 +2165,68 @@ func (a *API) AuthMinExpire() time.Duration {
 	return d
 }
 
-//func (a *API) Cancel(params api.CancelParam) (*api.CancelResponse, error) {
-//    cancelUrl := `https://api.resy.com/3/cancel`
-//    resyToken := url.QueryEscape(params.ResyToken)
-//    requestBodyStr := "resy_token=" + resyToken
-//    request, err := http.NewRequest("POST", cancelUrl, bytes.NewBuffer([]byte(requestBodyStr)))
-//    if err != nil {
-//        return nil, err
-//    }
-//
-//    request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-//    request.Header.Set("Authorization", `ResyAPI api_key="` + a.APIKey + `"`)
-//    request.Header.Set("X-Resy-Auth-Token", params.AuthToken)
-//    request.Header.Set("X-Resy-Universal-Auth-Token", params.AuthToken)
-//    request.Header.Set("Referer", "https://resy.com/")
-//    request.Header.Set("Origin", "https://resy.com")
-//
-//
-//    client := &http.Client{}
-//    response, err := client.Do(request)
-//    if err != nil {
-//        return nil, err
-//    }
-//
-//    if isCodeFail(response.StatusCode) {
-//        return nil, api.ErrNetwork
-//    }
-//
-//    responseBody, err := io.ReadAll(response.Body)
-//    if err != nil {
-//        return nil, err
-//    }
-//
-//    defer response.Body.Close()
-//    var jsonTopLevelMap map[string]interface{}
-//    err = json.Unmarshal(responseBody, &jsonTopLevelMap)
-//    if err != nil {
-//        return nil, err
-//    }
-//
-//    jsonPaymentMap := jsonTopLevelMap["payment"].(map[string]interface{})
-//    jsonTransactionMap := jsonPaymentMap["transaction"].(map[string]interface{})
-//    refund := jsonTransactionMap["refund"].(int) == 1
-//    return &api.CancelResponse{Refund: refund}, nil
-//}
-//
+/*
+Name: Cancel
+Type: API Func
+Purpose: Resy implementation of the Cancel api func
+Note: Resy reports the refund as a number (1 for refunded) in
+payment.transaction.refund; a missing field means no refund
+*/
+func (a *API) Cancel(params api.CancelParam) (*api.CancelResponse, error) {
+	cancelUrl := "https://api.resy.com/3/cancel"
+	bodyBytes := []byte("resy_token=" + url.QueryEscape(params.ResyToken))
+
+	// Cookies picked up from challenges belong to this call, not to the shared API
+	a = a.callCopy()
+
+	request, err := http.NewRequest("POST", cancelUrl, bytes.NewBuffer(bodyBytes))
+	if err != nil {
+		return nil, err
+	}
+
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Authorization", `ResyAPI api_key="`+a.APIKey+`"`)
+	setAuthHeaders(request, params.AuthToken)
+	request.Header.Set("Referer", "https://resy.com/")
+	request.Header.Set("Origin", "https://resy.com")
+
+	// Add Imperva cookies and user agent
+	a.addCookiesToRequest(request)
+	if a.UserAgent == "" {
+		request.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36")
+	}
+
+	response, err := a.doRequestWithRetry(a.httpClient(), request, bodyBytes, 2, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if isCodeFail(response.StatusCode) {
+		a.debugf("Cancel request failed with status code: %d, body: %s\n", response.StatusCode, string(responseBody))
+		return nil, api.NewNetworkError("cancel", response.StatusCode, "cancel request failed")
+	}
+
+	var jsonTopLevelMap map[string]interface{}
+	if err := json.Unmarshal(responseBody, &jsonTopLevelMap); err != nil {
+		return nil, api.NewNetworkError("cancel", 0, "invalid response: not JSON")
+	}
+
+	refund := false
+	if jsonPaymentMap, ok := jsonTopLevelMap["payment"].(map[string]interface{}); ok {
+		if jsonTransactionMap, ok := jsonPaymentMap["transaction"].(map[string]interface{}); ok {
+			switch v := jsonTransactionMap["refund"].(type) {
+			case float64:
+				refund = v == 1
+			case bool:
+				refund = v
+			}
+		}
+	}
+	return &api.CancelResponse{Refund: refund}, nil
+}
@@ -0,0 +1,100 @@
+package resy
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/21Bruce/resolved-server/api"
+	"github.com/21Bruce/resolved-server/config"
+)
+
+// recordingTransport answers every request with body and keeps the headers it was sent
+type recordingTransport struct {
+	body    string
+	headers http.Header
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.headers = req.Header.Clone()
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(t.body)),
+		Request:    req,
+	}, nil
+}
+
+func TestAuthHeaders(t *testing.T) {
+	const token = "auth-token"
+	params := api.ReserveParam{
+		VenueID:   1,
+		PartySize: 2,
+		LoginResp: api.LoginResponse{AuthToken: token, PaymentMethodID: 3},
+	}
+
+	steps := []struct {
+		name string
+		send func(a *API) (http.Header, error)
+	}{
+		{"find", func(a *API) (http.Header, error) {
+			req, _, err := a.newFindRequest(params, "2026-01-02", params.PartySize)
+			if err != nil {
+				return nil, err
+			}
+			return req.Header, nil
+		}},
+		{"details", func(a *API) (http.Header, error) {
+			transport := &recordingTransport{body: `{"book_token":{"value":"book-token"}}`}
+			_, _, err := a.requestBookToken(&http.Client{Transport: transport}, token, "config-token", "2026-01-02", params.PartySize)
+			return transport.headers, err
+		}},
+		{"book", func(a *API) (http.Header, error) {
+			transport := &recordingTransport{body: `{"reservation_id":4}`}
+			_, _, err := a.book(&http.Client{Transport: transport}, "book-token", params)
+			return transport.headers, err
+		}},
+	}
+
+	modes := []struct {
+		mode       string
+		plain      bool // X-Resy-Universal-Auth
+		tokenNamed bool // X-Resy-Universal-Auth-Token
+	}{
+		{config.UniversalAuthHeaderBoth, true, true},
+		{config.UniversalAuthHeaderToken, false, true},
+		{config.UniversalAuthHeaderPlain, true, false},
+	}
+
+	cfg := config.Get()
+	defer func(mode string) { cfg.UniversalAuthHeader = mode }(cfg.UniversalAuthHeader)
+
+	for _, m := range modes {
+		cfg.UniversalAuthHeader = m.mode
+		for _, step := range steps {
+			t.Run(m.mode+"/"+step.name, func(t *testing.T) {
+				a := GetDefaultAPI()
+				headers, err := step.send(&a)
+				if err != nil {
+					t.Fatalf("sending request: %v", err)
+				}
+
+				want := map[string]bool{
+					"X-Resy-Auth-Token":           true,
+					"X-Resy-Universal-Auth":       m.plain,
+					"X-Resy-Universal-Auth-Token": m.tokenNamed,
+				}
+				for name, sent := range want {
+					got := headers.Get(name)
+					switch {
+					case sent && got != token:
+						t.Errorf("%s = %q, want %q", name, got, token)
+					case !sent && got != "":
+						t.Errorf("%s = %q, want it unset", name, got)
+					}
+				}
+			})
+		}
+	}
+}
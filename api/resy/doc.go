@@ -111,6 +111,13 @@ Login:
             X-Resy-Auth-Token: ###TOK###
             X-Resy-Universal-Auth-Token: ###TOK###
 
+    Resy's web client has also been observed sending the universal
+    token as 'X-Resy-Universal-Auth' (without '-Token'), and both
+    are currently accepted. To avoid depending on either, the find,
+    details and book requests all send both variants by default;
+    the RESY_UNIVERSAL_AUTH_HEADER setting ('both', 'token' or
+    'plain') narrows this to one.
+
     The ###PID### value is used in the reservation process.
 
 **********************************************************************
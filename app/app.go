@@ -327,12 +327,12 @@ func (a *AppCtx) reserveAtInterval(params ReserveAtIntervalParam, cancel <-chan
 
         // if there was an error and it wasn't due to every time being
         // taken, then it's an issue we don't know about
-        if err != nil && err != api.ErrNoTable {
+        if err != nil && !errors.Is(err, api.ErrNoTable) {
             output<-OperationResult{Response: nil, Err: err}     
             close(output)
             return
         }
-        if err == api.ErrNoTable {
+        if errors.Is(err, api.ErrNoTable) {
             // see if last time on list is still in the future,
             // since if it isn't there's no point in trying to reserve it
             if lastTime.After(time.Now()) {
@@ -1,25 +1,178 @@
 package config
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
 	"os"
+	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 // Config holds all configuration values
 type Config struct {
-	RedisURL              string
-	RedisPassword         string
-	ResyAPIKey            string
-	CookieSecretKey       []byte
-	CookieBlockKey        []byte
-	Port                  string
-	AdminToken            string
+	RedisURL        string
+	RedisPassword   string
+	RedisDB         int // Redis logical database index, -1 if REDIS_DB isn't one
+	ResyAPIKey      string
+	CookieSecretKey []byte
+	CookieBlockKey  []byte
+	// Redis connection timeouts and command retries
+	RedisDialTimeout time.Duration
+	RedisReadTimeout time.Duration
+	RedisMaxRetries  int
+	// Keys that sessions may have been issued under before a key rotation
+	PreviousCookieKeys []CookieKeyPair
+	Port               string
+	AdminToken         string
+	// Secret that short-lived admin tokens are signed with (empty disables them)
+	AdminTokenSecret      string
 	CookieRefreshEnabled  bool
 	CookieRefreshInterval time.Duration
-	KnownVenueIDs         []int64
+	// Per-venue overrides of CookieRefreshInterval, keyed by venue ID
+	VenueCookieRefreshIntervals map[int64]time.Duration
+	KnownVenueIDs               []int64
+	RunMode                     string
+	// Process each venue's scheduled reservations in its own worker
+	PartitionReservationsByVenue bool
+	// How many times to fetch a fresh book token when Resy reports it expired
+	BookTokenRetries int
+	// Most matching slots one attempt runs details and book for before giving up (0 tries them all)
+	MaxBookCandidates int
+	// How many times to retry a login that failed for a transient reason
+	LoginRetries int
+	// Number of independent Imperva cookie sets kept per venue
+	CookieSetsPerVenue int
+	// Which universal auth header variant(s) to send to Resy
+	UniversalAuthHeader string
+	// Extra headers set on every outbound Resy request, keyed by canonical header name
+	ExtraHeaders map[string]string
+	// Headers identifying the Resy web client version, set on every Resy request (none by default)
+	ClientHeaders map[string]string
+	// Go time layout for human-readable times in API responses
+	ResponseTimeFormat string
+	// How long after its RunTime a scheduled reservation may still be attempted (0 disables)
+	MaxLateness time.Duration
+	// How long before a drop_at time a scheduled reservation runs by default (negative runs after it)
+	DropLead time.Duration
+	// How long the scheduler waits before retrying a booking while Resy is unavailable
+	UnavailableBackoff time.Duration
+	// How often a watched reservation polls for cancellations when it doesn't set poll_interval
+	WatchPollInterval time.Duration
+	// Shortest poll_interval a watched reservation may use, to spare the venue's cookies
+	WatchMinPollInterval time.Duration
+	// How long after RESERVATION_MAX_LATENESS an unprocessed reservation's data is kept (0 keeps it forever)
+	ReservationExpiryBuffer time.Duration
+	// How long a scheduled reservation's attempt log is kept after its last entry (0 disables attempt logs)
+	AttemptLogTTL time.Duration
+	// Most finished reservation attempts kept for /admin/reservations/history.csv (0 disables)
+	ReservationHistorySize int
+	// How due reservations are ordered: by priority, then run time, or strictly by run time
+	ReservationOrder string
+	// How long a due reservation may wait before /health reports the scheduler degraded (0 disables)
+	SchedulerLagThreshold time.Duration
+	// How new scheduled reservation IDs are generated
+	ReservationIDScheme string
+	// Minimum time between scheduled booking attempts at the same venue (0 disables)
+	BookingMinInterval time.Duration
+	// Per-venue overrides of BookingMinInterval, keyed by venue ID
+	VenueBookingMinIntervals map[int64]time.Duration
+	// Venues that may be booked; empty means any venue
+	AllowedVenueIDs []int64
+	// resy.com city slug per venue ID, for venue pages outside NYC
+	VenueCitySlugs map[int64]string
+	// Path to a JS file evaluated on the venue page before cookies are collected
+	CookieFetchScript string
+	// Also load api.resy.com during cookie fetch to collect API-host cookies
+	CookieFetchAPIWarmup bool
+	// Fail a booking straight away when its venue has no stored cookies, instead of trying without
+	RequireCookies bool
+	// Book from the first venue in a find response when the requested venue isn't listed
+	FirstVenueFallback bool
+	// URL posted the outcome of each scheduled reservation (empty disables)
+	WebhookURL string
+	// Shared secret webhook bodies are signed with in X-Signature (empty sends them unsigned)
+	WebhookSecret string
+	// Directory of per-venue cookie JSON files imported at startup and on SIGHUP
+	CookieImportDir string
+	// Deadline for a single headless-browser cookie fetch
+	CookieFetchTimeout time.Duration
+	// How long shutdown waits for an in-flight cookie fetch before killing its browser
+	CookieFetchShutdownGrace time.Duration
+	// How long before a scheduled reservation runs its venue's cookies are refreshed (0 disables)
+	PreDropCookieRefreshLead time.Duration
+	// Most venue pages kept open in a shared browser between cookie fetches (0 disables)
+	CookieWarmTabs int
+	// How often warm tabs are reloaded; fetches within this of a reload reuse its cookies
+	CookieWarmRefreshInterval time.Duration
+	// Use the offline mock API instead of Resy, for local development
+	ResyMock bool
+	// Smallest JSON response, in bytes, to gzip for clients that accept it (0 disables)
+	GzipMinSize int
+	// When Reserve's full request/response log is printed: on failure only, or always
+	ResyDebugLog string
+	// Lowest level logged: debug, info, warn, or error
+	LogLevel string
+	// Deadline for a single Resy HTTP request, including reading the response (0 waits forever)
+	RequestTimeout time.Duration
+	// Most Imperva cookies one Resy client keeps in memory (0 is unlimited)
+	MaxCookies int
+	// Most Resy requests in flight at once across all clients (0 is unlimited)
+	MaxConcurrentRequests int
+	// Most party sizes searched at once for a reservation with party_sizes
+	PartySizeSearchConcurrency int
+	// Login response token field to send per Resy request step ("find", "detail", "book")
+	AuthTokenFields map[string]string
+	// Oldest Redis server version the store supports (empty skips the check)
+	RedisMinVersion string
+	// Refuse to start when the Redis version check fails, instead of warning
+	RedisVersionStrict bool
+	// Log in again with a scheduled reservation's stored credentials right before its attempt
+	LoginRefresh bool
+	// SMTP server for reservation outcome emails (empty host sends none)
+	SMTPHost     string
+	SMTPPort     int
+	SMTPUser     string
+	SMTPPassword string
+	SMTPFrom     string
+}
+
+// Reservation processing orders
+const (
+	ReservationOrderPriority = "priority" // Highest Priority first among due reservations, then earliest
+	ReservationOrderFIFO     = "fifo"     // Earliest RunTime first, ignoring Priority
+)
+
+// ResyDebugLog modes
+const (
+	ResyDebugLogFailure = "failure" // Print the full log only for failed attempts
+	ResyDebugLogAlways  = "always"  // Print the full log as it happens
+)
+
+// Universal auth header variants sent with user requests to Resy
+const (
+	UniversalAuthHeaderBoth  = "both"  // X-Resy-Universal-Auth and X-Resy-Universal-Auth-Token
+	UniversalAuthHeaderToken = "token" // X-Resy-Universal-Auth-Token only
+	UniversalAuthHeaderPlain = "plain" // X-Resy-Universal-Auth only
+)
+
+// Run modes select which parts of the server a process runs
+const (
+	RunModeAll       = "all"       // HTTP server, scheduler and cookie refresh
+	RunModeWeb       = "web"       // HTTP server only
+	RunModeScheduler = "scheduler" // Scheduler and cookie refresh, plus /health
+)
+
+// CookieKeyPair is a session cookie hash key and block key
+type CookieKeyPair struct {
+	SecretKey []byte
+	BlockKey  []byte
 }
 
 var (
@@ -31,16 +184,89 @@ var (
 func Get() *Config {
 	once.Do(func() {
 		cfg = &Config{
-			RedisURL:              getEnv("REDIS_URL", "localhost:6379"),
-			RedisPassword:         getEnv("REDIS_PASSWORD", ""),
-			ResyAPIKey:            getEnv("RESY_API_KEY", "VbWk7s3L4KiK5fzlO7JD3Q5EYolJI7n5"),
-			CookieSecretKey:       getSecretKey("COOKIE_SECRET_KEY"),
-			CookieBlockKey:        getSecretKey("COOKIE_BLOCK_KEY"),
-			Port:                  getEnv("PORT", "8090"),
-			AdminToken:            getEnv("ADMIN_TOKEN", ""),
-			CookieRefreshEnabled:  getEnvBool("COOKIE_REFRESH_ENABLED", true),
-			CookieRefreshInterval: getEnvDuration("COOKIE_REFRESH_INTERVAL", 6*time.Hour),
-			KnownVenueIDs:         []int64{89607, 89678, 92807},
+			RedisURL:                     getEnv("REDIS_URL", "localhost:6379"),
+			RedisPassword:                getEnv("REDIS_PASSWORD", ""),
+			RedisDB:                      getEnvIndex("REDIS_DB", 0),
+			RedisDialTimeout:             getEnvDuration("REDIS_DIAL_TIMEOUT", 5*time.Second),
+			RedisReadTimeout:             getEnvDuration("REDIS_READ_TIMEOUT", 3*time.Second),
+			RedisMaxRetries:              getEnvInt("REDIS_MAX_RETRIES", 3),
+			ResyAPIKey:                   getEnv("RESY_API_KEY", "VbWk7s3L4KiK5fzlO7JD3Q5EYolJI7n5"),
+			CookieSecretKey:              getSecretKey("COOKIE_SECRET_KEY"),
+			CookieBlockKey:               getSecretKey("COOKIE_BLOCK_KEY"),
+			PreviousCookieKeys:           getPreviousCookieKeys("COOKIE_PREVIOUS_KEYS"),
+			Port:                         getEnv("PORT", "8090"),
+			AdminToken:                   getEnv("ADMIN_TOKEN", ""),
+			AdminTokenSecret:             getEnv("ADMIN_TOKEN_SECRET", ""),
+			CookieRefreshEnabled:         getEnvBool("COOKIE_REFRESH_ENABLED", true),
+			CookieRefreshInterval:        getEnvDuration("COOKIE_REFRESH_INTERVAL", 6*time.Hour),
+			VenueCookieRefreshIntervals:  getEnvVenueDurations("COOKIE_REFRESH_VENUE_INTERVALS"),
+			KnownVenueIDs:                getEnvVenueIDs("KNOWN_VENUE_IDS"),
+			RunMode:                      getEnv("RUN_MODE", RunModeAll),
+			PartitionReservationsByVenue: getEnvBool("RESERVATION_PARTITION_BY_VENUE", false),
+			BookTokenRetries:             getEnvInt("RESY_BOOK_TOKEN_RETRIES", 1),
+			MaxBookCandidates:            getEnvInt("RESY_MAX_BOOK_CANDIDATES", 0),
+			LoginRetries:                 getEnvInt("RESY_LOGIN_RETRIES", 2),
+			CookieSetsPerVenue:           getEnvInt("COOKIE_SETS_PER_VENUE", 1),
+			UniversalAuthHeader:          getEnv("RESY_UNIVERSAL_AUTH_HEADER", UniversalAuthHeaderBoth),
+			ExtraHeaders:                 getEnvHeaders("RESY_EXTRA_HEADERS"),
+			ClientHeaders:                getEnvHeaders("RESY_CLIENT_HEADERS"),
+			ResponseTimeFormat:           getEnv("RESPONSE_TIME_FORMAT", "2006-01-02 3:04 PM EST"),
+			MaxLateness:                  getEnvDuration("RESERVATION_MAX_LATENESS", 15*time.Minute),
+			SchedulerLagThreshold:        getEnvDuration("SCHEDULER_LAG_THRESHOLD", 2*time.Minute),
+			DropLead:                     getEnvDuration("RESERVATION_DROP_LEAD", 0),
+			ReservationOrder:             getEnv("RESERVATION_ORDER", ReservationOrderPriority),
+			ReservationExpiryBuffer:      getEnvDuration("RESERVATION_EXPIRY_BUFFER", 24*time.Hour),
+			AttemptLogTTL:                getEnvDuration("RESERVATION_ATTEMPT_LOG_TTL", 7*24*time.Hour),
+			ReservationHistorySize:       getEnvInt("RESERVATION_HISTORY_SIZE", 10000),
+			UnavailableBackoff:           getEnvDuration("RESY_UNAVAILABLE_BACKOFF", time.Minute),
+			WatchPollInterval:            getEnvDuration("WATCH_POLL_INTERVAL", 2*time.Minute),
+			WatchMinPollInterval:         getEnvDuration("WATCH_MIN_POLL_INTERVAL", 30*time.Second),
+			ReservationIDScheme:          getEnv("RESERVATION_ID_SCHEME", "random"),
+			BookingMinInterval:           getEnvDuration("BOOKING_MIN_INTERVAL", 0),
+			VenueBookingMinIntervals:     getEnvVenueDurations("BOOKING_MIN_INTERVAL_VENUES"),
+			AllowedVenueIDs:              getEnvVenueIDs("VENUE_ALLOWLIST"),
+			VenueCitySlugs:               getEnvVenueStrings("VENUE_CITY_SLUGS"),
+			CookieFetchScript:            getEnv("COOKIE_FETCH_SCRIPT", ""),
+			CookieFetchAPIWarmup:         getEnvBool("COOKIE_FETCH_API_WARMUP", false),
+			RequireCookies:               getEnvBool("RESY_REQUIRE_COOKIES", false),
+			FirstVenueFallback:           getEnvBool("RESY_FIRST_VENUE_FALLBACK", true),
+			WebhookURL:                   getEnv("WEBHOOK_URL", ""),
+			WebhookSecret:                getEnv("WEBHOOK_SECRET", ""),
+			CookieImportDir:              getEnv("COOKIE_IMPORT_DIR", ""),
+			CookieFetchTimeout:           getEnvDuration("COOKIE_FETCH_TIMEOUT", 60*time.Second),
+			CookieFetchShutdownGrace:     getEnvDuration("COOKIE_FETCH_SHUTDOWN_GRACE", 5*time.Second),
+			PreDropCookieRefreshLead:     getEnvDuration("PRE_DROP_COOKIE_REFRESH_LEAD", 0),
+			CookieWarmTabs:               getEnvInt("COOKIE_WARM_TABS", 0),
+			CookieWarmRefreshInterval:    getEnvDuration("COOKIE_WARM_REFRESH_INTERVAL", 2*time.Minute),
+			ResyMock:                     getEnvBool("RESY_MOCK", false),
+			GzipMinSize:                  getEnvInt("RESPONSE_GZIP_MIN_BYTES", 1024),
+			ResyDebugLog:                 getEnv("RESY_DEBUG_LOG", ResyDebugLogFailure),
+			LogLevel:                     getEnv("LOG_LEVEL", "info"),
+			RequestTimeout:               getEnvDuration("RESY_REQUEST_TIMEOUT", 30*time.Second),
+			MaxCookies:                   getEnvInt("RESY_MAX_COOKIES", 50),
+			MaxConcurrentRequests:        getEnvInt("RESY_MAX_CONCURRENT_REQUESTS", 0),
+			PartySizeSearchConcurrency:   getEnvInt("PARTY_SIZE_SEARCH_CONCURRENCY", 3),
+			AuthTokenFields:              getEnvStrings("RESY_AUTH_TOKEN_FIELDS"),
+			RedisMinVersion:              getEnv("REDIS_MIN_VERSION", "6.0"),
+			RedisVersionStrict:           getEnvBool("REDIS_VERSION_STRICT", false),
+			LoginRefresh:                 getEnvBool("LOGIN_REFRESH_ENABLED", true),
+			SMTPHost:                     getEnv("SMTP_HOST", ""),
+			SMTPPort:                     getEnvInt("SMTP_PORT", 587),
+			SMTPUser:                     getEnv("SMTP_USER", ""),
+			SMTPPassword:                 getEnv("SMTP_PASSWORD", ""),
+			SMTPFrom:                     getEnv("SMTP_FROM", ""),
+		}
+		if len(cfg.KnownVenueIDs) == 0 {
+			cfg.KnownVenueIDs = []int64{89607, 89678, 92807}
+		}
+		if cfg.CookieSetsPerVenue < 1 {
+			cfg.CookieSetsPerVenue = 1
+		}
+		if cfg.CookieFetchTimeout <= 0 {
+			cfg.CookieFetchTimeout = 60 * time.Second
+		}
+		if cfg.CookieWarmRefreshInterval <= 0 {
+			cfg.CookieWarmRefreshInterval = 2 * time.Minute
 		}
 	})
 	return cfg
@@ -64,6 +290,31 @@ func getEnvBool(key string, defaultValue bool) bool {
 	return value == "true" || value == "1" || value == "yes"
 }
 
+// getEnvInt returns an integer from environment variable or default
+func getEnvInt(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		return n
+	}
+	return defaultValue
+}
+
+// getEnvIndex returns a non-negative integer from environment variable or
+// default, or -1 if the variable is set to anything else
+func getEnvIndex(key string, defaultValue int) int {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	if n, err := strconv.Atoi(value); err == nil && n >= 0 {
+		return n
+	}
+	return -1
+}
+
 // getEnvDuration returns a duration from environment variable or default
 // Accepts formats like "6h", "30m", "1h30m"
 func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
@@ -72,17 +323,149 @@ func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
 		return defaultValue
 	}
 
+	if d, ok := parseDuration(value); ok {
+		return d
+	}
+
+	return defaultValue
+}
+
+// parseDuration parses a Go duration string, or a bare number of hours
+func parseDuration(value string) (time.Duration, bool) {
 	// First try parsing as a Go duration string (e.g., "6h", "30m")
 	if d, err := time.ParseDuration(value); err == nil {
-		return d
+		return d, true
 	}
 
 	// Fall back to parsing as hours (e.g., "6" means 6 hours)
 	if hours, err := strconv.Atoi(value); err == nil {
-		return time.Duration(hours) * time.Hour
+		return time.Duration(hours) * time.Hour, true
 	}
 
-	return defaultValue
+	return 0, false
+}
+
+// getEnvVenueDurations returns per-venue durations from an environment variable
+// Accepts a comma-separated list of venue_id=duration pairs, e.g. "89607=1h,92807=30m"
+// Malformed or non-positive entries are skipped
+func getEnvVenueDurations(key string) map[int64]time.Duration {
+	durations := make(map[int64]time.Duration)
+	value := os.Getenv(key)
+	if value == "" {
+		return durations
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		venueID, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+		if err != nil {
+			continue
+		}
+		d, ok := parseDuration(strings.TrimSpace(parts[1]))
+		if !ok || d <= 0 {
+			continue
+		}
+		durations[venueID] = d
+	}
+	return durations
+}
+
+// getEnvHeaders returns a header map from an environment variable
+// Accepts a JSON object of header names to values, e.g. {"X-Origin": "https://resy.com"}
+// JSON is used because values such as sec-ch-ua contain commas, semicolons and quotes
+// Entries with an empty name are skipped; an invalid object yields no headers
+func getEnvHeaders(key string) map[string]string {
+	headers := make(map[string]string)
+	value := os.Getenv(key)
+	if value == "" {
+		return headers
+	}
+
+	var raw map[string]string
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return headers
+	}
+	for name, v := range raw {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		headers[http.CanonicalHeaderKey(name)] = v
+	}
+	return headers
+}
+
+// getEnvVenueStrings returns per-venue strings from an environment variable
+// Accepts a comma-separated list of venue_id=value pairs, e.g. "89607=ny,12345=la"
+// Malformed or empty entries are skipped
+func getEnvVenueStrings(key string) map[int64]string {
+	values := make(map[int64]string)
+	value := os.Getenv(key)
+	if value == "" {
+		return values
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		venueID, err := strconv.ParseInt(strings.TrimSpace(parts[0]), 10, 64)
+		if err != nil {
+			continue
+		}
+		v := strings.TrimSpace(parts[1])
+		if v == "" {
+			continue
+		}
+		values[venueID] = v
+	}
+	return values
+}
+
+// getEnvStrings returns a map of string values from an environment variable
+// Accepts a comma-separated list of name=value pairs, e.g. "book=legacy_token"; malformed entries are skipped
+func getEnvStrings(key string) map[string]string {
+	values := make(map[string]string)
+	value := os.Getenv(key)
+	if value == "" {
+		return values
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name, v := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+		if name == "" || v == "" {
+			continue
+		}
+		values[name] = v
+	}
+	return values
+}
+
+// getEnvVenueIDs returns a list of venue IDs from an environment variable
+// Accepts a comma-separated list, e.g. "89607,92807"; malformed entries are skipped
+func getEnvVenueIDs(key string) []int64 {
+	var venueIDs []int64
+	value := os.Getenv(key)
+	if value == "" {
+		return venueIDs
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		venueID, err := strconv.ParseInt(strings.TrimSpace(entry), 10, 64)
+		if err != nil {
+			continue
+		}
+		venueIDs = append(venueIDs, venueID)
+	}
+	return venueIDs
 }
 
 // getSecretKey returns a 32-byte key from hex-encoded env var or nil if not set
@@ -91,22 +474,208 @@ func getSecretKey(key string) []byte {
 	if hexKey == "" {
 		return nil // Will trigger random key generation
 	}
-	decoded, err := hex.DecodeString(hexKey)
+	return decodeSecretKey(hexKey)
+}
+
+// decodeSecretKey decodes a hex-encoded 32-byte key, returning nil if invalid
+func decodeSecretKey(hexKey string) []byte {
+	decoded, err := hex.DecodeString(strings.TrimSpace(hexKey))
 	if err != nil || len(decoded) != 32 {
 		return nil
 	}
 	return decoded
 }
 
+// getPreviousCookieKeys returns retired session key pairs from an environment variable
+// Accepts a comma-separated list of secret:block hex key pairs; invalid pairs are skipped
+func getPreviousCookieKeys(key string) []CookieKeyPair {
+	var pairs []CookieKeyPair
+	value := os.Getenv(key)
+	if value == "" {
+		return pairs
+	}
+
+	for _, entry := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(entry), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		secretKey := decodeSecretKey(parts[0])
+		blockKey := decodeSecretKey(parts[1])
+		if secretKey == nil || blockKey == nil {
+			continue
+		}
+		pairs = append(pairs, CookieKeyPair{SecretKey: secretKey, BlockKey: blockKey})
+	}
+	return pairs
+}
+
 // HasAdminToken returns true if an admin token is configured
 func (c *Config) HasAdminToken() bool {
 	return c.AdminToken != ""
 }
 
-// ValidateAdminToken checks if the provided token matches the configured admin token
+// ValidateAdminToken checks if the provided token matches the configured admin
+// token or is an unexpired short-lived token minted by MintAdminToken
 func (c *Config) ValidateAdminToken(token string) bool {
 	if !c.HasAdminToken() {
 		return false // No admin token configured, deny all
 	}
-	return token == c.AdminToken
+	return c.IsPermanentAdminToken(token) || c.validTempAdminToken(token, time.Now())
+}
+
+// IsPermanentAdminToken checks if the provided token is the configured admin token itself
+func (c *Config) IsPermanentAdminToken(token string) bool {
+	return c.HasAdminToken() && token == c.AdminToken
+}
+
+// Short-lived admin tokens look like "tmp.<unix expiry>.<hex HMAC-SHA256 of the expiry>"
+const tempAdminTokenPrefix = "tmp."
+
+// MaxTempAdminTokenTTL is the longest lifetime MintAdminToken allows
+const MaxTempAdminTokenTTL = 7 * 24 * time.Hour
+
+// MintAdminToken returns a signed admin token that expires after ttl
+func (c *Config) MintAdminToken(ttl time.Duration) (string, time.Time, error) {
+	if c.AdminTokenSecret == "" || !c.HasAdminToken() {
+		return "", time.Time{}, errors.New("short-lived admin tokens need ADMIN_TOKEN and ADMIN_TOKEN_SECRET")
+	}
+	if ttl <= 0 || ttl > MaxTempAdminTokenTTL {
+		return "", time.Time{}, errors.New("ttl must be positive and at most " + MaxTempAdminTokenTTL.String())
+	}
+	expiresAt := time.Now().Add(ttl).Truncate(time.Second)
+	expiry := strconv.FormatInt(expiresAt.Unix(), 10)
+	return tempAdminTokenPrefix + expiry + "." + c.signAdminTokenExpiry(expiry), expiresAt, nil
+}
+
+// validTempAdminToken checks a short-lived admin token's signature and expiry
+func (c *Config) validTempAdminToken(token string, now time.Time) bool {
+	if c.AdminTokenSecret == "" {
+		return false
+	}
+	rest, ok := strings.CutPrefix(token, tempAdminTokenPrefix)
+	if !ok {
+		return false
+	}
+	expiry, signature, ok := strings.Cut(rest, ".")
+	if !ok {
+		return false
+	}
+	if !hmac.Equal([]byte(signature), []byte(c.signAdminTokenExpiry(expiry))) {
+		return false
+	}
+	expiresAt, err := strconv.ParseInt(expiry, 10, 64)
+	return err == nil && now.Unix() < expiresAt
+}
+
+// signAdminTokenExpiry returns the hex HMAC of a short-lived token's expiry
+func (c *Config) signAdminTokenExpiry(expiry string) string {
+	mac := hmac.New(sha256.New, []byte(c.AdminTokenSecret))
+	mac.Write([]byte(tempAdminTokenPrefix + expiry))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// CookieRefreshIntervalFor returns the cookie refresh interval for a venue,
+// falling back to the global interval when no override is configured
+func (c *Config) CookieRefreshIntervalFor(venueID int64) time.Duration {
+	if d, ok := c.VenueCookieRefreshIntervals[venueID]; ok {
+		return d
+	}
+	return c.CookieRefreshInterval
+}
+
+// MinCookieRefreshInterval returns the shortest configured cookie refresh interval
+func (c *Config) MinCookieRefreshInterval() time.Duration {
+	minInterval := c.CookieRefreshInterval
+	for _, d := range c.VenueCookieRefreshIntervals {
+		if d < minInterval {
+			minInterval = d
+		}
+	}
+	return minInterval
+}
+
+// BookingMinIntervalFor returns the minimum time between booking attempts at a venue,
+// falling back to the global interval when no override is configured
+func (c *Config) BookingMinIntervalFor(venueID int64) time.Duration {
+	if d, ok := c.VenueBookingMinIntervals[venueID]; ok {
+		return d
+	}
+	return c.BookingMinInterval
+}
+
+// VenueAllowed reports whether bookings are allowed at a venue.
+// Every venue is allowed when no allowlist is configured.
+func (c *Config) VenueAllowed(venueID int64) bool {
+	if len(c.AllowedVenueIDs) == 0 {
+		return true
+	}
+	for _, id := range c.AllowedVenueIDs {
+		if id == venueID {
+			return true
+		}
+	}
+	return false
+}
+
+// secretFields are Config fields Effective never reveals. Webhook URLs often
+// embed a token, and extra headers may carry credentials.
+var secretFields = map[string]bool{
+	"RedisPassword":      true,
+	"ResyAPIKey":         true,
+	"CookieSecretKey":    true,
+	"CookieBlockKey":     true,
+	"PreviousCookieKeys": true,
+	"AdminToken":         true,
+	"AdminTokenSecret":   true,
+	"WebhookURL":         true,
+	"WebhookSecret":      true,
+	"SMTPPassword":       true,
+	"ExtraHeaders":       true,
+}
+
+// redactedValue replaces a set secret in Effective's output
+const redactedValue = "[redacted]"
+
+// Effective returns the loaded configuration keyed by field name, for
+// display. Secrets are replaced by "[redacted]" when set and "" when not,
+// and durations are written like "30m0s" rather than in nanoseconds.
+func (c *Config) Effective() map[string]interface{} {
+	effective := make(map[string]interface{})
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		name := t.Field(i).Name
+		field := v.Field(i)
+		if secretFields[name] {
+			if field.IsZero() || (field.Kind() != reflect.String && field.Len() == 0) {
+				effective[name] = ""
+			} else {
+				effective[name] = redactedValue
+			}
+			continue
+		}
+		effective[name] = displayValue(field.Interface())
+	}
+	return effective
+}
+
+// displayValue returns durations, including those in per-venue maps, as strings
+func displayValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Duration:
+		return v.String()
+	case map[int64]time.Duration:
+		durations := make(map[string]string, len(v))
+		for venueID, d := range v {
+			durations[strconv.FormatInt(venueID, 10)] = d.String()
+		}
+		return durations
+	}
+	return value
+}
+
+// ValidRunMode reports whether mode is one of the supported run modes
+func ValidRunMode(mode string) bool {
+	return mode == RunModeAll || mode == RunModeWeb || mode == RunModeScheduler
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/21Bruce/resolved-server/config"
+)
+
+// watchCookieFiles imports the cookie files in cfg.CookieImportDir now and
+// again whenever the process receives SIGHUP, until ctx is cancelled
+func watchCookieFiles(ctx context.Context, cfg *config.Config) {
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	defer signal.Stop(reload)
+
+	importCookieFiles(ctx, cfg)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-reload:
+			appendLog("SIGHUP received, reloading cookie files from " + cfg.CookieImportDir)
+			importCookieFiles(ctx, cfg)
+		}
+	}
+}
+
+// importCookieFiles imports every *.json file in cfg.CookieImportDir. Each file
+// holds one venue's cookies in the /admin/cookies/import request format.
+func importCookieFiles(ctx context.Context, cfg *config.Config) {
+	paths, err := filepath.Glob(filepath.Join(cfg.CookieImportDir, "*.json"))
+	if err != nil {
+		appendLog("Failed to list cookie files: " + err.Error())
+		return
+	}
+
+	imported := 0
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			appendLog("Failed to read cookie file " + path + ": " + err.Error())
+			continue
+		}
+
+		var req CookieImportRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			appendLog("Invalid cookie file " + path + ": " + err.Error())
+			continue
+		}
+
+		if err := importCookies(ctx, cfg, req); err != nil {
+			appendLog("Failed to import cookie file " + path + ": " + err.Error())
+			continue
+		}
+		imported++
+	}
+
+	appendLog("Imported cookies from " + strconv.Itoa(imported) + " of " + strconv.Itoa(len(paths)) + " files in " + cfg.CookieImportDir)
+}
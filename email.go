@@ -0,0 +1,67 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/21Bruce/resolved-server/api"
+	"github.com/21Bruce/resolved-server/notify"
+	"github.com/21Bruce/resolved-server/store"
+)
+
+// emailNotifier sends reservation outcome emails; nil when SMTP isn't configured
+var emailNotifier notify.Notifier
+
+// emailReservationOutcome emails the outcome of a scheduled reservation to the
+// address stored with it, in the background. reserveResp is the booking when it
+// succeeded; err is why it didn't.
+func emailReservationOutcome(event string, res *store.ScheduledReservation, reserveResp *api.ReserveResponse, err error) {
+	if emailNotifier == nil || res.NotifyEmail == "" {
+		return
+	}
+
+	venue := "venue " + strconv.FormatInt(res.VenueID, 10)
+	var subject string
+	var body strings.Builder
+	switch {
+	case reserveResp != nil:
+		bookedAt := reserveResp.ReservationTime.In(nycLocation).Format("Mon Jan 2, 2006 3:04 PM")
+		subject = "Reservation booked at " + venue + " for " + bookedAt
+		body.WriteString("Your scheduled reservation was booked.\n\n")
+		body.WriteString("Time: " + bookedAt + " (New York time)\n")
+		body.WriteString("Party size: " + strconv.Itoa(res.PartySize) + "\n")
+		if reserveResp.ReservationID != "" {
+			body.WriteString("Resy reservation ID: " + reserveResp.ReservationID + "\n")
+		}
+		if reserveResp.VenueMismatch {
+			body.WriteString("Note: Resy didn't list " + venue + ", so venue " + strconv.FormatInt(reserveResp.BookedVenueID, 10) + " was booked instead\n")
+		}
+	case event == webhookEventMissed:
+		subject = "Reservation missed at " + venue
+		body.WriteString("Your scheduled reservation was not attempted.\n\n")
+	case event == webhookEventSkipped:
+		subject = "Reservation skipped at " + venue
+		body.WriteString("Your scheduled reservation was not attempted because the venue isn't allowed.\n\n")
+	default:
+		subject = "Reservation failed at " + venue
+		body.WriteString("Your scheduled reservation could not be booked.\n\n")
+	}
+	if reserveResp == nil {
+		body.WriteString("Requested time: " + res.ReservationTime.In(nycLocation).Format("Mon Jan 2, 2006 3:04 PM") + " (New York time)\n")
+		body.WriteString("Party size: " + strconv.Itoa(res.PartySize) + "\n")
+		if err != nil {
+			body.WriteString("Reason: " + err.Error() + "\n")
+		}
+	}
+	body.WriteString("Scheduled reservation ID: " + res.ID + "\n")
+	if res.Note != "" {
+		body.WriteString("Note: " + res.Note + "\n")
+	}
+
+	notifier, to, resID, text := emailNotifier, res.NotifyEmail, res.ID, body.String()
+	go func() {
+		if err := notifier.Send(to, subject, text); err != nil {
+			appendLog("Failed to email outcome of reservation " + resID + ": " + err.Error())
+		}
+	}()
+}
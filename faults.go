@@ -0,0 +1,162 @@
+//go:build faultinject
+
+// Failure injection for exercising retry and self-heal paths. Only compiled
+// into binaries built with -tags faultinject, so it can't be enabled in a
+// normal (production) build.
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/21Bruce/resolved-server/api"
+	"github.com/21Bruce/resolved-server/config"
+)
+
+// injectableErrors maps the error names accepted by /admin/faults to errors
+var injectableErrors = map[string]error{
+	"network":          api.ErrNetwork,
+	"imperva":          api.ErrImperva,
+	"rate_limited":     api.ErrRateLimited,
+	"no_table":         api.ErrNoTable,
+	"no_offer":         api.ErrNoOffer,
+	"login_wrong":      api.ErrLoginWrong,
+	"no_pay_info":      api.ErrNoPayInfo,
+	"payment_required": api.ErrPaymentRequired,
+	"payment_declined": api.ErrPaymentDeclined,
+	"party_too_large":  api.ErrPartyTooLarge,
+}
+
+// FaultRequest queues an injected error for the next Count calls of an operation
+type FaultRequest struct {
+	Operation string `json:"operation"` // login, search, reserve or cancel
+	Error     string `json:"error"`     // a key of injectableErrors
+	Count     int    `json:"count"`     // defaults to 1
+}
+
+// injectedFault is a queued error and how many more calls it applies to
+type injectedFault struct {
+	Error     string `json:"error"`
+	Remaining int    `json:"remaining"`
+}
+
+// Queued faults per operation, shared by every API client so the per-venue
+// scheduler workers see them too
+var (
+	faultsMu sync.Mutex
+	faults   = make(map[string][]*injectedFault)
+)
+
+// nextFault consumes one call's worth of the oldest queued fault for an operation
+func nextFault(operation string) error {
+	faultsMu.Lock()
+	defer faultsMu.Unlock()
+
+	queue := faults[operation]
+	if len(queue) == 0 {
+		return nil
+	}
+	fault := queue[0]
+	fault.Remaining--
+	if fault.Remaining <= 0 {
+		faults[operation] = queue[1:]
+	}
+	appendLog("Injecting " + fault.Error + " into " + operation + " (" + strconv.Itoa(fault.Remaining) + " remaining)")
+	return injectableErrors[fault.Error]
+}
+
+// faultAPI wraps an API client, failing calls that have a queued fault
+type faultAPI struct {
+	api.API
+}
+
+func (f *faultAPI) Login(params api.LoginParam) (*api.LoginResponse, error) {
+	if err := nextFault("login"); err != nil {
+		return nil, err
+	}
+	return f.API.Login(params)
+}
+
+func (f *faultAPI) Search(params api.SearchParam) (*api.SearchResponse, error) {
+	if err := nextFault("search"); err != nil {
+		return nil, err
+	}
+	return f.API.Search(params)
+}
+
+func (f *faultAPI) Reserve(params api.ReserveParam) (*api.ReserveResponse, error) {
+	if err := nextFault("reserve"); err != nil {
+		return nil, err
+	}
+	return f.API.Reserve(params)
+}
+
+func (f *faultAPI) Cancel(params api.CancelParam) (*api.CancelResponse, error) {
+	if err := nextFault("cancel"); err != nil {
+		return nil, err
+	}
+	return f.API.Cancel(params)
+}
+
+// wrapAPI adds failure injection to an API client
+func wrapAPI(a api.API) api.API {
+	return &faultAPI{API: a}
+}
+
+// registerFaultRoutes adds the /admin/faults endpoint: GET lists queued faults,
+// POST queues one and DELETE clears them all
+func registerFaultRoutes(cfg *config.Config) {
+	appendLog("Failure injection is compiled in: /admin/faults is enabled")
+
+	handleRoute("/admin/faults", "GET,POST,DELETE", func(w http.ResponseWriter, r *http.Request) {
+		if !validateAdminToken(r, cfg) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			faultsMu.Lock()
+			defer faultsMu.Unlock()
+			sendJSONResponse(w, faults, http.StatusOK)
+
+		case http.MethodPost:
+			var req FaultRequest
+			if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+				sendJSONResponse(w, map[string]string{"error": "Invalid request format"}, http.StatusBadRequest)
+				return
+			}
+			if req.Operation != "login" && req.Operation != "search" && req.Operation != "reserve" && req.Operation != "cancel" {
+				sendJSONResponse(w, map[string]string{"error": "operation must be login, search, reserve or cancel"}, http.StatusBadRequest)
+				return
+			}
+			if _, ok := injectableErrors[req.Error]; !ok {
+				sendJSONResponse(w, map[string]string{"error": "Unknown error " + strconv.Quote(req.Error)}, http.StatusBadRequest)
+				return
+			}
+			if req.Count <= 0 {
+				req.Count = 1
+			}
+
+			faultsMu.Lock()
+			faults[req.Operation] = append(faults[req.Operation], &injectedFault{Error: req.Error, Remaining: req.Count})
+			faultsMu.Unlock()
+
+			appendLog("Queued " + req.Error + " for the next " + strconv.Itoa(req.Count) + " " + req.Operation + " calls")
+			sendJSONResponse(w, map[string]string{"message": "Fault queued"}, http.StatusOK)
+
+		case http.MethodDelete:
+			faultsMu.Lock()
+			faults = make(map[string][]*injectedFault)
+			faultsMu.Unlock()
+
+			appendLog("Cleared injected faults")
+			sendJSONResponse(w, map[string]string{"message": "Faults cleared"}, http.StatusOK)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
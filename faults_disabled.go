@@ -0,0 +1,17 @@
+//go:build !faultinject
+
+package main
+
+import (
+	"github.com/21Bruce/resolved-server/api"
+	"github.com/21Bruce/resolved-server/config"
+)
+
+// wrapAPI returns the client unchanged; failure injection is only compiled
+// into builds made with -tags faultinject
+func wrapAPI(a api.API) api.API {
+	return a
+}
+
+// registerFaultRoutes does nothing without the faultinject build tag
+func registerFaultRoutes(cfg *config.Config) {}
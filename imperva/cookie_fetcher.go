@@ -6,9 +6,12 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"regexp"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/21Bruce/resolved-server/config"
 	"github.com/chromedp/cdproto/network"
 	"github.com/chromedp/chromedp"
 )
@@ -22,6 +25,72 @@ type CookieData struct {
 // DefaultUserAgent is used for browser automation
 const DefaultUserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
 
+// defaultCitySlug is used for venues whose city isn't known yet. Resy redirects
+// the page to the venue's canonical URL, which is where the real slug is learned.
+const defaultCitySlug = "nyc"
+
+// waitBaseTimeout is the fetch timeout the fixed waits in fetchCookiesOnce were
+// tuned for; shorter timeouts shrink them in proportion
+const waitBaseTimeout = 60 * time.Second
+
+// scaledWait returns wait shortened in proportion to a fetch timeout below waitBaseTimeout
+func scaledWait(wait, timeout time.Duration) time.Duration {
+	if timeout >= waitBaseTimeout {
+		return wait
+	}
+	return time.Duration(float64(wait) * float64(timeout) / float64(waitBaseTimeout))
+}
+
+// cityPathPattern extracts the city slug from a Resy venue page URL
+var cityPathPattern = regexp.MustCompile(`^https?://[^/]*resy\.com/cities/([^/?#]+)/`)
+
+// City slugs learned from the canonical URLs Resy redirected venue pages to
+var (
+	citySlugsMu sync.Mutex
+	citySlugs   = make(map[int64]string)
+)
+
+// venueCitySlug returns the city slug for a venue, from config or a previous fetch
+func venueCitySlug(venueID int64) (string, bool) {
+	if slug, ok := config.Get().VenueCitySlugs[venueID]; ok {
+		return slug, true
+	}
+	citySlugsMu.Lock()
+	defer citySlugsMu.Unlock()
+	slug, ok := citySlugs[venueID]
+	return slug, ok
+}
+
+// venuePageURL builds the URL of a venue's page on resy.com
+func venuePageURL(venueID int64) string {
+	slug, ok := venueCitySlug(venueID)
+	if !ok {
+		slug = defaultCitySlug
+	}
+	return fmt.Sprintf("https://resy.com/cities/%s/venues/%d", slug, venueID)
+}
+
+// rememberCitySlug records the city slug of the page a venue fetch ended up on,
+// so later fetches navigate straight to it
+func rememberCitySlug(venueID int64, pageURL string) {
+	match := cityPathPattern.FindStringSubmatch(pageURL)
+	if match == nil {
+		return
+	}
+	slug := match[1]
+
+	citySlugsMu.Lock()
+	defer citySlugsMu.Unlock()
+	if citySlugs[venueID] != slug {
+		log.Printf("Venue %d page is under city %q, using it for future cookie fetches", venueID, slug)
+		citySlugs[venueID] = slug
+	}
+}
+
+// apiWarmupURL is loaded after the venue page when API warm-up is enabled. Any
+// api.resy.com request passes through Imperva, which sets the API host's cookies.
+const apiWarmupURL = "https://api.resy.com/"
+
 // FetchCookies uses a headless browser to navigate to a Resy venue page and fetch Imperva cookies
 // Returns the cookies and user-agent that can be used for subsequent API requests
 func FetchCookies(venueID int64) (*CookieData, error) {
@@ -30,15 +99,30 @@ func FetchCookies(venueID int64) (*CookieData, error) {
 
 // FetchCookiesWithRetry attempts to fetch cookies with retry logic for transient failures
 func FetchCookiesWithRetry(venueID int64, maxRetries int) (*CookieData, error) {
+	return fetchCookiesWithRetry(venueID, maxRetries, false)
+}
+
+// fetchCookiesWithRetry retries fetchCookiesOnce, optionally warming up the API host
+func fetchCookiesWithRetry(venueID int64, maxRetries int, warmAPI bool) (*CookieData, error) {
+	done, err := beginFetch()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
 	var lastErr error
 
 	for attempt := 0; attempt < maxRetries; attempt++ {
 		if attempt > 0 {
 			log.Printf("Cookie fetch attempt %d/%d for venue %d", attempt+1, maxRetries, venueID)
-			time.Sleep(time.Duration(attempt*2) * time.Second) // Exponential backoff
+			select {
+			case <-fetchCtx.Done():
+				return nil, ErrShuttingDown
+			case <-time.After(time.Duration(attempt*2) * time.Second): // Exponential backoff
+			}
 		}
 
-		cookieData, err := fetchCookiesOnce(venueID)
+		cookieData, err := fetchCookiesOnce(venueID, warmAPI)
 		if err == nil {
 			return cookieData, nil
 		}
@@ -50,13 +134,39 @@ func FetchCookiesWithRetry(venueID int64, maxRetries int) (*CookieData, error) {
 	return nil, fmt.Errorf("failed to fetch cookies after %d attempts: %w", maxRetries, lastErr)
 }
 
-// fetchCookiesOnce performs a single attempt to fetch cookies
-func fetchCookiesOnce(venueID int64) (*CookieData, error) {
-	// Build the venue URL
-	venueURL := fmt.Sprintf("https://resy.com/cities/nyc/venues/%d", venueID)
+// loadSolverScript reads the optional challenge-solver script; it is read on
+// every fetch so it can be edited without a restart
+func loadSolverScript() (string, error) {
+	scriptPath := config.Get().CookieFetchScript
+	if scriptPath == "" {
+		return "", nil
+	}
+	script, err := os.ReadFile(scriptPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to read cookie fetch script: %w", err)
+	}
+	return string(script), nil
+}
+
+// fetchCookiesOnce performs a single attempt to fetch cookies. With warmAPI the
+// browser also loads api.resy.com after the venue page and collects its cookies too.
+func fetchCookiesOnce(venueID int64, warmAPI bool) (*CookieData, error) {
+	// Build the venue URL; the browser follows any redirect to the canonical page
+	venueURL := venuePageURL(venueID)
+
+	solverScript, err := loadSolverScript()
+	if err != nil {
+		return nil, err
+	}
+
+	// Reuse a warm tab when the operator keeps them
+	timeout := config.Get().CookieFetchTimeout
+	if config.Get().CookieWarmTabs > 0 {
+		return fetchFromWarmTab(venueID, warmAPI, solverScript, timeout)
+	}
 
-	// Create context with timeout - 60s for headless operation
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	// Create context with the configured deadline for headless operation; shutdown cancels it early
+	ctx, cancel := context.WithTimeout(fetchCtx, timeout)
 	defer cancel()
 
 	// Build chrome options for headless operation
@@ -69,21 +179,55 @@ func fetchCookiesOnce(venueID int64) (*CookieData, error) {
 	chromeCtx, chromeCancel := chromedp.NewContext(allocCtx, chromedp.WithLogf(log.Printf))
 	defer chromeCancel()
 
+	return collectCookies(chromeCtx, venueID, venueURL, warmAPI, solverScript, timeout)
+}
+
+// collectCookies loads a venue page in a browser tab, waits out the Imperva
+// challenge and returns the cookies it set. timeout scales the fixed waits.
+func collectCookies(chromeCtx context.Context, venueID int64, venueURL string, warmAPI bool, solverScript string, timeout time.Duration) (*CookieData, error) {
 	var cookies []*http.Cookie
 	var userAgent string
+	var pageURL string
 
 	// Navigate to the venue page and wait for Imperva challenge to complete
 	err := chromedp.Run(chromeCtx,
 		chromedp.Navigate(venueURL),
 		// Wait for page to load and Imperva challenge to complete
-		chromedp.Sleep(5*time.Second), // Initial wait for Imperva challenge
+		chromedp.Sleep(scaledWait(5*time.Second, timeout)), // Initial wait for Imperva challenge
 		// Check if page loaded successfully by waiting for body
 		chromedp.WaitVisible("body", chromedp.ByQuery),
+		// Record where the page ended up, to learn the venue's city
+		chromedp.Location(&pageURL),
+		// Run the operator's challenge-solver script, if one is configured
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			if solverScript == "" {
+				return nil
+			}
+			if err := chromedp.Evaluate(solverScript, nil).Do(ctx); err != nil {
+				return fmt.Errorf("cookie fetch script failed: %w", err)
+			}
+			return nil
+		}),
 		// Additional wait to ensure Imperva cookies are set
-		chromedp.Sleep(3*time.Second),
+		chromedp.Sleep(scaledWait(3*time.Second, timeout)),
+		// Touch the API host so Imperva issues its cookies as well
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			if !warmAPI {
+				return nil
+			}
+			if err := chromedp.Navigate(apiWarmupURL).Do(ctx); err != nil {
+				return fmt.Errorf("failed to load %s: %w", apiWarmupURL, err)
+			}
+			return chromedp.Sleep(scaledWait(2*time.Second, timeout)).Do(ctx)
+		}),
 		// Get cookies
 		chromedp.ActionFunc(func(ctx context.Context) error {
-			cookiesRaw, err := network.GetCookies().Do(ctx)
+			// Without URLs only the current page's cookies are returned
+			urls := []string{pageURL}
+			if warmAPI {
+				urls = append(urls, apiWarmupURL)
+			}
+			cookiesRaw, err := network.GetCookies().WithURLs(urls).Do(ctx)
 			if err != nil {
 				return fmt.Errorf("failed to get cookies: %w", err)
 			}
@@ -121,6 +265,8 @@ func fetchCookiesOnce(venueID int64) (*CookieData, error) {
 		return nil, fmt.Errorf("failed to fetch cookies: %w", err)
 	}
 
+	rememberCitySlug(venueID, pageURL)
+
 	// Filter for Imperva cookies
 	impervaCookies := filterImpervaCookies(cookies)
 
@@ -185,16 +331,11 @@ func filterImpervaCookies(cookies []*http.Cookie) []*http.Cookie {
 }
 
 // FetchCookiesForAPI is a convenience function that fetches cookies for api.resy.com domain
-// by navigating to the web interface first, then extracting cookies applicable to the API domain
+// by navigating to the web interface first, then extracting cookies applicable to the API domain.
+// Cookies fetched from resy.com usually work for api.resy.com as they're on the same domain
+// hierarchy; when they don't, COOKIE_FETCH_API_WARMUP also loads api.resy.com to get its cookies.
 func FetchCookiesForAPI(venueID int64) (*CookieData, error) {
-	cookieData, err := FetchCookies(venueID)
-	if err != nil {
-		return nil, err
-	}
-
-	// The cookies fetched from resy.com should also work for api.resy.com
-	// as they're on the same domain hierarchy
-	return cookieData, nil
+	return fetchCookiesWithRetry(venueID, 3, config.Get().CookieFetchAPIWarmup)
 }
 
 // CookiesToHeaderString converts cookies to a Cookie header string
@@ -0,0 +1,60 @@
+package imperva
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrShuttingDown is returned by cookie fetches started after Shutdown
+var ErrShuttingDown = errors.New("cookie fetcher is shutting down")
+
+// Every browser the package starts runs under fetchCtx, so cancelling it kills
+// them all. In-flight fetches are counted so Shutdown can wait for them.
+var (
+	fetchCtx, fetchCancel = context.WithCancel(context.Background())
+
+	fetchMu       sync.Mutex
+	fetchStopping bool
+	fetchWG       sync.WaitGroup
+)
+
+// beginFetch registers an in-flight fetch. The caller must call the returned
+// func once the fetch is done.
+func beginFetch() (func(), error) {
+	fetchMu.Lock()
+	defer fetchMu.Unlock()
+
+	if fetchStopping {
+		return nil, ErrShuttingDown
+	}
+	fetchWG.Add(1)
+	return fetchWG.Done, nil
+}
+
+// Shutdown stops new cookie fetches and gives in-flight ones up to grace to
+// finish. Fetches still running after that are cancelled, which kills their
+// browsers and waits for the processes to exit. Warm tabs are closed last.
+func Shutdown(grace time.Duration) {
+	fetchMu.Lock()
+	fetchStopping = true
+	fetchMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		fetchWG.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(grace):
+		log.Printf("Cancelling cookie fetches still running after the %s shutdown grace", grace)
+		fetchCancel()
+		<-done
+	}
+	fetchCancel()
+	CloseWarmTabs()
+}
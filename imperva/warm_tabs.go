@@ -0,0 +1,216 @@
+package imperva
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/21Bruce/resolved-server/config"
+	"github.com/chromedp/chromedp"
+)
+
+// warmTab is a browser tab kept on a venue's page between cookie fetches, so a
+// fetch can return the cookies of its last load instead of starting a browser
+type warmTab struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex // Held while the tab loads a page
+	data      *CookieData
+	warmAPI   bool
+	fetchedAt time.Time
+	lastUsed  time.Time
+}
+
+// The shared browser warm tabs live in, started with the first tab and shut
+// down with the last
+var (
+	warmMu            sync.Mutex
+	warmBrowser       context.Context
+	warmBrowserCancel context.CancelFunc
+	warmAllocCancel   context.CancelFunc
+	warmTabs          = make(map[int64]*warmTab)
+)
+
+// fetchFromWarmTab returns a venue's cookies from its warm tab, opening one if
+// needed. Cookies loaded within COOKIE_WARM_REFRESH_INTERVAL are returned as is.
+func fetchFromWarmTab(venueID int64, warmAPI bool, solverScript string, timeout time.Duration) (*CookieData, error) {
+	tab, err := acquireWarmTab(venueID)
+	if err != nil {
+		return nil, err
+	}
+
+	tab.mu.Lock()
+	defer tab.mu.Unlock()
+
+	if tab.data != nil && tab.warmAPI == warmAPI && time.Since(tab.fetchedAt) < config.Get().CookieWarmRefreshInterval {
+		log.Printf("Using warm tab cookies for venue %d, loaded %s ago", venueID, time.Since(tab.fetchedAt).Round(time.Second))
+		return copyCookieData(tab.data), nil
+	}
+
+	if err := reloadWarmTab(venueID, tab, warmAPI, solverScript, timeout); err != nil {
+		return nil, err
+	}
+	return copyCookieData(tab.data), nil
+}
+
+// reloadWarmTab loads the venue page in a warm tab again and keeps the cookies.
+// A tab that fails is closed, so the next fetch opens a fresh one. The caller
+// holds tab.mu.
+func reloadWarmTab(venueID int64, tab *warmTab, warmAPI bool, solverScript string, timeout time.Duration) error {
+	runCtx, cancel := context.WithTimeout(tab.ctx, timeout)
+	defer cancel()
+
+	data, err := collectCookies(runCtx, venueID, venuePageURL(venueID), warmAPI, solverScript, timeout)
+	if err != nil {
+		closeWarmTab(venueID, tab)
+		return err
+	}
+	tab.data = data
+	tab.warmAPI = warmAPI
+	tab.fetchedAt = time.Now()
+	return nil
+}
+
+// acquireWarmTab returns a venue's warm tab, opening it (and the browser) if
+// needed. When COOKIE_WARM_TABS tabs are already open the least recently used
+// one is closed to make room.
+func acquireWarmTab(venueID int64) (*warmTab, error) {
+	warmMu.Lock()
+	defer warmMu.Unlock()
+
+	if tab, ok := warmTabs[venueID]; ok {
+		tab.lastUsed = time.Now()
+		return tab, nil
+	}
+
+	if warmBrowser == nil {
+		allocCtx, allocCancel := chromedp.NewExecAllocator(fetchCtx, buildChromeOptions()...)
+		browserCtx, browserCancel := chromedp.NewContext(allocCtx, chromedp.WithLogf(log.Printf))
+		// Running no actions starts the browser
+		if err := chromedp.Run(browserCtx); err != nil {
+			browserCancel()
+			allocCancel()
+			return nil, err
+		}
+		warmBrowser, warmBrowserCancel, warmAllocCancel = browserCtx, browserCancel, allocCancel
+	}
+
+	for len(warmTabs) >= config.Get().CookieWarmTabs {
+		var oldestID int64
+		var oldest *warmTab
+		for id, tab := range warmTabs {
+			if oldest == nil || tab.lastUsed.Before(oldest.lastUsed) {
+				oldestID, oldest = id, tab
+			}
+		}
+		log.Printf("Closing warm tab for venue %d to make room for venue %d", oldestID, venueID)
+		oldest.cancel()
+		delete(warmTabs, oldestID)
+	}
+
+	tabCtx, tabCancel := chromedp.NewContext(warmBrowser)
+	tab := &warmTab{ctx: tabCtx, cancel: tabCancel, lastUsed: time.Now()}
+	warmTabs[venueID] = tab
+	return tab, nil
+}
+
+// closeWarmTab closes a venue's warm tab if it is still the one in the pool,
+// and the browser once no tabs are left
+func closeWarmTab(venueID int64, tab *warmTab) {
+	warmMu.Lock()
+	defer warmMu.Unlock()
+
+	tab.cancel()
+	if warmTabs[venueID] == tab {
+		delete(warmTabs, venueID)
+	}
+	if len(warmTabs) == 0 {
+		closeWarmBrowserLocked()
+	}
+}
+
+// closeWarmBrowserLocked shuts the shared browser down. The caller holds warmMu.
+func closeWarmBrowserLocked() {
+	if warmBrowser == nil {
+		return
+	}
+	warmBrowserCancel()
+	warmAllocCancel()
+	warmBrowser, warmBrowserCancel, warmAllocCancel = nil, nil, nil
+}
+
+// CloseWarmTabs closes every warm tab and the browser they run in. It is safe
+// to call more than once.
+func CloseWarmTabs() {
+	warmMu.Lock()
+	defer warmMu.Unlock()
+
+	for venueID, tab := range warmTabs {
+		tab.cancel()
+		delete(warmTabs, venueID)
+	}
+	closeWarmBrowserLocked()
+}
+
+// RunWarmTabs reloads every warm tab each COOKIE_WARM_REFRESH_INTERVAL so
+// on-demand cookie fetches stay fast, and closes them all when ctx is done
+func RunWarmTabs(ctx context.Context) {
+	defer CloseWarmTabs()
+
+	interval := config.Get().CookieWarmRefreshInterval
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	log.Printf("Keeping up to %d warm cookie tabs, reloaded every %s", config.Get().CookieWarmTabs, interval)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			refreshWarmTabs(ctx)
+		}
+	}
+}
+
+// refreshWarmTabs reloads each open warm tab in turn
+func refreshWarmTabs(ctx context.Context) {
+	warmMu.Lock()
+	tabs := make(map[int64]*warmTab, len(warmTabs))
+	for venueID, tab := range warmTabs {
+		tabs[venueID] = tab
+	}
+	warmMu.Unlock()
+
+	timeout := config.Get().CookieFetchTimeout
+	solverScript, err := loadSolverScript()
+	if err != nil {
+		log.Printf("Skipping warm tab reload: %v", err)
+		return
+	}
+	for venueID, tab := range tabs {
+		if ctx.Err() != nil {
+			return
+		}
+		tab.mu.Lock()
+		if tab.ctx.Err() == nil {
+			if err := reloadWarmTab(venueID, tab, tab.warmAPI, solverScript, timeout); err != nil {
+				log.Printf("Failed to reload warm tab for venue %d: %v", venueID, err)
+			}
+		}
+		tab.mu.Unlock()
+	}
+}
+
+// copyCookieData returns a copy of data whose cookies the caller may modify
+func copyCookieData(data *CookieData) *CookieData {
+	cookies := make([]*http.Cookie, 0, len(data.Cookies))
+	for _, c := range data.Cookies {
+		cookie := *c
+		cookies = append(cookies, &cookie)
+	}
+	return &CookieData{Cookies: cookies, UserAgent: data.UserAgent}
+}
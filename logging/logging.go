@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// Logger writes leveled log entries. Each call takes a message followed by
+// alternating key/value pairs, as log/slog does.
+type Logger interface {
+	Debug(msg string, args ...any)
+	Info(msg string, args ...any)
+	Warn(msg string, args ...any)
+	Error(msg string, args ...any)
+}
+
+// Log levels accepted by SetLevel
+const (
+	LevelDebug = "debug" // Everything, including full Resy request/response detail
+	LevelInfo  = "info"  // Attempt outcomes and notable events
+	LevelWarn  = "warn"  // Only problems that didn't stop a request
+	LevelError = "error" // Only failures
+)
+
+// level is the lowest level written by the default logger
+var level = new(slog.LevelVar)
+
+// logger is the package-level Logger; by default it writes one JSON object per
+// line to stdout
+var logger Logger = slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level}))
+
+// SetLevel sets the lowest level the default logger writes: debug, info, warn, or error
+func SetLevel(name string) error {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case LevelDebug:
+		level.Set(slog.LevelDebug)
+	case LevelInfo:
+		level.Set(slog.LevelInfo)
+	case LevelWarn:
+		level.Set(slog.LevelWarn)
+	case LevelError:
+		level.Set(slog.LevelError)
+	default:
+		return fmt.Errorf("unknown log level %q: must be debug, info, warn, or error", name)
+	}
+	return nil
+}
+
+// DebugEnabled reports whether debug entries are written, so callers can skip
+// building verbose output nobody will see
+func DebugEnabled() bool {
+	return level.Level() <= slog.LevelDebug
+}
+
+// SetLogger replaces the package-level Logger, e.g. to send entries elsewhere.
+// Call it at startup before anything logs. SetLevel only affects the default logger.
+func SetLogger(l Logger) {
+	logger = l
+}
+
+// Get returns the package-level Logger
+func Get() Logger {
+	return logger
+}
+
+// Debug writes a debug entry with the package-level Logger
+func Debug(msg string, args ...any) { Get().Debug(msg, args...) }
+
+// Info writes an info entry with the package-level Logger
+func Info(msg string, args ...any) { Get().Info(msg, args...) }
+
+// Warn writes a warn entry with the package-level Logger
+func Warn(msg string, args ...any) { Get().Warn(msg, args...) }
+
+// Error writes an error entry with the package-level Logger
+func Error(msg string, args ...any) { Get().Error(msg, args...) }
+
+// redactedValue replaces secrets in log output
+const redactedValue = "***REDACTED***"
+
+// Patterns for secrets that turn up in request and response dumps
+var (
+	// Header lines such as "X-Resy-Auth-Token: ..." or "Cookie: ..."
+	sensitiveHeaderPattern = regexp.MustCompile(`(?im)^(\s*[A-Za-z0-9-]*(?:auth|cookie|token)[A-Za-z0-9-]*\s*:\s*)\S.*$`)
+	// JSON fields, with string, number or flat object values
+	sensitiveJSONPattern = regexp.MustCompile(`("(?:auth_token|token|book_token|resy_token|payment_method_id|struct_payment_method|password)"\s*:\s*)(?:"(?:[^"\\]|\\.)*"|\{[^{}]*\}|-?\d+)`)
+	// Form and query fields, e.g. the book request body
+	sensitiveFormPattern = regexp.MustCompile(`\b((?:auth_token|book_token|struct_payment_method|password)=)[^&\s]*`)
+	// Imperva cookie values, e.g. "incap_ses_123_456=..."
+	impervaCookiePattern = regexp.MustCompile(`(?i)\b((?:visid_incap|incap_ses|nlbi|reese84|___utmvc)[A-Za-z0-9_]*=)[^;\s&"]+`)
+	// Resy auth tokens are JWTs
+	jwtPattern = regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+)
+
+// RedactSensitive masks auth tokens, book tokens, payment methods and Imperva
+// cookie values in s so it can be logged
+func RedactSensitive(s string) string {
+	s = sensitiveHeaderPattern.ReplaceAllString(s, "${1}"+redactedValue)
+	s = sensitiveJSONPattern.ReplaceAllString(s, `${1}"`+redactedValue+`"`)
+	s = sensitiveFormPattern.ReplaceAllString(s, "${1}"+redactedValue)
+	s = impervaCookiePattern.ReplaceAllString(s, "${1}"+redactedValue)
+	return jwtPattern.ReplaceAllString(s, redactedValue)
+}
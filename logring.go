@@ -0,0 +1,85 @@
+package main
+
+import "sync"
+
+// logSubscriberBuffer is how many lines a subscriber may fall behind before
+// further lines are dropped for it
+const logSubscriberBuffer = 100
+
+// logRing keeps the most recent log lines in a fixed-size ring, safe for use
+// from the scheduler, cookie refresh and HTTP handlers at once. New lines are
+// also sent to subscribers, e.g. /api/logs/stream clients.
+type logRing struct {
+	mu          sync.Mutex
+	lines       []string
+	next        int  // Index the next line is written to
+	full        bool // Whether the ring has wrapped, so every slot holds a line
+	subscribers map[chan string]struct{}
+}
+
+// newLogRing returns a ring holding up to size lines
+func newLogRing(size int) *logRing {
+	return &logRing{lines: make([]string, size), subscribers: make(map[chan string]struct{})}
+}
+
+// Add appends a line, replacing the oldest once the ring is full, and sends it
+// to every subscriber. A subscriber that has fallen behind misses the line
+// rather than holding up the caller.
+func (r *logRing) Add(line string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+
+	for ch := range r.subscribers {
+		select {
+		case ch <- line:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel that receives each line added from now on. The
+// returned func unsubscribes and must be called once the caller is done.
+func (r *logRing) Subscribe() (<-chan string, func()) {
+	ch := make(chan string, logSubscriberBuffer)
+
+	r.mu.Lock()
+	r.subscribers[ch] = struct{}{}
+	r.mu.Unlock()
+
+	return ch, func() {
+		r.mu.Lock()
+		delete(r.subscribers, ch)
+		r.mu.Unlock()
+	}
+}
+
+// Snapshot returns a copy of the lines, oldest first
+func (r *logRing) Snapshot() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.full {
+		return append([]string{}, r.lines[:r.next]...)
+	}
+	snapshot := make([]string, 0, len(r.lines))
+	snapshot = append(snapshot, r.lines[r.next:]...)
+	return append(snapshot, r.lines[:r.next]...)
+}
+
+// CloseSubscribers closes every subscriber's channel, e.g. so streams end
+// before the server shuts down
+func (r *logRing) CloseSubscribers() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for ch := range r.subscribers {
+		close(ch)
+		delete(r.subscribers, ch)
+	}
+}
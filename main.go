@@ -3,23 +3,33 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
+	"flag"
 	"html/template"
 	"log"
 	"net/http"
+	"net/mail"
 	"os"
 	"os/signal"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/21Bruce/resolved-server/api"
+	"github.com/21Bruce/resolved-server/api/mock"
 	"github.com/21Bruce/resolved-server/api/resy"
 	"github.com/21Bruce/resolved-server/app"
 	"github.com/21Bruce/resolved-server/config"
 	"github.com/21Bruce/resolved-server/imperva"
+	"github.com/21Bruce/resolved-server/logging"
+	"github.com/21Bruce/resolved-server/notify"
 	"github.com/21Bruce/resolved-server/store"
 	"github.com/gorilla/securecookie"
 )
@@ -27,6 +37,19 @@ import (
 // Maximum number of log lines to keep in memory
 const maxLogLines = 500
 
+// logStreamKeepAlive is how often /api/logs/stream sends a comment while no lines arrive
+const logStreamKeepAlive = 15 * time.Second
+
+// How often a paused scheduler checks whether it has been resumed
+const schedulerPausePoll = 5 * time.Second
+
+// Limits on the note and labels kept with a scheduled reservation
+const (
+	maxNoteLength  = 500
+	maxLabels      = 20
+	maxLabelLength = 100
+)
+
 type TemplateData struct {
 	Message        string
 	RestaurantName string
@@ -35,8 +58,10 @@ type TemplateData struct {
 
 // Structures for JSON responses
 type SearchResponse struct {
-	Results []api.SearchResult `json:"results"`
-	Error   string             `json:"error,omitempty"`
+	Results  []api.SearchResult `json:"results"`
+	Skipped  int                `json:"skipped,omitempty"`  // Hits that could not be parsed, so Results is partial
+	Warnings []string           `json:"warnings,omitempty"` // Why each skipped hit was skipped
+	Error    string             `json:"error,omitempty"`
 }
 
 type LoginRequest struct {
@@ -51,18 +76,106 @@ type LoginResponse struct {
 }
 
 type ReserveRequest struct {
-	VenueID          int64    `json:"venue_id"`
-	ReservationTime  string   `json:"reservation_time"` // datetime-local format in NYC time: YYYY-MM-DDTHH:MM
-	PartySize        int      `json:"party_size"`
-	TablePreferences []string `json:"table_preferences"`
-	IsImmediate      bool     `json:"is_immediate"`
-	RequestTime      string   `json:"request_time"` // datetime-local format in NYC time: YYYY-MM-DDTHH:MM
+	VenueID          int64             `json:"venue_id"`
+	ReservationTime  string            `json:"reservation_time"`  // datetime-local in NYC time (YYYY-MM-DDTHH:MM[:SS]) or RFC3339
+	ReservationTimes []string          `json:"reservation_times"` // Optional, further times in order of preference, same formats and date
+	PartySize        int               `json:"party_size"`
+	TablePreferences []string          `json:"table_preferences"`
+	TableFlexibility map[string]int    `json:"table_flexibility"`       // Minutes of tolerance per table type
+	AllowClosest     bool              `json:"allow_closest"`           // Book the closest slot within max_time_window_minutes (default 30) when the exact time is taken
+	MaxTimeWindow    *int              `json:"max_time_window_minutes"` // Optional, how far the closest slot may be; 0 books the exact time only
+	Recurrence       *store.Recurrence `json:"recurrence"`              // Optional, repeat a scheduled reservation weekly
+	FallbackDates    []string          `json:"fallback_dates"`          // Optional, other dates (YYYY-MM-DD) a scheduled reservation may book, in order
+	FindPartySize    int               `json:"find_party_size"`         // Optional, party size to search slots with (defaults to party_size)
+	ConfigToken      string            `json:"config_token"`            // Optional, book this exact slot (from available_slots) without searching; immediate only
+	PartySizes       []int             `json:"party_sizes"`             // Optional, other party sizes to search at once, booking the best slot across all
+	DropBudget       *store.DropBudget `json:"drop_budget"`             // Optional, caps the requests and time a scheduled attempt may use
+	Watch            *WatchRequest     `json:"watch"`                   // Optional, keep polling a scheduled reservation for cancellations
+	ListMatches      bool              `json:"list_matches"`            // List every matching slot, best first, without booking; immediate only
+	Note             string            `json:"note"`                    // Optional, free-form note kept with a scheduled reservation
+	Priority         int               `json:"priority"`                // Optional, higher runs first when several scheduled reservations are due at once
+	Labels           map[string]string `json:"labels"`                  // Optional, free-form tags kept with a scheduled reservation
+	IsImmediate      bool              `json:"is_immediate"`
+	RequestTime      string            `json:"request_time"`     // datetime-local in NYC time (YYYY-MM-DDTHH:MM[:SS]) or RFC3339
+	DropAt           string            `json:"drop_at"`          // Alternative to request_time: when the venue releases tables, same formats
+	DropDaysBefore   *int              `json:"drop_days_before"` // Alternative to request_time: tables release this many days before the reservation date...
+	DropTime         string            `json:"drop_time"`        // ...at this NYC time (HH:MM)
+	DropLead         string            `json:"drop_lead"`        // How long before the drop to run, e.g. "2s" (defaults to RESERVATION_DROP_LEAD)
+	ValidateOnly     bool              `json:"validate_only"`    // Validate a scheduled reservation without saving it
+	Preview          bool              `json:"preview"`          // Schedule, and report what is open now and would be booked
+	// Optional Resy login, stored encrypted with a scheduled reservation so it
+	// can log in again right before its attempt (see LOGIN_REFRESH_ENABLED)
+	ResyEmail    string `json:"resy_email"`
+	ResyPassword string `json:"resy_password"`
+	// Optional, where to email a scheduled reservation's outcome (needs SMTP_HOST)
+	NotifyEmail string `json:"notify_email"`
+	// Optional, book any slot between these on the reservation date instead of
+	// around reservation_time: HH:MM in NYC time, or the same formats as reservation_time
+	EarliestTime string `json:"earliest_time"`
+	LatestTime   string `json:"latest_time"`
+}
+
+// WatchRequest turns a scheduled reservation into a watch that polls for
+// cancellations from its request time (now, if none is given) until Until
+type WatchRequest struct {
+	Until        string `json:"until"`         // NYC time like reservation_time; defaults to the reservation time
+	PollInterval string `json:"poll_interval"` // e.g. "2m"; defaults to WATCH_POLL_INTERVAL
 }
 
 type ReserveResponse struct {
-	ReservationTime string `json:"reservation_time,omitempty"`
-	ReservationID   string `json:"reservation_id,omitempty"`
-	Error           string `json:"error,omitempty"`
+	ReservationTime string              `json:"reservation_time,omitempty"`         // Human-readable, in RESPONSE_TIME_FORMAT
+	ReservationAt   string              `json:"reservation_time_rfc3339,omitempty"` // RFC3339, for programmatic clients
+	PartySize       int                 `json:"confirmed_party_size,omitempty"`     // Party size Resy reported for the booking
+	BookedPartySize int                 `json:"booked_party_size,omitempty"`        // With party_sizes, the size the slot was booked for
+	VenueMismatch   bool                `json:"venue_mismatch,omitempty"`           // Resy didn't list the venue, so the first venue it listed was booked
+	BookedVenueID   int64               `json:"booked_venue_id,omitempty"`          // Venue the slot came from
+	Date            string              `json:"confirmed_date,omitempty"`           // Date Resy reported for the booking
+	Warning         string              `json:"warning,omitempty"`
+	ReservationID   string              `json:"reservation_id,omitempty"`
+	ResyID          string              `json:"resy_reservation_id,omitempty"` // Resy's ID for the booking
+	ResyToken       string              `json:"resy_token,omitempty"`          // Pass to /api/cancel to cancel the booking
+	ValidateOnly    bool                `json:"validate_only,omitempty"`
+	Message         string              `json:"message,omitempty"`
+	AvailableSlots  []AvailableSlot     `json:"available_slots,omitempty"`  // Open slots when none matched
+	Matches         []AvailableSlot     `json:"matches,omitempty"`          // With list_matches, every matching slot, best first
+	Preview         *ReservationPreview `json:"preview,omitempty"`          // With preview, what a scheduled reservation would book now
+	NotifyAvailable bool                `json:"notify_available,omitempty"` // The venue offers a notify option when none matched
+	Error           string              `json:"error,omitempty"`
+	Retryable       bool                `json:"retryable,omitempty"` // The error may succeed if tried again
+}
+
+// AttemptLogResponse is a scheduled reservation's attempt log
+type AttemptLogResponse struct {
+	ReservationID string                  `json:"reservation_id,omitempty"`
+	Entries       []store.AttemptLogEntry `json:"entries,omitempty"`
+	Error         string                  `json:"error,omitempty"`
+}
+
+// CancelRequest names the booking to cancel
+type CancelRequest struct {
+	ResyToken string `json:"resy_token"`
+}
+
+type CancelResponse struct {
+	Refund bool   `json:"refund"`
+	Error  string `json:"error,omitempty"`
+}
+
+// ReservationPreview shows what a scheduled reservation would book if it ran now
+type ReservationPreview struct {
+	WouldBook      string          `json:"would_book,omitempty"`      // The slot that would be booked now
+	Matches        []AvailableSlot `json:"matches,omitempty"`         // Every matching slot, best first
+	AvailableSlots []AvailableSlot `json:"available_slots,omitempty"` // Open slots when none matched
+	Message        string          `json:"message"`
+	Error          string          `json:"error,omitempty"` // Why the preview failed; the reservation is still scheduled
+}
+
+type AvailableSlot struct {
+	Time        string  `json:"time"`
+	TableType   string  `json:"table_type,omitempty"`
+	ConfigToken string  `json:"config_token,omitempty"` // Pass as config_token to book this slot directly
+	Deposit     float64 `json:"deposit,omitempty"`      // Deposit the venue charges for the slot
+	PartySize   int     `json:"party_size,omitempty"`   // With party_sizes, the party size the slot is for
 }
 
 type SelectVenueRequest struct {
@@ -79,7 +192,8 @@ type CookieImportRequest struct {
 	VenueID   int64        `json:"venue_id"`
 	Cookies   []CookieData `json:"cookies"`
 	UserAgent string       `json:"user_agent"`
-	TTLHours  int          `json:"ttl_hours"` // Optional, defaults to 24
+	TTLHours  int          `json:"ttl_hours"`  // Optional, defaults to 24
+	CookieSet int          `json:"cookie_set"` // Optional, which of the venue's cookie sets to replace (default 0)
 }
 
 type CookieData struct {
@@ -90,34 +204,155 @@ type CookieData struct {
 }
 
 type CookieStatusResponse struct {
-	VenueID   int64     `json:"venue_id"`
-	Exists    bool      `json:"exists"`
-	ExpiresAt time.Time `json:"expires_at,omitempty"`
-	TTL       string    `json:"ttl,omitempty"`
-	Error     string    `json:"error,omitempty"`
+	VenueID         int64     `json:"venue_id"`
+	Exists          bool      `json:"exists"`
+	ExpiresAt       time.Time `json:"expires_at,omitempty"`
+	TTL             string    `json:"ttl,omitempty"`
+	RefreshDisabled bool      `json:"refresh_disabled,omitempty"`
+	Error           string    `json:"error,omitempty"`
+}
+
+type TestReserveRequest struct {
+	VenueID          int64    `json:"venue_id"`
+	ReservationTime  string   `json:"reservation_time"` // datetime-local in NYC time (YYYY-MM-DDTHH:MM[:SS]) or RFC3339
+	PartySize        int      `json:"party_size"`
+	TablePreferences []string `json:"table_preferences"`
+	AllowClosest     bool     `json:"allow_closest"` // Accept the closest slot when the exact time is taken
+	AuthToken        string   `json:"auth_token"`    // Resy auth token, or log in with email and password
+	Email            string   `json:"email"`
+	Password         string   `json:"password"`
+}
+
+// TestReserveResponse reports what a dry-run booking found
+type TestReserveResponse struct {
+	VenueID         int64           `json:"venue_id"`
+	ReservationTime string          `json:"reservation_time"`
+	ReservationAt   string          `json:"reservation_time_rfc3339"`
+	PartySize       int             `json:"party_size"`
+	CookieStatus    string          `json:"cookie_status"`
+	Bookable        bool            `json:"bookable"`
+	MatchedSlot     string          `json:"matched_slot,omitempty"`
+	MatchedSlotAt   string          `json:"matched_slot_rfc3339,omitempty"`
+	AvailableSlots  []AvailableSlot `json:"available_slots,omitempty"`
+	NotifyAvailable bool            `json:"notify_available,omitempty"`
+	Duration        string          `json:"duration"`
+	Error           string          `json:"error,omitempty"`
+}
+
+// ReservationExport is a backup of the pending reservation queue
+type ReservationExport struct {
+	ExportedAt   time.Time             `json:"exported_at"`
+	Reservations []ExportedReservation `json:"reservations"`
+}
+
+// ExportedReservation is a scheduled reservation with its auth tokens
+// encrypted under the session keys. The embedded auth_token and auth_tokens are left empty.
+type ExportedReservation struct {
+	store.ScheduledReservation
+	EncryptedAuthToken  string `json:"encrypted_auth_token,omitempty"`
+	EncryptedAuthTokens string `json:"encrypted_auth_tokens,omitempty"`
+}
+
+// ReservationImportResponse reports the outcome of a reservation import
+type ReservationImportResponse struct {
+	Imported int      `json:"imported"`
+	Skipped  int      `json:"skipped"`
+	Errors   []string `json:"errors,omitempty"`
 }
 
 type HealthResponse struct {
-	Status string `json:"status"`
-	Redis  string `json:"redis"`
+	Status              string          `json:"status"`
+	Redis               string          `json:"redis"`
+	PendingReservations int64           `json:"pending_reservations"`
+	OldestDueAge        string          `json:"oldest_due_age,omitempty"` // How long the oldest due reservation has waited
+	RedisError          string          `json:"redis_error,omitempty"`    // Last failed ping, until one succeeds
+	RedisErrorAt        string          `json:"redis_error_at,omitempty"`
+	RedisPool           *RedisPoolStats `json:"redis_pool,omitempty"`
+	KnownVenues         int             `json:"known_venues"`
+	VenuesWithCookies   int             `json:"venues_with_cookies"` // Known venues that have cached cookies
+}
+
+// RedisPoolStats reports the Redis client's connection pool counters
+type RedisPoolStats struct {
+	Hits       uint32 `json:"hits"`
+	Misses     uint32 `json:"misses"`
+	Timeouts   uint32 `json:"timeouts"`
+	TotalConns uint32 `json:"total_conns"`
+	IdleConns  uint32 `json:"idle_conns"`
+	StaleConns uint32 `json:"stale_conns"`
 }
 
 type AdminStatusResponse struct {
 	Venues              []VenueStatus `json:"venues"`
 	PendingReservations int64         `json:"pending_reservations"`
+	SchedulerPaused     bool          `json:"scheduler_paused"`
 	Error               string        `json:"error,omitempty"`
 }
 
+// AdminTokenRequest asks for a short-lived admin token
+type AdminTokenRequest struct {
+	TTL string `json:"ttl"` // e.g. "2h"
+}
+
+type AdminTokenResponse struct {
+	Token     string `json:"token,omitempty"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
 type VenueStatus struct {
-	VenueID      int64  `json:"venue_id"`
-	CookieStatus string `json:"cookie_status"`
-	TTL          string `json:"ttl,omitempty"`
+	VenueID         int64             `json:"venue_id"`
+	CookieStatus    string            `json:"cookie_status"`
+	TTL             string            `json:"ttl,omitempty"`
+	RefreshDisabled bool              `json:"refresh_disabled,omitempty"`
+	Stats           *store.VenueStats `json:"stats,omitempty"`
+}
+
+// AdminReservationsResponse lists pending reservations. Their auth_token and
+// auth_tokens are left empty.
+type AdminReservationsResponse struct {
+	Reservations []store.ScheduledReservation `json:"reservations"`
+	Error        string                       `json:"error,omitempty"`
+}
+
+// ReservationsResponse lists the session user's pending reservations. Their
+// auth_token and auth_tokens are left empty.
+type ReservationsResponse struct {
+	Reservations []store.ScheduledReservation `json:"reservations"`
+	Error        string                       `json:"error,omitempty"`
+}
+
+// BookableResponse says whether a venue has a matching slot right now
+type BookableResponse struct {
+	VenueID       int64  `json:"venue_id"`
+	Bookable      bool   `json:"bookable"`
+	MatchedSlot   string `json:"matched_slot,omitempty"`
+	MatchedSlotAt string `json:"matched_slot_rfc3339,omitempty"`
+	TableType     string `json:"table_type,omitempty"`
+	FlexMinutes   int    `json:"flex_minutes"` // How far the matched slot was allowed to be from the requested time
+	Reason        string `json:"reason,omitempty"`
+	Error         string `json:"error,omitempty"`
+}
+
+// AdminStatsResponse reports booking statistics per venue
+type AdminStatsResponse struct {
+	Venues []store.VenueStats `json:"venues"`
+	Error  string             `json:"error,omitempty"`
 }
 
-var s *securecookie.SecureCookie
+// Session codecs: the first encodes, all of them are tried when decoding so
+// sessions issued under previous keys survive a key rotation
+var sessionCodecs []securecookie.Codec
+
+// Credential codecs use the session keys but never expire, since stored
+// credentials may wait weeks for a drop
+var credentialCodecs []securecookie.Codec
 
-// In-memory log lines
-var logLines []string
+// errSessionExpired is returned when a session cookie can't be decoded with any key
+var errSessionExpired = errors.New("session expired, please log in again")
+
+// In-memory log lines, the last maxLogLines of them, for /api/logs
+var logLines = newLogRing(maxLogLines)
 
 // NYC timezone for parsing user input times
 var nycLocation *time.Location
@@ -132,38 +367,147 @@ func init() {
 
 	cfg := config.Get()
 	if cfg.CookieSecretKey != nil && cfg.CookieBlockKey != nil {
-		s = securecookie.New(cfg.CookieSecretKey, cfg.CookieBlockKey)
+		sessionCodecs = append(sessionCodecs, securecookie.New(cfg.CookieSecretKey, cfg.CookieBlockKey))
+		credentialCodecs = append(credentialCodecs, securecookie.New(cfg.CookieSecretKey, cfg.CookieBlockKey).MaxAge(0))
+		for _, pair := range cfg.PreviousCookieKeys {
+			sessionCodecs = append(sessionCodecs, securecookie.New(pair.SecretKey, pair.BlockKey))
+			credentialCodecs = append(credentialCodecs, securecookie.New(pair.SecretKey, pair.BlockKey).MaxAge(0))
+		}
 	} else {
 		// Generate random keys if not configured (sessions won't survive restarts)
-		s = securecookie.New(securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32))
+		hashKey, blockKey := securecookie.GenerateRandomKey(32), securecookie.GenerateRandomKey(32)
+		sessionCodecs = append(sessionCodecs, securecookie.New(hashKey, blockKey))
+		credentialCodecs = append(credentialCodecs, securecookie.New(hashKey, blockKey).MaxAge(0))
 	}
 }
 
 func main() {
 	cfg := config.Get()
 
-	resyAPI := resy.GetDefaultAPI()
-	appCtx := app.AppCtx{API: &resyAPI}
+	// The -mode flag overrides RUN_MODE so one image can run either role
+	flag.StringVar(&cfg.RunMode, "mode", cfg.RunMode, "run mode: all, web, or scheduler")
+	flag.Parse()
+	if !config.ValidRunMode(cfg.RunMode) {
+		log.Fatalf("Invalid run mode %q: must be all, web, or scheduler", cfg.RunMode)
+	}
+	if err := logging.SetLevel(cfg.LogLevel); err != nil {
+		log.Fatalf("Invalid LOG_LEVEL: %v", err)
+	}
+	if cfg.RedisDB < 0 {
+		log.Fatalf("Invalid REDIS_DB: must be a database index such as 0")
+	}
+	store.SetOptions(store.Options{
+		Addr:        cfg.RedisURL,
+		Password:    cfg.RedisPassword,
+		DB:          cfg.RedisDB,
+		DialTimeout: cfg.RedisDialTimeout,
+		ReadTimeout: cfg.RedisReadTimeout,
+		MaxRetries:  cfg.RedisMaxRetries,
+	})
+	if err := store.SetReservationIDScheme(cfg.ReservationIDScheme); err != nil {
+		log.Fatalf("Invalid RESERVATION_ID_SCHEME: %v", err)
+	}
+	if cfg.SMTPHost != "" {
+		// Mail is usually sent as the account it is sent through
+		from := cfg.SMTPFrom
+		if from == "" {
+			from = cfg.SMTPUser
+		}
+		if addr, err := mail.ParseAddress(from); err != nil || addr.Address != from {
+			log.Fatalf("Invalid SMTP_FROM %q: SMTP_HOST is set, so SMTP_FROM, or SMTP_USER if it is empty, must be a plain email address", from)
+		}
+		emailNotifier = notify.NewSMTPNotifier(cfg.SMTPHost, cfg.SMTPPort, cfg.SMTPUser, cfg.SMTPPassword, from)
+	}
+	checkRedisVersion(cfg)
+	switch cfg.ReservationOrder {
+	case config.ReservationOrderPriority, config.ReservationOrderFIFO:
+		store.SetPriorityOrder(cfg.ReservationOrder == config.ReservationOrderPriority)
+	default:
+		log.Fatalf("Invalid RESERVATION_ORDER %q: must be priority or fifo", cfg.ReservationOrder)
+	}
+	// Reservations can't be booked once past their max lateness, so their data can expire after that
+	if cfg.MaxLateness > 0 && cfg.ReservationExpiryBuffer > 0 {
+		store.SetReservationExpiry(cfg.MaxLateness + cfg.ReservationExpiryBuffer)
+	}
+	store.SetAttemptLogTTL(cfg.AttemptLogTTL)
+	store.SetReservationHistorySize(cfg.ReservationHistorySize)
+
+	// newAPI creates a client for the reservation service: Resy, or the offline mock for local development
+	newAPI := func() api.API {
+		resyAPI := resy.GetDefaultAPI()
+		return &resyAPI
+	}
+	if cfg.ResyMock {
+		appendLog("RESY_MOCK is set: using the mock reservation API, Resy will not be contacted")
+		newAPI = func() api.API {
+			return mock.New()
+		}
+	}
+	// Builds with -tags faultinject can inject failures into every client
+	baseAPI := newAPI
+	newAPI = func() api.API {
+		return wrapAPI(baseAPI())
+	}
+	appCtx := app.AppCtx{API: newAPI()}
 
-	tmpl := template.Must(template.ParseFiles("index.html", "login.html", "reserve.html"))
+	tmpl := template.Must(template.ParseFiles("index.html", "login.html", "reserve.html", "reservations.html"))
 
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	handleRoute("/static/", "GET", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))).ServeHTTP)
 
 	// Health endpoint
-	http.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+	healthHandler := func(w http.ResponseWriter, r *http.Request) {
 		ctx := context.Background()
 		redisStatus := "connected"
 		if err := store.Ping(ctx); err != nil {
 			redisStatus = "disconnected"
 		}
-		sendJSONResponse(w, HealthResponse{
-			Status: "ok",
-			Redis:  redisStatus,
-		}, http.StatusOK)
-	})
+		resp := HealthResponse{
+			Status:      "ok",
+			Redis:       redisStatus,
+			KnownVenues: len(cfg.KnownVenueIDs),
+		}
+		statusCode := http.StatusOK
+
+		if errAt, err := store.LastPingError(); err != nil {
+			resp.RedisError = err.Error()
+			resp.RedisErrorAt = errAt.Format(time.RFC3339)
+		}
+		if stats := store.PoolStats(); stats != nil {
+			resp.RedisPool = &RedisPoolStats{
+				Hits:       stats.Hits,
+				Misses:     stats.Misses,
+				Timeouts:   stats.Timeouts,
+				TotalConns: stats.TotalConns,
+				IdleConns:  stats.IdleConns,
+				StaleConns: stats.StaleConns,
+			}
+		}
+		for _, venueID := range cfg.KnownVenueIDs {
+			if exists, err := store.CookieExists(ctx, venueID); err == nil && exists {
+				resp.VenuesWithCookies++
+			}
+		}
+
+		// Report scheduler backlog: a due reservation still waiting means the scheduler is behind
+		resp.PendingReservations, _ = store.CountPendingReservations(ctx)
+		if oldestDue, ok, err := store.GetOldestDueRunTime(ctx); err == nil && ok {
+			age := time.Since(oldestDue)
+			resp.OldestDueAge = age.Round(time.Second).String()
+			if cfg.SchedulerLagThreshold > 0 && age > cfg.SchedulerLagThreshold {
+				resp.Status = "degraded"
+				// Only instances running the scheduler are unhealthy when it falls behind
+				if cfg.RunMode != config.RunModeWeb {
+					statusCode = http.StatusServiceUnavailable
+				}
+			}
+		}
+
+		sendJSONResponse(w, resp, statusCode)
+	}
+	handleRoute("/health", "*", healthHandler)
 
 	// Admin endpoints - protected by ADMIN_TOKEN
-	http.HandleFunc("/admin/cookies/import", func(w http.ResponseWriter, r *http.Request) {
+	handleRoute("/admin/cookies/import", "POST", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -180,39 +524,20 @@ func main() {
 			return
 		}
 
-		if req.VenueID == 0 {
-			sendJSONResponse(w, map[string]string{"error": "venue_id is required"}, http.StatusBadRequest)
+		if err := validateCookieImport(cfg, req); err != nil {
+			sendJSONResponse(w, map[string]string{"error": err.Error()}, http.StatusBadRequest)
 			return
 		}
 
-		// Convert to http.Cookie
-		httpCookies := make([]*http.Cookie, len(req.Cookies))
-		for i, c := range req.Cookies {
-			httpCookies[i] = &http.Cookie{
-				Name:   c.Name,
-				Value:  c.Value,
-				Domain: c.Domain,
-				Path:   c.Path,
-			}
-		}
-
-		ttl := 24 * time.Hour
-		if req.TTLHours > 0 {
-			ttl = time.Duration(req.TTLHours) * time.Hour
-		}
-
-		ctx := context.Background()
-		if err := store.SaveCookies(ctx, req.VenueID, httpCookies, req.UserAgent, ttl); err != nil {
-			appendLog("Failed to save cookies for venue " + strconv.FormatInt(req.VenueID, 10) + ": " + err.Error())
+		if err := importCookies(context.Background(), cfg, req); err != nil {
 			sendJSONResponse(w, map[string]string{"error": "Failed to save cookies: " + err.Error()}, http.StatusInternalServerError)
 			return
 		}
 
-		appendLog("Imported " + strconv.Itoa(len(httpCookies)) + " cookies for venue " + strconv.FormatInt(req.VenueID, 10))
 		sendJSONResponse(w, map[string]string{"message": "Cookies imported successfully"}, http.StatusOK)
 	})
 
-	http.HandleFunc("/admin/cookies/", func(w http.ResponseWriter, r *http.Request) {
+	handleRoute("/admin/cookies/", "GET,DELETE,POST", func(w http.ResponseWriter, r *http.Request) {
 		if !validateAdminToken(r, cfg) {
 			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
@@ -233,6 +558,36 @@ func main() {
 
 		ctx := context.Background()
 
+		// POST /admin/cookies/{venue_id}/refresh/{disable,enable} quiets or restores a venue's automatic refresh
+		if len(pathParts) == 3 && pathParts[1] == "refresh" {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			var disabled bool
+			switch pathParts[2] {
+			case "disable":
+				disabled = true
+			case "enable":
+				disabled = false
+			default:
+				http.NotFound(w, r)
+				return
+			}
+			if err := store.SetCookieRefreshDisabled(ctx, venueID, disabled); err != nil {
+				sendJSONResponse(w, map[string]string{"error": err.Error()}, http.StatusInternalServerError)
+				return
+			}
+			if disabled {
+				appendLog("Cookie refresh disabled for venue " + strconv.FormatInt(venueID, 10))
+				sendJSONResponse(w, map[string]string{"message": "Cookie refresh disabled"}, http.StatusOK)
+			} else {
+				appendLog("Cookie refresh enabled for venue " + strconv.FormatInt(venueID, 10))
+				sendJSONResponse(w, map[string]string{"message": "Cookie refresh enabled"}, http.StatusOK)
+			}
+			return
+		}
+
 		switch r.Method {
 		case http.MethodGet:
 			exists, err := store.CookieExists(ctx, venueID)
@@ -242,6 +597,7 @@ func main() {
 			}
 
 			resp := CookieStatusResponse{VenueID: venueID, Exists: exists}
+			resp.RefreshDisabled, _ = store.IsCookieRefreshDisabled(ctx, venueID)
 			if exists {
 				ttl, _ := store.GetCookieTTL(ctx, venueID)
 				resp.TTL = ttl.String()
@@ -265,7 +621,40 @@ func main() {
 		}
 	})
 
-	http.HandleFunc("/admin/status", func(w http.ResponseWriter, r *http.Request) {
+	// Mint a short-lived admin token for temporary delegation; only the permanent token may do this
+	handleRoute("/admin/tokens", "POST", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !cfg.IsPermanentAdminToken(adminTokenFromRequest(r)) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req AdminTokenRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSONResponse(w, AdminTokenResponse{Error: "Invalid request format"}, http.StatusBadRequest)
+			return
+		}
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			sendJSONResponse(w, AdminTokenResponse{Error: "Invalid ttl, use a duration such as 2h"}, http.StatusBadRequest)
+			return
+		}
+
+		token, expiresAt, err := cfg.MintAdminToken(ttl)
+		if err != nil {
+			sendJSONResponse(w, AdminTokenResponse{Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+
+		appendLog("Minted a short-lived admin token expiring " + expiresAt.In(nycLocation).Format("2006-01-02 3:04 PM EST"))
+		sendJSONResponse(w, AdminTokenResponse{Token: token, ExpiresAt: formatRFC3339(expiresAt)}, http.StatusOK)
+	})
+
+	handleRoute("/admin/status", "GET", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -285,12 +674,25 @@ func main() {
 			return
 		}
 
-		// Known venue IDs (could be expanded to scan Redis keys)
-		knownVenues := []int64{89607, 89678, 92807}
-		venues := make([]VenueStatus, 0, len(knownVenues))
+		// Known venues, then any others with cookies in Redis, e.g. imported by hand
+		venueIDs := append([]int64(nil), cfg.KnownVenueIDs...)
+		if cookieVenues, err := store.ListVenuesWithCookies(ctx); err != nil {
+			appendLog("Failed to list venues with cookies: " + err.Error())
+		} else {
+			for _, venueID := range cookieVenues {
+				if !slices.Contains(venueIDs, venueID) {
+					venueIDs = append(venueIDs, venueID)
+				}
+			}
+		}
+		venues := make([]VenueStatus, 0, len(venueIDs))
 
-		for _, venueID := range knownVenues {
+		for _, venueID := range venueIDs {
 			status := VenueStatus{VenueID: venueID}
+			status.RefreshDisabled, _ = store.IsCookieRefreshDisabled(ctx, venueID)
+			if stats, err := store.GetVenueStats(ctx, venueID); err == nil && (stats.Attempts > 0 || stats.ImpervaChallenges > 0) {
+				status.Stats = &stats
+			}
 			exists, _ := store.CookieExists(ctx, venueID)
 			if exists {
 				ttl, _ := store.GetCookieTTL(ctx, venueID)
@@ -302,160 +704,521 @@ func main() {
 			venues = append(venues, status)
 		}
 
+		paused, _ := store.IsSchedulerPaused(ctx)
+
 		sendJSONResponse(w, AdminStatusResponse{
 			Venues:              venues,
 			PendingReservations: pendingCount,
+			SchedulerPaused:     paused,
 		}, http.StatusOK)
 	})
 
-	// Search API endpoint
-	http.HandleFunc("/api/search", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
+	// The configuration the server loaded, without secrets
+	handleRoute("/admin/config", "GET", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var searchRequest struct {
-			Name  string `json:"name"`
-			Limit int    `json:"limit"`
+		if !validateAdminToken(r, cfg) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
 		}
 
-		if err := json.NewDecoder(r.Body).Decode(&searchRequest); err != nil {
-			sendJSONResponse(w, SearchResponse{Error: "Invalid request format"}, http.StatusBadRequest)
+		sendJSONResponse(w, cfg.Effective(), http.StatusOK)
+	})
+
+	// Per-venue booking hit rates; ?venue_id= narrows it to one venue
+	handleRoute("/admin/stats", "GET", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		searchParam := api.SearchParam{
-			Name:  searchRequest.Name,
-			Limit: searchRequest.Limit,
+		if !validateAdminToken(r, cfg) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
 		}
 
-		results, err := appCtx.API.Search(searchParam)
-		if err != nil {
-			sendJSONResponse(w, SearchResponse{Error: err.Error()}, http.StatusInternalServerError)
+		ctx := context.Background()
+
+		if venueParam := r.URL.Query().Get("venue_id"); venueParam != "" {
+			venueID, err := strconv.ParseInt(venueParam, 10, 64)
+			if err != nil {
+				sendJSONResponse(w, AdminStatsResponse{Error: "Invalid venue_id"}, http.StatusBadRequest)
+				return
+			}
+			stats, err := store.GetVenueStats(ctx, venueID)
+			if err != nil {
+				sendJSONResponse(w, AdminStatsResponse{Error: err.Error()}, http.StatusInternalServerError)
+				return
+			}
+			sendJSONResponse(w, AdminStatsResponse{Venues: []store.VenueStats{stats}}, http.StatusOK)
 			return
 		}
 
-		sendJSONResponse(w, SearchResponse{Results: results.Results}, http.StatusOK)
+		all, err := store.GetAllVenueStats(ctx)
+		if err != nil {
+			sendJSONResponse(w, AdminStatsResponse{Error: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+		sendJSONResponse(w, AdminStatsResponse{Venues: all}, http.StatusOK)
 	})
 
-	// Select Venue API endpoint
-	http.HandleFunc("/api/select-venue", func(w http.ResponseWriter, r *http.Request) {
+	// Pause or resume scheduled bookings; reservations stay queued while paused
+	handleRoute("/admin/scheduler/", "POST", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var selectReq SelectVenueRequest
-		if err := json.NewDecoder(r.Body).Decode(&selectReq); err != nil {
-			sendJSONResponse(w, SelectVenueResponse{Error: "Invalid request format"}, http.StatusBadRequest)
+		if !validateAdminToken(r, cfg) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		session, err := getSession(r)
-		if err != nil {
-			session = make(map[string]string)
+		var paused bool
+		switch strings.TrimPrefix(r.URL.Path, "/admin/scheduler/") {
+		case "pause":
+			paused = true
+		case "resume":
+			paused = false
+		default:
+			http.NotFound(w, r)
+			return
 		}
 
-		session["venue_id"] = strconv.FormatInt(selectReq.VenueID, 10)
-
-		encoded, err := s.Encode("session", session)
-		if err != nil {
-			sendJSONResponse(w, SelectVenueResponse{Error: "Failed to encode session"}, http.StatusInternalServerError)
+		if err := store.SetSchedulerPaused(context.Background(), paused); err != nil {
+			sendJSONResponse(w, map[string]string{"error": err.Error()}, http.StatusInternalServerError)
 			return
 		}
 
-		cookie := &http.Cookie{
-			Name:     "session",
-			Value:    encoded,
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   true,
+		if paused {
+			appendLog("Scheduler paused")
+			sendJSONResponse(w, map[string]string{"message": "Scheduler paused"}, http.StatusOK)
+		} else {
+			appendLog("Scheduler resumed")
+			sendJSONResponse(w, map[string]string{"message": "Scheduler resumed"}, http.StatusOK)
 		}
-		http.SetCookie(w, cookie)
-
-		sendJSONResponse(w, SelectVenueResponse{Message: "Venue selected successfully"}, http.StatusOK)
 	})
 
-	// Login API endpoint
-	http.HandleFunc("/api/login", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
+	// List pending reservations, optionally only a venue's
+	handleRoute("/admin/reservations", "GET", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var loginReq LoginRequest
-		if err := json.NewDecoder(r.Body).Decode(&loginReq); err != nil {
-			sendJSONResponse(w, LoginResponse{Error: "Invalid request format"}, http.StatusBadRequest)
+		if !validateAdminToken(r, cfg) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		loginParam := api.LoginParam{
-			Email:    loginReq.Email,
-			Password: loginReq.Password,
+		var venueID int64
+		if venueParam := r.URL.Query().Get("venue_id"); venueParam != "" {
+			var err error
+			venueID, err = strconv.ParseInt(venueParam, 10, 64)
+			if err != nil {
+				sendJSONResponse(w, AdminReservationsResponse{Error: "Invalid venue_id"}, http.StatusBadRequest)
+				return
+			}
 		}
 
-		loginResp, err := appCtx.API.Login(loginParam)
+		reservations, err := store.GetAllPendingReservations(context.Background())
 		if err != nil {
-			switch err {
-			case api.ErrLoginWrong:
-				sendJSONResponse(w, LoginResponse{Error: "Incorrect email or password"}, http.StatusUnauthorized)
-			case api.ErrNetwork:
-				sendJSONResponse(w, LoginResponse{Error: "Network error. Please try again later."}, http.StatusInternalServerError)
-			case api.ErrNoPayInfo:
-				sendJSONResponse(w, LoginResponse{Error: "No payment information found. Please update your account."}, http.StatusBadRequest)
-			case api.ErrImperva:
-				sendJSONResponse(w, LoginResponse{Error: "Imperva challenge: please refresh cookies via /admin/cookies/import"}, http.StatusServiceUnavailable)
-			default:
-				sendJSONResponse(w, LoginResponse{Error: "An unexpected error occurred."}, http.StatusInternalServerError)
+			sendJSONResponse(w, AdminReservationsResponse{Error: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+
+		resp := AdminReservationsResponse{Reservations: make([]store.ScheduledReservation, 0, len(reservations))}
+		for _, res := range reservations {
+			if venueID != 0 && res.VenueID != venueID {
+				continue
 			}
+			listed := *res
+			listed.AuthToken = ""
+			listed.AuthTokens = nil
+			listed.EncryptedCredentials = ""
+			resp.Reservations = append(resp.Reservations, listed)
+		}
+		sendJSONResponse(w, resp, http.StatusOK)
+	})
+
+	// Dump all pending reservations for backup or migration
+	handleRoute("/admin/reservations/export", "GET", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		value := map[string]string{
-			"auth_token":        loginResp.AuthToken,
-			"payment_method_id": strconv.FormatInt(loginResp.PaymentMethodID, 10),
+		if !validateAdminToken(r, cfg) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
 		}
-		encoded, err := s.Encode("session", value)
+
+		reservations, err := store.GetAllPendingReservations(context.Background())
 		if err != nil {
-			sendJSONResponse(w, LoginResponse{Error: "Failed to set session"}, http.StatusInternalServerError)
+			sendJSONResponse(w, map[string]string{"error": err.Error()}, http.StatusInternalServerError)
 			return
 		}
 
-		cookie := &http.Cookie{
-			Name:     "session",
-			Value:    encoded,
-			Path:     "/",
-			HttpOnly: true,
-			Secure:   true,
+		export := ReservationExport{
+			ExportedAt:   time.Now().UTC(),
+			Reservations: make([]ExportedReservation, 0, len(reservations)),
+		}
+		for _, res := range reservations {
+			exported, err := exportReservation(res)
+			if err != nil {
+				sendJSONResponse(w, map[string]string{"error": "Failed to encrypt reservation " + res.ID + ": " + err.Error()}, http.StatusInternalServerError)
+				return
+			}
+			export.Reservations = append(export.Reservations, exported)
 		}
-		http.SetCookie(w, cookie)
 
-		sendJSONResponse(w, LoginResponse{
-			AuthToken: loginResp.AuthToken,
-		}, http.StatusOK)
+		appendLog("Exported " + strconv.Itoa(len(export.Reservations)) + " pending reservations")
+		sendJSONResponse(w, export, http.StatusOK)
 	})
 
-	// Reserve API endpoint
-	http.HandleFunc("/api/reserve", func(w http.ResponseWriter, r *http.Request) {
-		if r.Method != http.MethodPost {
+	// Stream finished reservation attempts as CSV, oldest first
+	handleRoute("/admin/reservations/history.csv", "GET", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		var reserveReq ReserveRequest
-		if err := json.NewDecoder(r.Body).Decode(&reserveReq); err != nil {
-			sendJSONResponse(w, ReserveResponse{Error: "Invalid request format"}, http.StatusBadRequest)
+		if !validateAdminToken(r, cfg) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
 			return
 		}
 
-		session, err := getSession(r)
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="reservation-history.csv"`)
+		out := csv.NewWriter(w)
+		out.Write([]string{"reservation_id", "venue_id", "reservation_date", "reservation_time", "party_size", "status", "finished_at", "resy_reservation_id", "error"})
+
+		// Rows are written as each page is read; once they start, a failure can only cut the file short
+		err := store.ScanReservationHistory(r.Context(), func(outcome store.ReservationOutcome) error {
+			reservationTime := outcome.ReservationTime.In(nycLocation)
+			out.Write([]string{
+				outcome.ReservationID,
+				strconv.FormatInt(outcome.VenueID, 10),
+				reservationTime.Format("2006-01-02"),
+				reservationTime.Format("15:04"),
+				strconv.Itoa(outcome.PartySize),
+				outcome.Status,
+				formatRFC3339(outcome.FinishedAt),
+				outcome.ResyReservationID,
+				outcome.Error,
+			})
+			return out.Error()
+		})
+		out.Flush()
 		if err != nil {
-			sendJSONResponse(w, ReserveResponse{Error: "Unauthorized. Please log in."}, http.StatusUnauthorized)
+			appendLog("Reservation history export stopped early: " + err.Error())
+		}
+	})
+
+	// Restore reservations from an export, re-adding them to the pending queue
+	handleRoute("/admin/reservations/import", "POST", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		authToken, ok := session["auth_token"]
+		if !validateAdminToken(r, cfg) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var export ReservationExport
+		if err := json.NewDecoder(r.Body).Decode(&export); err != nil {
+			sendJSONResponse(w, map[string]string{"error": "Invalid request format"}, http.StatusBadRequest)
+			return
+		}
+
+		ctx := context.Background()
+		var resp ReservationImportResponse
+		for _, exported := range export.Reservations {
+			res, err := importReservation(exported)
+			if err == nil {
+				err = store.SaveReservation(ctx, res)
+			}
+			if err != nil {
+				resp.Skipped++
+				resp.Errors = append(resp.Errors, exported.ID+": "+err.Error())
+				continue
+			}
+			resp.Imported++
+		}
+
+		appendLog("Imported " + strconv.Itoa(resp.Imported) + " reservations, skipped " + strconv.Itoa(resp.Skipped))
+		sendJSONResponse(w, resp, http.StatusOK)
+	})
+
+	registerFaultRoutes(cfg)
+
+	// Dry-run booking to check a venue is bookable end to end without reserving
+	handleRoute("/admin/test-reserve", "POST", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if !validateAdminToken(r, cfg) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		var req TestReserveRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSONResponse(w, TestReserveResponse{Error: "Invalid request format"}, http.StatusBadRequest)
+			return
+		}
+
+		if req.VenueID == 0 || req.PartySize <= 0 {
+			sendJSONResponse(w, TestReserveResponse{Error: "venue_id and party_size are required"}, http.StatusBadRequest)
+			return
+		}
+
+		reservationTime, err := parseTimeNYC(req.ReservationTime)
+		if err != nil {
+			sendJSONResponse(w, TestReserveResponse{Error: "Invalid reservation time format. Use YYYY-MM-DDTHH:MM or RFC3339"}, http.StatusBadRequest)
+			return
+		}
+
+		authToken := req.AuthToken
+		var authTokens map[string]string
+		if authToken == "" {
+			if req.Email == "" || req.Password == "" {
+				sendJSONResponse(w, TestReserveResponse{Error: "auth_token or email and password are required"}, http.StatusBadRequest)
+				return
+			}
+			loginResp, err := appCtx.API.Login(api.LoginParam{Email: req.Email, Password: req.Password})
+			if err != nil {
+				sendJSONResponse(w, TestReserveResponse{Error: "Login failed: " + err.Error()}, http.StatusBadRequest)
+				return
+			}
+			authToken = loginResp.AuthToken
+			authTokens = loginResp.AuthTokens
+		}
+
+		resp := TestReserveResponse{
+			VenueID:         req.VenueID,
+			ReservationTime: formatResponseTime(reservationTime),
+			ReservationAt:   formatRFC3339(reservationTime),
+			PartySize:       req.PartySize,
+			CookieStatus:    "missing",
+		}
+
+		ctx := context.Background()
+		if exists, _ := store.CookieExists(ctx, req.VenueID); exists {
+			ttl, _ := store.GetCookieTTL(ctx, req.VenueID)
+			resp.CookieStatus = "valid (TTL: " + ttl.String() + ")"
+		}
+
+		var tableTypes []api.TableType
+		for _, pref := range req.TablePreferences {
+			tableTypes = append(tableTypes, api.TableType(pref))
+		}
+
+		appendLog("Running test reservation for venue " + strconv.FormatInt(req.VenueID, 10))
+		start := time.Now()
+		reserveResp, err := appCtx.API.Reserve(api.ReserveParam{
+			VenueID:          req.VenueID,
+			ReservationTimes: []time.Time{reservationTime},
+			PartySize:        req.PartySize,
+			TableTypes:       tableTypes,
+			AllowClosest:     req.AllowClosest,
+			LoginResp:        api.LoginResponse{AuthToken: authToken, AuthTokens: authTokens},
+			DryRun:           true,
+		})
+		resp.Duration = time.Since(start).Round(time.Millisecond).String()
+
+		if err != nil {
+			resp.Error = err.Error()
+			resp.AvailableSlots = availableSlotsFromError(err)
+			resp.NotifyAvailable = notifyAvailableFromError(err)
+			appendLog("Test reservation for venue " + strconv.FormatInt(req.VenueID, 10) + " failed: " + err.Error())
+		} else {
+			resp.Bookable = true
+			resp.MatchedSlot = formatResponseTime(reserveResp.ReservationTime)
+			resp.MatchedSlotAt = formatRFC3339(reserveResp.ReservationTime)
+			appendLog("Test reservation for venue " + strconv.FormatInt(req.VenueID, 10) + " matched slot " + resp.MatchedSlot)
+		}
+
+		sendJSONResponse(w, resp, http.StatusOK)
+	})
+
+	// Search API endpoint
+	handleRoute("/api/search", "POST", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var searchRequest struct {
+			Name  string `json:"name"`
+			Limit int    `json:"limit"`
+		}
+
+		if err := json.NewDecoder(r.Body).Decode(&searchRequest); err != nil {
+			sendJSONResponse(w, SearchResponse{Error: "Invalid request format"}, http.StatusBadRequest)
+			return
+		}
+
+		searchParam := api.SearchParam{
+			Name:  searchRequest.Name,
+			Limit: searchRequest.Limit,
+		}
+
+		results, err := appCtx.API.Search(searchParam)
+		if err != nil {
+			sendJSONResponse(w, SearchResponse{Error: err.Error()}, http.StatusInternalServerError)
+			return
+		}
+
+		if results.Skipped > 0 {
+			appendLog("Search for \"" + searchParam.Name + "\" skipped " + strconv.Itoa(results.Skipped) + " unreadable results")
+		}
+		sendJSONResponse(w, SearchResponse{
+			Results:  results.Results,
+			Skipped:  results.Skipped,
+			Warnings: results.Warnings,
+		}, http.StatusOK)
+	})
+
+	// Select Venue API endpoint
+	handleRoute("/api/select-venue", "POST", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var selectReq SelectVenueRequest
+		if err := json.NewDecoder(r.Body).Decode(&selectReq); err != nil {
+			sendJSONResponse(w, SelectVenueResponse{Error: "Invalid request format"}, http.StatusBadRequest)
+			return
+		}
+
+		session, err := getSession(r)
+		if err != nil {
+			session = make(map[string]string)
+		}
+
+		session["venue_id"] = strconv.FormatInt(selectReq.VenueID, 10)
+
+		encoded, err := securecookie.EncodeMulti("session", session, sessionCodecs...)
+		if err != nil {
+			sendJSONResponse(w, SelectVenueResponse{Error: "Failed to encode session"}, http.StatusInternalServerError)
+			return
+		}
+
+		cookie := &http.Cookie{
+			Name:     "session",
+			Value:    encoded,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   true,
+		}
+		http.SetCookie(w, cookie)
+
+		sendJSONResponse(w, SelectVenueResponse{Message: "Venue selected successfully"}, http.StatusOK)
+	})
+
+	// Login API endpoint
+	handleRoute("/api/login", "POST", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var loginReq LoginRequest
+		if err := json.NewDecoder(r.Body).Decode(&loginReq); err != nil {
+			sendJSONResponse(w, LoginResponse{Error: "Invalid request format"}, http.StatusBadRequest)
+			return
+		}
+
+		loginParam := api.LoginParam{
+			Email:    loginReq.Email,
+			Password: loginReq.Password,
+		}
+
+		loginResp, err := appCtx.API.Login(loginParam)
+		if err != nil {
+			switch {
+			case errors.Is(err, api.ErrTimeout):
+				sendJSONResponse(w, LoginResponse{Error: "Resy took too long to respond. Please try again."}, http.StatusGatewayTimeout)
+			case errors.Is(err, syscall.ECONNREFUSED):
+				sendJSONResponse(w, LoginResponse{Error: "Could not connect to Resy (connection refused); it may be down. Please try again later."}, http.StatusBadGateway)
+			case errors.Is(err, api.ErrServiceUnavailable):
+				sendJSONResponse(w, LoginResponse{Error: "Resy is temporarily unavailable, possibly for maintenance. Please try again later."}, http.StatusServiceUnavailable)
+			case errors.Is(err, api.ErrLoginWrong):
+				sendJSONResponse(w, LoginResponse{Error: "Incorrect email or password"}, http.StatusUnauthorized)
+			case errors.Is(err, api.ErrNetwork):
+				sendJSONResponse(w, LoginResponse{Error: "Network error. Please try again later."}, http.StatusInternalServerError)
+			case errors.Is(err, api.ErrNoPayInfo):
+				sendJSONResponse(w, LoginResponse{Error: "No payment information found. Please update your account."}, http.StatusBadRequest)
+			case errors.Is(err, api.ErrImperva):
+				sendJSONResponse(w, LoginResponse{Error: "Imperva challenge: please refresh cookies via /admin/cookies/import"}, http.StatusServiceUnavailable)
+			default:
+				sendJSONResponse(w, LoginResponse{Error: "An unexpected error occurred."}, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		value := map[string]string{
+			"auth_token":        loginResp.AuthToken,
+			"payment_method_id": strconv.FormatInt(loginResp.PaymentMethodID, 10),
+		}
+		if len(loginResp.AuthTokens) > 0 {
+			if authTokens, err := json.Marshal(loginResp.AuthTokens); err == nil {
+				value["auth_tokens"] = string(authTokens)
+			}
+		}
+		encoded, err := securecookie.EncodeMulti("session", value, sessionCodecs...)
+		if err != nil {
+			sendJSONResponse(w, LoginResponse{Error: "Failed to set session"}, http.StatusInternalServerError)
+			return
+		}
+
+		cookie := &http.Cookie{
+			Name:     "session",
+			Value:    encoded,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   true,
+		}
+		http.SetCookie(w, cookie)
+
+		sendJSONResponse(w, LoginResponse{
+			AuthToken: loginResp.AuthToken,
+		}, http.StatusOK)
+	})
+
+	// Reserve API endpoint
+	handleRoute("/api/reserve", "POST", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var reserveReq ReserveRequest
+		if err := json.NewDecoder(r.Body).Decode(&reserveReq); err != nil {
+			sendJSONResponse(w, ReserveResponse{Error: "Invalid request format"}, http.StatusBadRequest)
+			return
+		}
+
+		session, err := getSession(r)
+		if errors.Is(err, errSessionExpired) {
+			clearSessionCookie(w)
+			sendJSONResponse(w, ReserveResponse{Error: "Your session has expired. Please log in again."}, http.StatusUnauthorized)
+			return
+		} else if err != nil {
+			sendJSONResponse(w, ReserveResponse{Error: "Unauthorized. Please log in."}, http.StatusUnauthorized)
+			return
+		}
+
+		authToken, ok := session["auth_token"]
 		if !ok || authToken == "" {
 			sendJSONResponse(w, ReserveResponse{Error: "Authentication token missing. Please log in."}, http.StatusUnauthorized)
 			return
@@ -481,70 +1244,230 @@ func main() {
 			}
 		}
 
-		// Parse the reservation time (NYC timezone, converted to UTC)
-		reservationTime, err := parseTimeNYC(reserveReq.ReservationTime)
+		if !cfg.VenueAllowed(venueID) {
+			appendLog("Rejected reservation for venue " + strconv.FormatInt(venueID, 10) + ": not in the venue allowlist")
+			sendJSONResponse(w, ReserveResponse{Error: "Bookings are not allowed for this venue"}, http.StatusForbidden)
+			return
+		}
+
+		// Parse the reservation times (NYC timezone, converted to UTC), most preferred first
+		reservationTimes, err := parseReservationTimes(reserveReq)
 		if err != nil {
-			sendJSONResponse(w, ReserveResponse{Error: "Invalid reservation time format. Use YYYY-MM-DDTHH:MM"}, http.StatusBadRequest)
+			sendJSONResponse(w, ReserveResponse{Error: err.Error()}, http.StatusBadRequest)
 			return
 		}
+		reservationTime := reservationTimes[0]
 
 		var requestTime time.Time
-		if !reserveReq.IsImmediate {
-			requestTime, err = parseTimeNYC(reserveReq.RequestTime)
+		if reserveReq.Watch != nil && !reserveReq.IsImmediate && reserveReq.RequestTime == "" && reserveReq.DropAt == "" && reserveReq.DropDaysBefore == nil {
+			// A watch without a start time starts polling right away
+			requestTime = time.Now().UTC()
+		} else if !reserveReq.IsImmediate {
+			requestTime, err = resolveRequestTime(reserveReq, reservationTime, cfg.DropLead)
 			if err != nil {
-				sendJSONResponse(w, ReserveResponse{Error: "Invalid request time format. Use YYYY-MM-DDTHH:MM"}, http.StatusBadRequest)
+				sendJSONResponse(w, ReserveResponse{Error: err.Error()}, http.StatusBadRequest)
+				return
+			}
+		}
+
+		if reserveReq.Recurrence != nil {
+			if reserveReq.IsImmediate {
+				sendJSONResponse(w, ReserveResponse{Error: "recurrence is only supported for scheduled reservations"}, http.StatusBadRequest)
+				return
+			}
+			if err := reserveReq.Recurrence.Validate(); err != nil {
+				sendJSONResponse(w, ReserveResponse{Error: "Invalid recurrence: " + err.Error()}, http.StatusBadRequest)
+				return
+			}
+		}
+
+		if (reserveReq.ResyEmail == "") != (reserveReq.ResyPassword == "") {
+			sendJSONResponse(w, ReserveResponse{Error: "resy_email and resy_password must be given together"}, http.StatusBadRequest)
+			return
+		}
+
+		// Config tokens come from a find response and don't outlive it for long
+		if reserveReq.ConfigToken != "" && !reserveReq.IsImmediate {
+			sendJSONResponse(w, ReserveResponse{Error: "config_token is only supported for immediate reservations"}, http.StatusBadRequest)
+			return
+		}
+		if reserveReq.ListMatches && (!reserveReq.IsImmediate || reserveReq.ConfigToken != "") {
+			sendJSONResponse(w, ReserveResponse{Error: "list_matches is only supported for immediate reservations without a config_token"}, http.StatusBadRequest)
+			return
+		}
+
+		if len(reserveReq.PartySizes) > 0 {
+			if reserveReq.ConfigToken != "" || reserveReq.FindPartySize > 0 {
+				sendJSONResponse(w, ReserveResponse{Error: "party_sizes can't be combined with config_token or find_party_size"}, http.StatusBadRequest)
+				return
+			}
+			for _, size := range reserveReq.PartySizes {
+				if size <= 0 {
+					sendJSONResponse(w, ReserveResponse{Error: "party_sizes must all be positive"}, http.StatusBadRequest)
+					return
+				}
+			}
+		}
+
+		if reserveReq.DropBudget != nil {
+			if reserveReq.IsImmediate {
+				sendJSONResponse(w, ReserveResponse{Error: "drop_budget is only supported for scheduled reservations"}, http.StatusBadRequest)
+				return
+			}
+			if _, err := reserveReq.DropBudget.Validate(); err != nil {
+				sendJSONResponse(w, ReserveResponse{Error: "Invalid drop_budget: " + err.Error()}, http.StatusBadRequest)
 				return
 			}
 		}
 
+		var watch *store.Watch
+		if reserveReq.Watch != nil {
+			if reserveReq.IsImmediate || reserveReq.Recurrence != nil {
+				sendJSONResponse(w, ReserveResponse{Error: "watch is only supported for scheduled reservations without a recurrence"}, http.StatusBadRequest)
+				return
+			}
+			watch, err = resolveWatch(cfg, *reserveReq.Watch, reservationTime, requestTime)
+			if err != nil {
+				sendJSONResponse(w, ReserveResponse{Error: "Invalid watch: " + err.Error()}, http.StatusBadRequest)
+				return
+			}
+		}
+
+		if len(reserveReq.FallbackDates) > 0 {
+			if reserveReq.IsImmediate {
+				sendJSONResponse(w, ReserveResponse{Error: "fallback_dates is only supported for scheduled reservations"}, http.StatusBadRequest)
+				return
+			}
+			if err := validateFallbackDates(reserveReq.FallbackDates); err != nil {
+				sendJSONResponse(w, ReserveResponse{Error: err.Error()}, http.StatusBadRequest)
+				return
+			}
+		}
+
+		note := strings.TrimSpace(reserveReq.Note)
+		if err := validateNoteAndLabels(note, reserveReq.Labels); err != nil {
+			sendJSONResponse(w, ReserveResponse{Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+		notifyEmail := strings.TrimSpace(reserveReq.NotifyEmail)
+		if notifyEmail != "" {
+			if reserveReq.IsImmediate {
+				sendJSONResponse(w, ReserveResponse{Error: "notify_email is only supported for scheduled reservations"}, http.StatusBadRequest)
+				return
+			}
+			if addr, err := mail.ParseAddress(notifyEmail); err != nil || addr.Address != notifyEmail {
+				sendJSONResponse(w, ReserveResponse{Error: "notify_email must be a plain email address"}, http.StatusBadRequest)
+				return
+			}
+		}
+		// A time window of 0 asks for the exact time; any other turns on closest matching
+		var maxTimeWindow time.Duration
+		if minutes := reserveReq.MaxTimeWindow; minutes != nil {
+			switch {
+			case *minutes < 0:
+				sendJSONResponse(w, ReserveResponse{Error: "max_time_window_minutes must not be negative"}, http.StatusBadRequest)
+				return
+			case *minutes == 0 && reserveReq.AllowClosest:
+				sendJSONResponse(w, ReserveResponse{Error: "max_time_window_minutes of 0 books the exact time only and can't be combined with allow_closest"}, http.StatusBadRequest)
+				return
+			case *minutes > 0:
+				reserveReq.AllowClosest = true
+				maxTimeWindow = time.Duration(*minutes) * time.Minute
+			}
+		}
+
+		earliestTime, latestTime, err := parseTimeWindow(reserveReq.EarliestTime, reserveReq.LatestTime, reservationTime)
+		if err != nil {
+			sendJSONResponse(w, ReserveResponse{Error: err.Error()}, http.StatusBadRequest)
+			return
+		}
+
 		// Convert table preferences
 		var tableTypes []api.TableType
 		for _, pref := range reserveReq.TablePreferences {
 			tableTypes = append(tableTypes, api.TableType(pref))
 		}
 
-		if reserveReq.IsImmediate {
-			// Attempt reservation now
-			reserveParam := api.ReserveParam{
-				VenueID:          venueID,
-				ReservationTimes: []time.Time{reservationTime},
-				PartySize:        reserveReq.PartySize,
-				LoginResp:        api.LoginResponse{AuthToken: authToken, PaymentMethodID: paymentMethodID},
-				TableTypes:       tableTypes,
-			}
+		reserveParam := api.ReserveParam{
+			VenueID:          venueID,
+			ReservationTimes: reservationTimes,
+			PartySize:        reserveReq.PartySize,
+			LoginResp:        api.LoginResponse{AuthToken: authToken, AuthTokens: sessionAuthTokens(session), PaymentMethodID: paymentMethodID},
+			TableTypes:       tableTypes,
+			TableFlexibility: toTableFlexibility(reserveReq.TableFlexibility),
+			AllowClosest:     reserveReq.AllowClosest,
+			MaxTimeWindow:    maxTimeWindow,
+			FindPartySize:    reserveReq.FindPartySize,
+			ConfigToken:      reserveReq.ConfigToken,
+			ListMatches:      reserveReq.ListMatches,
+			PartySizes:       reserveReq.PartySizes,
+			EarliestTime:     earliestTime,
+			LatestTime:       latestTime,
+		}
 
+		if reserveReq.ListMatches {
+			// Read-only: report the choices, book nothing
+			appendLog("Listing matching slots for venue " + strconv.FormatInt(venueID, 10))
+			listResp, err := appCtx.API.Reserve(reserveParam)
+			if err != nil {
+				sendReserveError(w, err)
+				return
+			}
+			sendJSONResponse(w, ReserveResponse{Matches: toAvailableSlots(listResp.Matches)}, http.StatusOK)
+		} else if reserveReq.IsImmediate {
+			// Attempt reservation now
 			appendLog("Attempting immediate reservation for venue " + strconv.FormatInt(venueID, 10))
 			appendLog("Reservation details: party_size=" + strconv.Itoa(reserveReq.PartySize) + ", time=" + reservationTime.Format("2006-01-02 15:04"))
 			if paymentMethodID == 0 {
 				appendLog("Warning: No payment method ID found in session - booking step may fail")
 			}
 			reserveResp, err := appCtx.API.Reserve(reserveParam)
+			recordBookingAttempt(venueID, err)
 			if err != nil {
 				appendLog("Immediate reservation failed: " + err.Error())
-
-				// Check for specific error types using errors.Is/As
-				var netErr *api.NetworkError
-				if errors.As(err, &netErr) {
-					appendLog("Network error details - Step: " + netErr.Step + ", Status: " + strconv.Itoa(netErr.Status) + ", Message: " + netErr.Message)
-					sendJSONResponse(w, ReserveResponse{Error: "Network error at " + netErr.Step + " step: " + netErr.Message}, http.StatusInternalServerError)
-				} else if errors.Is(err, api.ErrNetwork) {
-					sendJSONResponse(w, ReserveResponse{Error: "Network error. Please try again later."}, http.StatusInternalServerError)
-				} else if errors.Is(err, api.ErrNoTable) {
-					sendJSONResponse(w, ReserveResponse{Error: "No available tables found for the selected time."}, http.StatusBadRequest)
-				} else if errors.Is(err, api.ErrImperva) {
-					sendJSONResponse(w, ReserveResponse{Error: "Imperva challenge: please refresh cookies via /admin/cookies/import"}, http.StatusServiceUnavailable)
-				} else if errors.Is(err, api.ErrNoOffer) {
-					sendJSONResponse(w, ReserveResponse{Error: "No reservations available for this date."}, http.StatusBadRequest)
-				} else {
-					sendJSONResponse(w, ReserveResponse{Error: "An unexpected error occurred: " + err.Error()}, http.StatusInternalServerError)
-				}
+				sendReserveError(w, err)
 				return
 			}
 
 			appendLog("Immediate reservation successful")
+			warning := bookingMismatch(reserveResp, reserveParam.PartySize, reservationTime)
+			if warning != "" {
+				appendLog("Warning: immediate reservation " + warning)
+			}
 			sendJSONResponse(w, ReserveResponse{
-				ReservationTime: reserveResp.ReservationTime.In(nycLocation).Format("2006-01-02 3:04 PM EST"),
+				ReservationTime: formatResponseTime(reserveResp.ReservationTime),
+				ReservationAt:   formatRFC3339(reserveResp.ReservationTime),
+				PartySize:       reserveResp.ConfirmedPartySize,
+				BookedPartySize: reserveResp.BookedPartySize,
+				VenueMismatch:   reserveResp.VenueMismatch,
+				BookedVenueID:   reserveResp.BookedVenueID,
+				Date:            reserveResp.ConfirmedDate,
+				ResyID:          reserveResp.ReservationID,
+				ResyToken:       reserveResp.ResyToken,
+				Warning:         warning,
 			}, http.StatusOK)
+		} else if reserveReq.ValidateOnly || r.URL.Query().Get("validate_only") == "true" {
+			// Validate the scheduled reservation with a dry-run find, without saving it
+			appendLog("Validating scheduled reservation for venue " + strconv.FormatInt(venueID, 10))
+			reserveParam.DryRun = true
+
+			resp := ReserveResponse{ValidateOnly: true}
+			dryResp, err := appCtx.API.Reserve(reserveParam)
+			switch {
+			case err == nil:
+				resp.ReservationTime = formatResponseTime(dryResp.ReservationTime)
+				resp.ReservationAt = formatRFC3339(dryResp.ReservationTime)
+				resp.Message = "Valid. A matching slot is open now and would be booked if still available at " + formatResponseTime(requestTime)
+			case errors.Is(err, api.ErrNoTable), errors.Is(err, api.ErrNoOffer):
+				resp.Message = "Valid. No matching slot is open yet; booking would be attempted at " + formatResponseTime(requestTime)
+			default:
+				appendLog("Scheduled reservation validation failed: " + err.Error())
+				sendReserveError(w, err)
+				return
+			}
+
+			appendLog("Scheduled reservation for venue " + strconv.FormatInt(venueID, 10) + " validated, not saved")
+			sendJSONResponse(w, resp, http.StatusOK)
 		} else {
 			// Schedule for later - save to Redis
 			ctx := context.Background()
@@ -556,31 +1479,382 @@ func main() {
 				ReservationTime:  reservationTime,
 				PartySize:        reserveReq.PartySize,
 				TablePreferences: reserveReq.TablePreferences,
+				TableFlexibility: reserveReq.TableFlexibility,
+				AllowClosest:     reserveReq.AllowClosest,
+				MaxTimeWindow:    int(maxTimeWindow / time.Minute),
+				Recurrence:       reserveReq.Recurrence,
+				FallbackDates:    reserveReq.FallbackDates,
+				FindPartySize:    reserveReq.FindPartySize,
+				PartySizes:       reserveReq.PartySizes,
+				Note:             note,
+				Labels:           reserveReq.Labels,
+				Priority:         reserveReq.Priority,
+				DropBudget:       reserveReq.DropBudget,
+				Watch:            watch,
+				NotifyEmail:      notifyEmail,
+				EarliestTime:     earliestTime,
+				LatestTime:       latestTime,
 				AuthToken:        authToken,
+				AuthTokens:       reserveParam.LoginResp.AuthTokens,
 				RunTime:          requestTime,
 				CreatedAt:        time.Now().UTC(),
 			}
+			if len(reservationTimes) > 1 {
+				scheduledRes.ReservationTimes = reservationTimes
+			}
+			if reserveReq.ResyEmail != "" {
+				scheduledRes.EncryptedCredentials, err = encryptCredentials(reserveReq.ResyEmail, reserveReq.ResyPassword)
+				if err != nil {
+					sendJSONResponse(w, ReserveResponse{Error: "Failed to encrypt credentials: " + err.Error()}, http.StatusInternalServerError)
+					return
+				}
+			}
+
+			if err := store.SaveReservation(ctx, scheduledRes); err != nil {
+				appendLog("Failed to schedule reservation: " + err.Error())
+				sendJSONResponse(w, ReserveResponse{Error: "Failed to schedule reservation: " + err.Error()}, http.StatusInternalServerError)
+				return
+			}
+
+			if watch != nil {
+				appendLog("Watching for reservation " + resID + describeTags(scheduledRes) + " every " + watch.PollInterval + " from " +
+					requestTime.In(nycLocation).Format("2006-01-02 3:04 PM EST") + " until " + watch.Until.In(nycLocation).Format("2006-01-02 3:04 PM EST"))
+			} else {
+				appendLog("Scheduled reservation " + resID + describeTags(scheduledRes) + " for: " + requestTime.In(nycLocation).Format("2006-01-02 3:04 PM EST"))
+			}
+			resp := ReserveResponse{ReservationID: resID}
+			if reserveReq.Preview {
+				resp.Preview = previewReservation(appCtx, reserveParam, requestTime)
+			}
+			sendJSONResponse(w, resp, http.StatusOK)
+		}
+	})
+
+	// List the session user's pending reservations, soonest to run first. The
+	// pending set is scanned and filtered by auth token rather than kept in a
+	// per-token index: it is small, and an index would have to follow every
+	// save, delete, expiry and token change to stay correct.
+	handleRoute("/api/reservations", "GET", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		session, err := getSession(r)
+		if errors.Is(err, errSessionExpired) {
+			clearSessionCookie(w)
+			sendJSONResponse(w, ReservationsResponse{Error: "Your session has expired. Please log in again."}, http.StatusUnauthorized)
+			return
+		} else if err != nil || session["auth_token"] == "" {
+			sendJSONResponse(w, ReservationsResponse{Error: "Unauthorized. Please log in."}, http.StatusUnauthorized)
+			return
+		}
+
+		reservations, err := store.GetAllPendingReservations(context.Background())
+		if err != nil {
+			sendJSONResponse(w, ReservationsResponse{Error: "Failed to load reservations: " + err.Error()}, http.StatusInternalServerError)
+			return
+		}
+
+		resp := ReservationsResponse{Reservations: make([]store.ScheduledReservation, 0)}
+		for _, res := range reservations {
+			if !ownsReservation(session, res) {
+				continue
+			}
+			listed := *res
+			listed.AuthToken = ""
+			listed.AuthTokens = nil
+			listed.EncryptedCredentials = ""
+			resp.Reservations = append(resp.Reservations, listed)
+		}
+		sendJSONResponse(w, resp, http.StatusOK)
+	})
+
+	// Dry-run find and match for one date, time and party size:
+	// GET /api/venue/{id}/bookable?date=&time=&party_size=&table_type=&flex=
+	handleRoute("/api/venue/", "GET", func(w http.ResponseWriter, r *http.Request) {
+		venueIDStr, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/venue/"), "/")
+		if action != "bookable" {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		session, err := getSession(r)
+		if errors.Is(err, errSessionExpired) {
+			clearSessionCookie(w)
+			sendJSONResponse(w, BookableResponse{Error: "Your session has expired. Please log in again."}, http.StatusUnauthorized)
+			return
+		} else if err != nil || session["auth_token"] == "" {
+			sendJSONResponse(w, BookableResponse{Error: "Unauthorized. Please log in."}, http.StatusUnauthorized)
+			return
+		}
+
+		venueID, err := strconv.ParseInt(venueIDStr, 10, 64)
+		if err != nil || venueID <= 0 {
+			sendJSONResponse(w, BookableResponse{Error: "Invalid Venue ID"}, http.StatusBadRequest)
+			return
+		}
+
+		query := r.URL.Query()
+		reservationTime, err := parseTimeNYC(query.Get("date") + "T" + query.Get("time"))
+		if err != nil {
+			sendJSONResponse(w, BookableResponse{Error: "date and time are required, as YYYY-MM-DD and HH:MM"}, http.StatusBadRequest)
+			return
+		}
+		partySize, err := strconv.Atoi(query.Get("party_size"))
+		if err != nil || partySize <= 0 {
+			sendJSONResponse(w, BookableResponse{Error: "party_size must be a positive number"}, http.StatusBadRequest)
+			return
+		}
+		flexMinutes := 0
+		if flex := query.Get("flex"); flex != "" {
+			flexMinutes, err = strconv.Atoi(flex)
+			if err != nil || flexMinutes < 0 {
+				sendJSONResponse(w, BookableResponse{Error: "flex must be a number of minutes, 0 or more"}, http.StatusBadRequest)
+				return
+			}
+		}
+
+		param := api.ReserveParam{
+			VenueID:          venueID,
+			ReservationTimes: []time.Time{reservationTime},
+			PartySize:        partySize,
+			LoginResp:        api.LoginResponse{AuthToken: session["auth_token"], AuthTokens: sessionAuthTokens(session)},
+			DryRun:           true,
+		}
+		// The tolerance applies to the requested table type, or to any table when none is given
+		tableType := query.Get("table_type")
+		if tableType != "" {
+			param.TableTypes = []api.TableType{api.TableType(tableType)}
+			param.TableFlexibility = toTableFlexibility(map[string]int{tableType: flexMinutes})
+		} else if flexMinutes > 0 {
+			param.AllowClosest = true
+			param.MaxTimeWindow = time.Duration(flexMinutes) * time.Minute
+		}
+
+		resp := BookableResponse{VenueID: venueID, TableType: tableType, FlexMinutes: flexMinutes}
+		reserveResp, err := appCtx.API.Reserve(param)
+		if err != nil {
+			// Nothing matching is a normal answer; anything else means we couldn't tell
+			if !errors.Is(err, api.ErrNoTable) && !errors.Is(err, api.ErrNoOffer) {
+				resp.Error = err.Error()
+				sendJSONResponse(w, resp, http.StatusBadGateway)
+				return
+			}
+			resp.Reason = err.Error()
+		} else {
+			resp.Bookable = true
+			resp.MatchedSlot = formatResponseTime(reserveResp.ReservationTime)
+			resp.MatchedSlotAt = formatRFC3339(reserveResp.ReservationTime)
+		}
+		sendJSONResponse(w, resp, http.StatusOK)
+	})
+
+	// Session-owned actions on a scheduled reservation: DELETE /api/reservations/{id}
+	// and POST /api/reservations/{id}/run-now
+	handleRoute("/api/reservations/", "GET,POST,DELETE", func(w http.ResponseWriter, r *http.Request) {
+		resID, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/reservations/"), "/")
+		if resID == "" || (action != "" && action != "run-now" && action != "log") {
+			http.NotFound(w, r)
+			return
+		}
+
+		// GET /api/reservations/{id}/log returns what happened during the reservation's booking attempt
+		if action == "log" {
+			if r.Method != http.MethodGet {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			session, err := getSession(r)
+			if errors.Is(err, errSessionExpired) {
+				clearSessionCookie(w)
+				sendJSONResponse(w, AttemptLogResponse{Error: "Your session has expired. Please log in again."}, http.StatusUnauthorized)
+				return
+			} else if err != nil || session["auth_token"] == "" {
+				sendJSONResponse(w, AttemptLogResponse{Error: "Unauthorized. Please log in."}, http.StatusUnauthorized)
+				return
+			}
+
+			// Logs of other users' reservations are reported as missing, like the reservations
+			entries, err := store.GetAttemptLog(context.Background(), resID, session["auth_token"])
+			if errors.Is(err, store.ErrReservationNotFound) {
+				sendJSONResponse(w, AttemptLogResponse{Error: "No attempt log for this reservation"}, http.StatusNotFound)
+				return
+			} else if err != nil {
+				sendJSONResponse(w, AttemptLogResponse{Error: "Failed to load attempt log: " + err.Error()}, http.StatusInternalServerError)
+				return
+			}
+			sendJSONResponse(w, AttemptLogResponse{ReservationID: resID, Entries: entries}, http.StatusOK)
+			return
+		}
+
+		if (action == "" && r.Method != http.MethodDelete) || (action == "run-now" && r.Method != http.MethodPost) {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		session, err := getSession(r)
+		if errors.Is(err, errSessionExpired) {
+			clearSessionCookie(w)
+			sendJSONResponse(w, ReserveResponse{Error: "Your session has expired. Please log in again."}, http.StatusUnauthorized)
+			return
+		} else if err != nil || session["auth_token"] == "" {
+			sendJSONResponse(w, ReserveResponse{Error: "Unauthorized. Please log in."}, http.StatusUnauthorized)
+			return
+		}
+
+		ctx := context.Background()
+		res, err := store.GetReservation(ctx, resID)
+		if errors.Is(err, store.ErrReservationNotFound) || (err == nil && !ownsReservation(session, res)) {
+			// Other users' reservations are reported as missing so IDs can't be probed
+			sendJSONResponse(w, ReserveResponse{Error: "Reservation not found"}, http.StatusNotFound)
+			return
+		} else if err != nil {
+			sendJSONResponse(w, ReserveResponse{Error: "Failed to load reservation: " + err.Error()}, http.StatusInternalServerError)
+			return
+		}
 
-			if err := store.SaveReservation(ctx, scheduledRes); err != nil {
-				appendLog("Failed to schedule reservation: " + err.Error())
-				sendJSONResponse(w, ReserveResponse{Error: "Failed to schedule reservation: " + err.Error()}, http.StatusInternalServerError)
+		if !res.RunTime.After(time.Now()) {
+			sendJSONResponse(w, ReserveResponse{Error: "Reservation is already due and will be attempted shortly"}, http.StatusConflict)
+			return
+		}
+
+		if action == "" {
+			if err := store.DeleteReservation(ctx, res.ID); err != nil {
+				sendJSONResponse(w, ReserveResponse{Error: "Failed to cancel reservation: " + err.Error()}, http.StatusInternalServerError)
 				return
 			}
-
-			appendLog("Scheduled reservation " + resID + " for: " + requestTime.In(nycLocation).Format("2006-01-02 3:04 PM EST"))
+			appendLog("Reservation " + res.ID + " cancelled by its owner")
 			sendJSONResponse(w, ReserveResponse{
-				ReservationID: resID,
+				ReservationID: res.ID,
+				Message:       "Scheduled reservation cancelled",
 			}, http.StatusOK)
+			return
+		}
+
+		if res.Recurrence != nil {
+			// The next occurrence is placed relative to the run time, so moving it would shift the series
+			sendJSONResponse(w, ReserveResponse{Error: "Recurring reservations can't be run early"}, http.StatusConflict)
+			return
+		}
+
+		originalRunTime := res.RunTime
+		res.RunTime = time.Now().UTC()
+		if err := store.SaveReservation(ctx, res); err != nil {
+			sendJSONResponse(w, ReserveResponse{Error: "Failed to update reservation: " + err.Error()}, http.StatusInternalServerError)
+			return
+		}
+
+		appendLog("Reservation " + res.ID + " moved up to run now (was " + originalRunTime.In(nycLocation).Format("2006-01-02 3:04 PM EST") + ")")
+		sendJSONResponse(w, ReserveResponse{
+			ReservationID: res.ID,
+			Message:       "Reservation will be attempted on the scheduler's next cycle",
+		}, http.StatusOK)
+	})
+
+	// Cancel a booking Resy has made, e.g. one a scheduled reservation booked
+	handleRoute("/api/cancel", "POST", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		session, err := getSession(r)
+		if errors.Is(err, errSessionExpired) {
+			clearSessionCookie(w)
+			sendJSONResponse(w, CancelResponse{Error: "Your session has expired. Please log in again."}, http.StatusUnauthorized)
+			return
+		} else if err != nil || session["auth_token"] == "" {
+			sendJSONResponse(w, CancelResponse{Error: "Unauthorized. Please log in."}, http.StatusUnauthorized)
+			return
+		}
+
+		var req CancelRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			sendJSONResponse(w, CancelResponse{Error: "Invalid request format"}, http.StatusBadRequest)
+			return
 		}
+		if strings.TrimSpace(req.ResyToken) == "" {
+			sendJSONResponse(w, CancelResponse{Error: "resy_token is required"}, http.StatusBadRequest)
+			return
+		}
+
+		cancelResp, err := appCtx.API.Cancel(api.CancelParam{
+			ResyToken: req.ResyToken,
+			AuthToken: session["auth_token"],
+		})
+		if err != nil {
+			appendLog("Cancel failed: " + err.Error())
+			switch {
+			case errors.Is(err, api.ErrImperva):
+				sendJSONResponse(w, CancelResponse{Error: "Imperva challenge: please refresh cookies via /admin/cookies/import"}, http.StatusServiceUnavailable)
+			case errors.Is(err, api.ErrTimeout):
+				sendJSONResponse(w, CancelResponse{Error: "Resy took too long to respond. Check your reservations before trying again."}, http.StatusGatewayTimeout)
+			case errors.Is(err, api.ErrNetwork):
+				sendJSONResponse(w, CancelResponse{Error: "Network error. Please try again later."}, http.StatusBadGateway)
+			default:
+				sendJSONResponse(w, CancelResponse{Error: "An unexpected error occurred: " + err.Error()}, http.StatusInternalServerError)
+			}
+			return
+		}
+
+		appendLog("Cancelled booking (refund: " + strconv.FormatBool(cancelResp.Refund) + ")")
+		sendJSONResponse(w, CancelResponse{Refund: cancelResp.Refund}, http.StatusOK)
 	})
 
 	// Logs endpoint
-	http.HandleFunc("/api/logs", func(w http.ResponseWriter, r *http.Request) {
+	handleRoute("/api/logs", "*", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
-		json.NewEncoder(w).Encode(logLines)
+		json.NewEncoder(w).Encode(logLines.Snapshot())
+	})
+
+	// Push each new log line to the client as a server-sent event
+	handleRoute("/api/logs/stream", "GET", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		lines, unsubscribe := logLines.Subscribe()
+		defer unsubscribe()
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		// A comment every so often keeps proxies from closing an idle stream
+		keepAlive := time.NewTicker(logStreamKeepAlive)
+		defer keepAlive.Stop()
+
+		for {
+			select {
+			case <-r.Context().Done():
+				return
+			case line, ok := <-lines:
+				if !ok {
+					return // Server shutting down
+				}
+				// Log lines are single lines, so one data field holds each
+				w.Write([]byte("data: " + strings.ReplaceAll(line, "\n", " ") + "\n\n"))
+			case <-keepAlive.C:
+				w.Write([]byte(": keep-alive\n\n"))
+			}
+			flusher.Flush()
+		}
 	})
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	handleRoute("/", "*", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path != "/" {
 			http.NotFound(w, r)
 			return
@@ -594,7 +1868,7 @@ func main() {
 		}
 	})
 
-	http.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+	handleRoute("/login", "GET", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -606,7 +1880,7 @@ func main() {
 		}
 	})
 
-	http.HandleFunc("/reserve", func(w http.ResponseWriter, r *http.Request) {
+	handleRoute("/reserve", "GET", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
@@ -623,21 +1897,73 @@ func main() {
 		}
 	})
 
+	handleRoute("/reservations", "GET", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		_, err := getSession(r)
+		if err != nil {
+			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			return
+		}
+		data := TemplateData{}
+		if err := tmpl.ExecuteTemplate(w, "reservations.html", data); err != nil {
+			http.Error(w, "Failed to render template", http.StatusInternalServerError)
+			appendLog("Template execution error: " + err.Error())
+		}
+	})
+
 	// Create cancellable context for scheduler
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	// Start the scheduling goroutine (Redis-backed)
-	go handleScheduledReservations(ctx, appCtx)
+	if cfg.RunMode == config.RunModeWeb {
+		appendLog("Running in web-only mode: scheduler and cookie refresh are disabled")
+	} else {
+		// Start the scheduling goroutine (Redis-backed)
+		if cfg.PartitionReservationsByVenue {
+			go handlePartitionedReservations(ctx, newAPI)
+		} else {
+			go handleScheduledReservations(ctx, appCtx)
+		}
+
+		// Start the cookie refresh goroutine (if enabled); the mock API needs no cookies
+		if cfg.CookieRefreshEnabled && !cfg.ResyMock {
+			go handleCookieRefresh(ctx, cfg)
+		}
+
+		// Fetch fresh cookies shortly before each scheduled booking, if configured
+		if cfg.PreDropCookieRefreshLead > 0 && !cfg.ResyMock {
+			go handlePreDropCookieRefresh(ctx, cfg)
+		}
+	}
+
+	// Keep venue pages open between cookie fetches, if configured
+	if cfg.CookieWarmTabs > 0 && !cfg.ResyMock {
+		go imperva.RunWarmTabs(ctx)
+	}
+
+	// Import cookie files dropped on disk, e.g. from a secret mount
+	if cfg.CookieImportDir != "" {
+		go watchCookieFiles(ctx, cfg)
+	}
 
-	// Start the cookie refresh goroutine (if enabled)
-	if cfg.CookieRefreshEnabled {
-		go handleCookieRefresh(ctx, cfg)
+	// Scheduler-only instances expose just the health check
+	var handler http.Handler = http.DefaultServeMux
+	routes := registeredRoutes
+	if cfg.RunMode == config.RunModeScheduler {
+		appendLog("Running in scheduler-only mode: serving /health only")
+		schedulerMux := http.NewServeMux()
+		schedulerMux.HandleFunc("/health", healthHandler)
+		handler = schedulerMux
+		routes = []routeEntry{{Pattern: "/health", Methods: "*"}}
 	}
+	logRoutes(routes)
 
 	// Create server for graceful shutdown
 	port := cfg.Port
-	server := &http.Server{Addr: ":" + port}
+	server := &http.Server{Addr: ":" + port, Handler: gzipJSON(handler, cfg.GzipMinSize)}
 
 	// Handle shutdown signals
 	stop := make(chan os.Signal, 1)
@@ -647,6 +1973,7 @@ func main() {
 		<-stop
 		appendLog("Shutting down gracefully...")
 		cancel() // Stop scheduler
+		logLines.CloseSubscribers()
 
 		shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 30*time.Second)
 		defer shutdownCancel()
@@ -660,6 +1987,8 @@ func main() {
 	if err := server.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatalf("Server error: %v", err)
 	}
+	// Let an in-flight cookie fetch finish briefly, then kill its browser so no Chrome outlives the server
+	imperva.Shutdown(cfg.CookieFetchShutdownGrace)
 	appendLog("Server stopped")
 }
 
@@ -683,51 +2012,566 @@ func handleScheduledReservations(ctx context.Context, appCtx app.AppCtx) {
 				continue
 			}
 
-			now := time.Now().UTC()
+			now := time.Now().UTC()
+
+			if nextRes.RunTime.After(now) {
+				// Sleep until the scheduled time (max 30 seconds to allow for faster shutdown response)
+				sleepDuration := nextRes.RunTime.Sub(now)
+				if sleepDuration > 30*time.Second {
+					sleepDuration = 30 * time.Second
+				}
+				select {
+				case <-ctx.Done():
+					appendLog("Scheduler shutting down")
+					return
+				case <-time.After(sleepDuration):
+				}
+				continue
+			}
+
+			// Hold off while an operator has the scheduler paused
+			if paused, _ := store.IsSchedulerPaused(ctx); paused {
+				select {
+				case <-ctx.Done():
+					appendLog("Scheduler shutting down")
+					return
+				case <-time.After(schedulerPausePoll):
+				}
+				continue
+			}
+
+			// Time to attempt booking
+			bookScheduledReservation(ctx, appCtx, nextRes)
+		}
+	}
+}
+
+// handlePartitionedReservations runs one worker per venue with pending reservations,
+// so a busy venue's drop doesn't delay another venue's
+func handlePartitionedReservations(ctx context.Context, newAPI func() api.API) {
+	appendLog("Scheduler started with per-venue reservation queues")
+
+	var mu sync.Mutex
+	workers := make(map[int64]bool)
+
+	for {
+		venueIDs, err := store.GetPendingVenueIDs(ctx)
+		if err != nil {
+			appendLog("Failed to list venues with pending reservations: " + err.Error())
+		}
+
+		for _, venueID := range venueIDs {
+			mu.Lock()
+			running := workers[venueID]
+			workers[venueID] = true
+			mu.Unlock()
+			if running {
+				continue
+			}
+
+			// Each worker gets its own API client, since the client holds the venue's cookies
+			go func(venueID int64) {
+				handleVenueReservations(ctx, app.AppCtx{API: newAPI()}, venueID)
+				mu.Lock()
+				delete(workers, venueID)
+				mu.Unlock()
+			}(venueID)
+		}
+
+		select {
+		case <-ctx.Done():
+			appendLog("Scheduler shutting down")
+			return
+		case <-time.After(30 * time.Second):
+		}
+	}
+}
+
+// handleVenueReservations books a single venue's reservations as they come due,
+// returning once the venue's queue is empty
+func handleVenueReservations(ctx context.Context, appCtx app.AppCtx, venueID int64) {
+	venueIDStr := strconv.FormatInt(venueID, 10)
+	appendLog("Reservation worker started for venue " + venueIDStr)
+	defer appendLog("Reservation worker stopped for venue " + venueIDStr)
+
+	for {
+		nextRes, err := store.GetNextReservationForVenue(ctx, venueID)
+		if err != nil || nextRes == nil {
+			return
+		}
+
+		now := time.Now().UTC()
+		if nextRes.RunTime.After(now) {
+			// Sleep until the scheduled time (max 30 seconds to pick up earlier reservations and shutdown)
+			sleepDuration := nextRes.RunTime.Sub(now)
+			if sleepDuration > 30*time.Second {
+				sleepDuration = 30 * time.Second
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(sleepDuration):
+			}
+			continue
+		}
+
+		// Hold off while an operator has the scheduler paused
+		if paused, _ := store.IsSchedulerPaused(ctx); paused {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(schedulerPausePoll):
+			}
+			continue
+		}
+
+		bookScheduledReservation(ctx, appCtx, nextRes)
+	}
+}
+
+// bookScheduledReservation attempts a due reservation and removes it from the store
+func bookScheduledReservation(ctx context.Context, appCtx app.AppCtx, nextRes *store.ScheduledReservation) {
+	// A reservation picked up long after its RunTime (e.g. after an outage) is
+	// marked missed rather than booked late
+	maxLateness := config.Get().MaxLateness
+	if nextRes.Watch != nil && time.Now().After(nextRes.Watch.Until) {
+		// A watch's RunTime is only its next poll; it is missed once its window ends
+		appendLog("Missed watched reservation " + nextRes.ID + describeTags(nextRes) + " for venue " + strconv.FormatInt(nextRes.VenueID, 10) + ": its watch window has ended")
+		missedErr := errors.New("watch window ended at " + nextRes.Watch.Until.In(nycLocation).Format("2006-01-02 3:04 PM EST"))
+		logAttempt(ctx, nextRes, "missed", "Not booking: the watch window has ended", missedErr)
+		notifyReservationOutcome(webhookEventMissed, nextRes, nil, missedErr)
+		recordOutcome(ctx, nextRes, "missed", nil, missedErr)
+		finishScheduledReservation(ctx, nextRes)
+		return
+	} else if lateness := time.Since(nextRes.RunTime); nextRes.Watch == nil && maxLateness > 0 && lateness > maxLateness {
+		appendLog("Missed scheduled reservation " + nextRes.ID + describeTags(nextRes) + " for venue " + strconv.FormatInt(nextRes.VenueID, 10) +
+			": picked up " + lateness.Round(time.Second).String() + " after its run time (max lateness " + maxLateness.String() + "), not booking")
+		missedErr := errors.New("picked up " + lateness.Round(time.Second).String() + " after its run time")
+		logAttempt(ctx, nextRes, "missed", "Not booking: max lateness is "+maxLateness.String(), missedErr)
+		notifyReservationOutcome(webhookEventMissed, nextRes, nil, missedErr)
+		recordOutcome(ctx, nextRes, "missed", nil, missedErr)
+		finishScheduledReservation(ctx, nextRes)
+		return
+	}
+
+	// Reservations queued before a venue was removed from the allowlist aren't booked
+	if !config.Get().VenueAllowed(nextRes.VenueID) {
+		appendLog("Skipping scheduled reservation " + nextRes.ID + describeTags(nextRes) + ": venue " + strconv.FormatInt(nextRes.VenueID, 10) + " is not in the venue allowlist")
+		skippedErr := errors.New("venue " + strconv.FormatInt(nextRes.VenueID, 10) + " is not in the venue allowlist")
+		logAttempt(ctx, nextRes, "skipped", "Not booking: venue is not in the venue allowlist", skippedErr)
+		notifyReservationOutcome(webhookEventSkipped, nextRes, nil, skippedErr)
+		recordOutcome(ctx, nextRes, "skipped", nil, skippedErr)
+		finishScheduledReservation(ctx, nextRes)
+		return
+	}
+
+	// Spread out consecutive attempts at the same venue
+	if !waitForVenueBookingSlot(ctx, nextRes.VenueID) {
+		return
+	}
+
+	appendLog("Attempting scheduled reservation " + nextRes.ID + describeTags(nextRes) + " for venue " + strconv.FormatInt(nextRes.VenueID, 10))
+	logAttempt(ctx, nextRes, "started", "Looking for a table at "+nextRes.ReservationTime.In(nycLocation).Format("2006-01-02 3:04 PM EST"), nil)
+
+	// Convert table preferences
+	var tableTypes []api.TableType
+	for _, pref := range nextRes.TablePreferences {
+		tableTypes = append(tableTypes, api.TableType(pref))
+	}
+
+	// A token saved days ago may have expired by now; log in again if we can
+	loginResp := api.LoginResponse{AuthToken: nextRes.AuthToken, AuthTokens: nextRes.AuthTokens}
+	if config.Get().LoginRefresh && nextRes.EncryptedCredentials != "" {
+		if fresh, err := refreshLogin(appCtx, nextRes); err != nil {
+			appendLog("Could not log in again for scheduled reservation " + nextRes.ID + ", using its stored token: " + err.Error())
+			logAttempt(ctx, nextRes, "login", "Using the stored auth token: logging in again failed", err)
+		} else {
+			loginResp = fresh
+			logAttempt(ctx, nextRes, "login", "Logged in again for a fresh auth token", nil)
+		}
+	}
+
+	reserveParam := api.ReserveParam{
+		VenueID:          nextRes.VenueID,
+		ReservationTimes: nextRes.Times(),
+		PartySize:        nextRes.PartySize,
+		LoginResp:        loginResp,
+		TableTypes:       tableTypes,
+		TableFlexibility: toTableFlexibility(nextRes.TableFlexibility),
+		AllowClosest:     nextRes.AllowClosest,
+		MaxTimeWindow:    time.Duration(nextRes.MaxTimeWindow) * time.Minute,
+		FindPartySize:    nextRes.FindPartySize,
+		PartySizes:       nextRes.PartySizes,
+		Budget:           dropBudget(nextRes),
+		EarliestTime:     nextRes.EarliestTime,
+		LatestTime:       nextRes.LatestTime,
+	}
+
+	reserveResp, err := appCtx.API.Reserve(reserveParam)
+	for errors.Is(err, api.ErrServiceUnavailable) {
+		// Retrying straight away would only hit the outage again; wait, for as
+		// long as the reservation could still be booked
+		backoff := unavailableBackoff(err)
+		if backoff <= 0 {
+			break
+		}
+		maxLateness := config.Get().MaxLateness
+		if maxLateness > 0 && time.Since(nextRes.RunTime)+backoff > maxLateness {
+			break
+		}
+		if time.Now().Add(backoff).After(nextRes.ReservationTime) {
+			break
+		}
+
+		appendLog("Resy is unavailable for scheduled reservation " + nextRes.ID + ", retrying in " + backoff.String())
+		logAttempt(ctx, nextRes, "retry", "Resy is unavailable, retrying in "+backoff.String(), err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		reserveResp, err = appCtx.API.Reserve(reserveParam)
+	}
+
+	// Flexible diners can list other dates; try them in order while nothing matches
+	for _, fallback := range fallbackTimes(nextRes) {
+		if !errors.Is(err, api.ErrNoTable) && !errors.Is(err, api.ErrNoOffer) {
+			break
+		}
+		appendLog("No table for scheduled reservation " + nextRes.ID + " on " + reserveParam.ReservationTimes[0].In(nycLocation).Format("2006-01-02") +
+			", trying " + fallback[0].In(nycLocation).Format("2006-01-02"))
+		logAttempt(ctx, nextRes, "fallback", "No table, trying "+fallback[0].In(nycLocation).Format("2006-01-02"), err)
+		reserveParam.ReservationTimes = fallback
+		reserveParam.EarliestTime = onDate(nextRes.EarliestTime, fallback[0])
+		reserveParam.LatestTime = onDate(nextRes.LatestTime, fallback[0])
+		reserveResp, err = appCtx.API.Reserve(reserveParam)
+	}
+
+	// A watch polls again while nothing matches (or Resy had a passing problem), until its window ends
+	if nextRes.Watch != nil && err != nil && (errors.Is(err, api.ErrNoTable) || errors.Is(err, api.ErrNoOffer) || api.IsRetryable(err)) {
+		if nextPoll := time.Now().Add(watchInterval(nextRes.Watch)).UTC(); nextPoll.Before(nextRes.Watch.Until) {
+			nextRes.RunTime = nextPoll
+			if saveErr := store.SaveReservation(ctx, nextRes); saveErr != nil {
+				appendLog("Failed to requeue watched reservation " + nextRes.ID + ": " + saveErr.Error())
+			} else {
+				logAttempt(ctx, nextRes, "watch", "No table yet, polling again at "+nextPoll.In(nycLocation).Format("3:04:05 PM"), err)
+				return
+			}
+		}
+	}
+
+	recordBookingAttempt(nextRes.VenueID, err)
+	if err != nil {
+		outcome := "terminal"
+		if api.IsRetryable(err) {
+			outcome = "retryable"
+		}
+		appendLog("Failed to book scheduled reservation " + nextRes.ID + describeTags(nextRes) + " (" + outcome + "): " + err.Error())
+		logAttempt(ctx, nextRes, "failed", "Booking failed ("+outcome+")", err)
+		notifyReservationOutcome(webhookEventFailed, nextRes, nil, err)
+		recordOutcome(ctx, nextRes, "failed", nil, err)
+	} else {
+		appendLog("Successfully booked scheduled reservation " + nextRes.ID + describeTags(nextRes))
+		if warning := bookingMismatch(reserveResp, nextRes.PartySize, reserveParam.ReservationTimes[0]); warning != "" {
+			appendLog("Warning: scheduled reservation " + nextRes.ID + " " + warning)
+		}
+		// Keep Resy's IDs for the booking so it can be looked up or cancelled later
+		nextRes.ResyReservationID = reserveResp.ReservationID
+		nextRes.ResyToken = reserveResp.ResyToken
+		if reserveResp.VenueMismatch {
+			nextRes.BookedVenueID = reserveResp.BookedVenueID
+		}
+		if err := store.SaveBookedReservation(ctx, nextRes); err != nil {
+			appendLog("Failed to save booking of reservation " + nextRes.ID + ": " + err.Error())
+		}
+		logAttempt(ctx, nextRes, "booked", "Booked "+reserveResp.ReservationTime.In(nycLocation).Format("2006-01-02 3:04 PM EST"), nil)
+		notifyReservationOutcome(webhookEventBooked, nextRes, reserveResp, nil)
+		recordOutcome(ctx, nextRes, "booked", reserveResp, nil)
+	}
+
+	// Remove the reservation from Redis (regardless of success/failure), or queue its next occurrence
+	finishScheduledReservation(ctx, nextRes)
+}
+
+// logAttempt adds a step to a scheduled reservation's own attempt log, see
+// GET /api/reservations/{id}/log. err, if set, is recorded as the step's error.
+func logAttempt(ctx context.Context, res *store.ScheduledReservation, step, message string, err error) {
+	entry := store.AttemptLogEntry{Time: time.Now().UTC(), Step: step, Message: message}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if err := store.AppendAttemptLog(ctx, res, entry); err != nil {
+		appendLog("Failed to write attempt log for reservation " + res.ID + ": " + err.Error())
+	}
+}
+
+// watchInterval returns how long a watch waits between polls, never less than
+// WATCH_MIN_POLL_INTERVAL so a watch can't wear out a venue's cookies
+func watchInterval(watch *store.Watch) time.Duration {
+	return max(watch.Interval(), config.Get().WatchMinPollInterval)
+}
+
+// resolveWatch checks a watch request against a scheduled reservation starting
+// at requestTime and returns the watch to store
+func resolveWatch(cfg *config.Config, req WatchRequest, reservationTime, requestTime time.Time) (*store.Watch, error) {
+	until := reservationTime
+	if req.Until != "" {
+		var err error
+		until, err = parseTimeNYC(req.Until)
+		if err != nil {
+			return nil, errors.New("invalid until format, use YYYY-MM-DDTHH:MM or RFC3339")
+		}
+	}
+	if until.After(reservationTime) {
+		return nil, errors.New("until must not be after the reservation time")
+	}
+	if !until.After(requestTime) || !until.After(time.Now()) {
+		return nil, errors.New("until must be after the request time and in the future")
+	}
+
+	interval := cfg.WatchPollInterval
+	if req.PollInterval != "" {
+		var err error
+		interval, err = time.ParseDuration(req.PollInterval)
+		if err != nil {
+			return nil, errors.New("invalid poll_interval format, use a duration such as 2m")
+		}
+	}
+	if interval < cfg.WatchMinPollInterval {
+		return nil, errors.New("poll_interval must be at least " + cfg.WatchMinPollInterval.String())
+	}
+	return &store.Watch{Until: until.UTC(), PollInterval: interval.String()}, nil
+}
+
+// recordOutcome adds a scheduled reservation's final outcome to the reservation
+// history. reserveResp is the booking when it succeeded; err is why it didn't.
+func recordOutcome(ctx context.Context, res *store.ScheduledReservation, status string, reserveResp *api.ReserveResponse, err error) {
+	outcome := store.ReservationOutcome{
+		ReservationID:   res.ID,
+		VenueID:         res.VenueID,
+		ReservationTime: res.ReservationTime,
+		PartySize:       res.PartySize,
+		Status:          status,
+		FinishedAt:      time.Now().UTC(),
+	}
+	if reserveResp != nil {
+		outcome.ReservationTime = reserveResp.ReservationTime
+		outcome.ResyReservationID = reserveResp.ReservationID
+	}
+	if err != nil {
+		outcome.Error = err.Error()
+	}
+	if err := store.RecordReservationOutcome(ctx, outcome); err != nil {
+		appendLog("Failed to record outcome of reservation " + res.ID + ": " + err.Error())
+	}
+}
+
+// unavailableBackoff returns how long to wait before retrying after Resy was
+// unavailable: RESY_UNAVAILABLE_BACKOFF, or longer if Resy asked for it
+func unavailableBackoff(err error) time.Duration {
+	backoff := config.Get().UnavailableBackoff
+	var unavailableErr *api.ServiceUnavailableError
+	if errors.As(err, &unavailableErr) && unavailableErr.RetryAfter > backoff {
+		backoff = unavailableErr.RetryAfter
+	}
+	return backoff
+}
+
+// finishScheduledReservation removes an attempted reservation from the store, or
+// reschedules it for its next occurrence if it recurs
+func finishScheduledReservation(ctx context.Context, res *store.ScheduledReservation) {
+	if res.Recurrence != nil {
+		nextRun, err := res.Recurrence.NextRunTime(maxTime(res.RunTime, time.Now()), nycLocation)
+		if err == nil {
+			// Move the reservation by the same number of calendar days, keeping its NYC wall-clock time across DST changes
+			next := *res
+			days := calendarDaysBetween(res.RunTime, nextRun)
+			next.ReservationTime = res.ReservationTime.In(nycLocation).AddDate(0, 0, days).UTC()
+			next.ReservationTimes = nil
+			for _, t := range res.ReservationTimes {
+				next.ReservationTimes = append(next.ReservationTimes, t.In(nycLocation).AddDate(0, 0, days).UTC())
+			}
+			next.FallbackDates = shiftDates(res.FallbackDates, days)
+			next.EarliestTime = onDate(res.EarliestTime, next.ReservationTime)
+			next.LatestTime = onDate(res.LatestTime, next.ReservationTime)
+			next.RunTime = nextRun
+			next.ResyReservationID, next.ResyToken, next.BookedVenueID = "", "", 0
+			if err := store.SaveReservation(ctx, &next); err != nil {
+				appendLog("Failed to reschedule recurring reservation " + res.ID + ": " + err.Error())
+			} else {
+				appendLog("Rescheduled recurring reservation " + res.ID + " for: " + nextRun.In(nycLocation).Format("2006-01-02 3:04 PM EST"))
+				return
+			}
+		} else {
+			appendLog("Invalid recurrence on reservation " + res.ID + ": " + err.Error())
+		}
+	}
+
+	if err := store.DeleteReservation(ctx, res.ID); err != nil {
+		appendLog("Failed to delete reservation " + res.ID + " from store: " + err.Error())
+	}
+}
+
+// validateNoteAndLabels checks a reservation's note and labels against the size limits
+func validateNoteAndLabels(note string, labels map[string]string) error {
+	if len(note) > maxNoteLength {
+		return errors.New("note must be at most " + strconv.Itoa(maxNoteLength) + " characters")
+	}
+	if len(labels) > maxLabels {
+		return errors.New("at most " + strconv.Itoa(maxLabels) + " labels are allowed")
+	}
+	for key, value := range labels {
+		if strings.TrimSpace(key) == "" {
+			return errors.New("label names must not be empty")
+		}
+		if len(key) > maxLabelLength || len(value) > maxLabelLength {
+			return errors.New("label names and values must be at most " + strconv.Itoa(maxLabelLength) + " characters")
+		}
+	}
+	return nil
+}
+
+// describeTags formats a reservation's note and labels for log lines, e.g.
+// ` ("anniversary dinner"; client=X)`, or "" when it has neither
+func describeTags(res *store.ScheduledReservation) string {
+	var parts []string
+	if res.Note != "" {
+		parts = append(parts, strconv.Quote(res.Note))
+	}
+	keys := make([]string, 0, len(res.Labels))
+	for key := range res.Labels {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		parts = append(parts, key+"="+res.Labels[key])
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return " (" + strings.Join(parts, "; ") + ")"
+}
+
+// validateFallbackDates checks fallback dates are YYYY-MM-DD
+func validateFallbackDates(dates []string) error {
+	for _, date := range dates {
+		if _, err := time.Parse("2006-01-02", date); err != nil {
+			return errors.New("invalid fallback date " + strconv.Quote(date) + ", use YYYY-MM-DD")
+		}
+	}
+	return nil
+}
+
+// fallbackTimes returns a reservation's fallback dates, each with the
+// reservation's NYC times of day in order, skipping times that have passed
+func fallbackTimes(res *store.ScheduledReservation) [][]time.Time {
+	var fallbacks [][]time.Time
+	for _, date := range res.FallbackDates {
+		day, err := time.ParseInLocation("2006-01-02", date, nycLocation)
+		if err != nil {
+			continue
+		}
+		var times []time.Time
+		for _, reservationTime := range res.Times() {
+			clock := reservationTime.In(nycLocation)
+			t := time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), clock.Second(), 0, nycLocation).UTC()
+			if t.After(time.Now()) {
+				times = append(times, t)
+			}
+		}
+		if len(times) > 0 {
+			fallbacks = append(fallbacks, times)
+		}
+	}
+	return fallbacks
+}
+
+// parseReservationTimes parses a request's reservation_time and
+// reservation_times, in that order of preference. Without reservation_time the
+// first of reservation_times leads. All must be on the same NYC date, since
+// one search covers them.
+func parseReservationTimes(req ReserveRequest) ([]time.Time, error) {
+	raw := req.ReservationTimes
+	if req.ReservationTime != "" {
+		raw = append([]string{req.ReservationTime}, raw...)
+	}
+	if len(raw) == 0 {
+		return nil, errors.New("Invalid reservation time format. Use YYYY-MM-DDTHH:MM or RFC3339")
+	}
 
-			if nextRes.RunTime.After(now) {
-				// Sleep until the scheduled time (max 30 seconds to allow for faster shutdown response)
-				sleepDuration := nextRes.RunTime.Sub(now)
-				if sleepDuration > 30*time.Second {
-					sleepDuration = 30 * time.Second
-				}
-				select {
-				case <-ctx.Done():
-					appendLog("Scheduler shutting down")
-					return
-				case <-time.After(sleepDuration):
-				}
-				continue
-			}
+	times := make([]time.Time, 0, len(raw))
+	for _, value := range raw {
+		t, err := parseTimeNYC(value)
+		if err != nil {
+			return nil, errors.New("Invalid reservation time format. Use YYYY-MM-DDTHH:MM or RFC3339")
+		}
+		if len(times) > 0 && t.In(nycLocation).Format("2006-01-02") != times[0].In(nycLocation).Format("2006-01-02") {
+			return nil, errors.New("reservation_times must all be on the same date as the first reservation time")
+		}
+		if !slices.ContainsFunc(times, t.Equal) {
+			times = append(times, t)
+		}
+	}
+	return times, nil
+}
 
-			// Time to attempt booking
-			appendLog("Attempting scheduled reservation " + nextRes.ID + " for venue " + strconv.FormatInt(nextRes.VenueID, 10))
+// shiftDates moves YYYY-MM-DD dates by a number of days, dropping invalid ones
+func shiftDates(dates []string, days int) []string {
+	var shifted []string
+	for _, date := range dates {
+		if day, err := time.Parse("2006-01-02", date); err == nil {
+			shifted = append(shifted, day.AddDate(0, 0, days).Format("2006-01-02"))
+		}
+	}
+	return shifted
+}
 
-			// Convert table preferences
-			var tableTypes []api.TableType
-			for _, pref := range nextRes.TablePreferences {
-				tableTypes = append(tableTypes, api.TableType(pref))
-			}
+// calendarDaysBetween returns the number of NYC calendar days from a to b
+func calendarDaysBetween(a, b time.Time) int {
+	a, b = a.In(nycLocation), b.In(nycLocation)
+	dayA := time.Date(a.Year(), a.Month(), a.Day(), 0, 0, 0, 0, time.UTC)
+	dayB := time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, time.UTC)
+	return int(dayB.Sub(dayA).Hours() / 24)
+}
 
-			reserveParam := api.ReserveParam{
-				VenueID:          nextRes.VenueID,
-				ReservationTimes: []time.Time{nextRes.ReservationTime},
-				PartySize:        nextRes.PartySize,
-				LoginResp:        api.LoginResponse{AuthToken: nextRes.AuthToken},
-				TableTypes:       tableTypes,
-			}
+// maxTime returns the later of two times
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
 
-			_, err = appCtx.API.Reserve(reserveParam)
-			if err != nil {
-				appendLog("Failed to book scheduled reservation " + nextRes.ID + ": " + err.Error())
-			} else {
-				appendLog("Successfully booked scheduled reservation " + nextRes.ID)
-			}
+// Last scheduled booking attempt per venue, for enforcing the minimum booking interval
+var (
+	venueLastBookingMu sync.Mutex
+	venueLastBooking   = make(map[int64]time.Time)
+)
 
-			// Remove the reservation from Redis (regardless of success/failure)
-			if err := store.DeleteReservation(ctx, nextRes.ID); err != nil {
-				appendLog("Failed to delete reservation " + nextRes.ID + " from store: " + err.Error())
-			}
+// waitForVenueBookingSlot blocks until the venue's minimum booking interval has
+// passed since its last attempt, then records a new attempt. It returns false
+// if ctx is cancelled while waiting.
+func waitForVenueBookingSlot(ctx context.Context, venueID int64) bool {
+	minInterval := config.Get().BookingMinIntervalFor(venueID)
+	if minInterval <= 0 {
+		return true
+	}
+
+	for {
+		venueLastBookingMu.Lock()
+		wait := time.Until(venueLastBooking[venueID].Add(minInterval))
+		if wait <= 0 {
+			venueLastBooking[venueID] = time.Now()
+			venueLastBookingMu.Unlock()
+			return true
+		}
+		venueLastBookingMu.Unlock()
+
+		appendLog("Delaying booking at venue " + strconv.FormatInt(venueID, 10) + " by " + wait.Round(time.Millisecond).String() + " to respect the minimum booking interval")
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(wait):
 		}
 	}
 }
@@ -735,12 +2579,18 @@ func handleScheduledReservations(ctx context.Context, appCtx app.AppCtx) {
 // handleCookieRefresh periodically refreshes Imperva cookies for known venues
 func handleCookieRefresh(ctx context.Context, cfg *config.Config) {
 	appendLog("Cookie refresh goroutine started (interval: " + cfg.CookieRefreshInterval.String() + ")")
+	for venueID, interval := range cfg.VenueCookieRefreshIntervals {
+		appendLog("Cookie refresh interval for venue " + strconv.FormatInt(venueID, 10) + ": " + interval.String())
+	}
+
+	// Last refresh check per venue, so each venue follows its own interval
+	lastRefresh := make(map[int64]time.Time)
 
 	// Run immediately on startup
-	refreshAllCookies(ctx, cfg)
+	refreshAllCookies(ctx, cfg, lastRefresh)
 
-	// Then run periodically
-	ticker := time.NewTicker(cfg.CookieRefreshInterval)
+	// Then wake up at the shortest interval and refresh the venues that are due
+	ticker := time.NewTicker(cfg.MinCookieRefreshInterval())
 	defer ticker.Stop()
 
 	for {
@@ -749,41 +2599,144 @@ func handleCookieRefresh(ctx context.Context, cfg *config.Config) {
 			appendLog("Cookie refresh goroutine shutting down")
 			return
 		case <-ticker.C:
-			refreshAllCookies(ctx, cfg)
+			refreshAllCookies(ctx, cfg, lastRefresh)
 		}
 	}
 }
 
-// refreshAllCookies checks and refreshes cookies for all known venues
-func refreshAllCookies(ctx context.Context, cfg *config.Config) {
+// refreshAllCookies checks and refreshes cookies for all known venues whose refresh interval has elapsed
+func refreshAllCookies(ctx context.Context, cfg *config.Config, lastRefresh map[int64]time.Time) {
 	appendLog("Starting cookie refresh check for " + strconv.Itoa(len(cfg.KnownVenueIDs)) + " venues")
 
+	now := time.Now()
 	for _, venueID := range cfg.KnownVenueIDs {
+		// Allow a little slack so ticker jitter doesn't push a venue to the next tick
+		if last, ok := lastRefresh[venueID]; ok && now.Sub(last) < cfg.CookieRefreshIntervalFor(venueID)-time.Second {
+			continue
+		}
+
+		// Operators can quiet a broken venue without removing it from the list
+		if disabled, _ := store.IsCookieRefreshDisabled(ctx, venueID); disabled {
+			continue
+		}
+
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			refreshCookiesIfNeeded(ctx, venueID)
+			// Venues with their own interval are refreshed on that schedule even if cookies haven't expired
+			_, force := cfg.VenueCookieRefreshIntervals[venueID]
+			refreshCookiesIfNeeded(ctx, venueID, force)
+			lastRefresh[venueID] = now
 		}
 	}
 
 	appendLog("Cookie refresh check completed")
 }
 
-// refreshCookiesIfNeeded checks if cookies need refreshing and fetches new ones if so
-func refreshCookiesIfNeeded(ctx context.Context, venueID int64) {
+// preDropCheckInterval is how often upcoming reservations are checked for a pre-drop cookie refresh
+const preDropCheckInterval = 15 * time.Second
+
+// handlePreDropCookieRefresh refreshes a venue's cookies once per scheduled
+// reservation, PRE_DROP_COOKIE_REFRESH_LEAD before it runs, so a drop doesn't
+// depend on the periodic refresh having happened recently
+func handlePreDropCookieRefresh(ctx context.Context, cfg *config.Config) {
+	appendLog("Pre-drop cookie refresh started (lead: " + cfg.PreDropCookieRefreshLead.String() + ")")
+
+	// Run time each reservation was last refreshed for; a recurring reservation
+	// gets a new run time, and so a new refresh, after each attempt
+	refreshed := make(map[string]time.Time)
+
+	ticker := time.NewTicker(preDropCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			appendLog("Pre-drop cookie refresh shutting down")
+			return
+		case <-ticker.C:
+			refreshCookiesBeforeDrops(ctx, cfg, refreshed)
+		}
+	}
+}
+
+// refreshCookiesBeforeDrops force-refreshes the cookies of every venue with a
+// reservation running within the lead time that hasn't been refreshed for yet
+func refreshCookiesBeforeDrops(ctx context.Context, cfg *config.Config, refreshed map[string]time.Time) {
+	upcoming, err := store.GetUpcomingReservations(ctx, cfg.PreDropCookieRefreshLead)
+	if err != nil {
+		appendLog("Failed to list upcoming reservations for pre-drop cookie refresh: " + err.Error())
+		return
+	}
+
+	// Forget reservations that have run
+	for id, runTime := range refreshed {
+		if time.Now().After(runTime) {
+			delete(refreshed, id)
+		}
+	}
+
+	// One refresh covers every reservation at the same venue
+	venuesDone := make(map[int64]bool)
+	for _, res := range upcoming {
+		if runTime, ok := refreshed[res.ID]; ok && runTime.Equal(res.RunTime) {
+			continue
+		}
+		refreshed[res.ID] = res.RunTime
+
+		if venuesDone[res.VenueID] {
+			continue
+		}
+		venuesDone[res.VenueID] = true
+
+		if disabled, _ := store.IsCookieRefreshDisabled(ctx, res.VenueID); disabled {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			appendLog("Reservation " + res.ID + " runs in " + time.Until(res.RunTime).Round(time.Second).String() +
+				", refreshing cookies for venue " + strconv.FormatInt(res.VenueID, 10))
+			refreshCookiesIfNeeded(ctx, res.VenueID, true)
+		}
+	}
+}
+
+// refreshCookiesIfNeeded checks each of a venue's cookie sets and fetches new ones where needed.
+// When force is set, cookies are fetched regardless of their remaining TTL.
+func refreshCookiesIfNeeded(ctx context.Context, venueID int64, force bool) {
+	for set := 0; set < config.Get().CookieSetsPerVenue; set++ {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			refreshCookieSetIfNeeded(ctx, venueID, set, force)
+		}
+	}
+}
+
+// refreshCookieSetIfNeeded checks if one of a venue's cookie sets needs refreshing and fetches a new one if so
+func refreshCookieSetIfNeeded(ctx context.Context, venueID int64, set int, force bool) {
 	venueIDStr := strconv.FormatInt(venueID, 10)
+	if set > 0 {
+		venueIDStr += " (cookie set " + strconv.Itoa(set) + ")"
+	}
 
 	// Check if cookies exist and their TTL
-	exists, err := store.CookieExists(ctx, venueID)
+	exists, err := store.CookieSetExists(ctx, venueID, set)
 	if err != nil {
 		appendLog("Error checking cookie existence for venue " + venueIDStr + ": " + err.Error())
 		return
 	}
 
 	// If cookies exist, check if they're expiring soon (within 2 hours)
-	if exists {
-		ttl, err := store.GetCookieTTL(ctx, venueID)
+	if exists && force {
+		appendLog("Venue " + venueIDStr + " refresh interval elapsed, refreshing cookies...")
+	} else if exists {
+		ttl, err := store.GetCookieSetTTL(ctx, venueID, set)
 		if err != nil {
 			appendLog("Error getting cookie TTL for venue " + venueIDStr + ": " + err.Error())
 			return
@@ -801,14 +2754,14 @@ func refreshCookiesIfNeeded(ctx context.Context, venueID int64) {
 	}
 
 	// Fetch new cookies using headless browser
-	cookieData, err := imperva.FetchCookies(venueID)
+	cookieData, err := imperva.FetchCookiesForAPI(venueID)
 	if err != nil {
 		appendLog("Failed to fetch cookies for venue " + venueIDStr + ": " + err.Error())
 		return
 	}
 
 	// Save cookies to Redis with 24 hour TTL
-	if err := store.SaveCookies(ctx, venueID, cookieData.Cookies, cookieData.UserAgent, 24*time.Hour); err != nil {
+	if err := store.SaveCookieSet(ctx, venueID, set, cookieData.Cookies, cookieData.UserAgent, 24*time.Hour); err != nil {
 		appendLog("Failed to save cookies for venue " + venueIDStr + ": " + err.Error())
 		return
 	}
@@ -818,26 +2771,328 @@ func refreshCookiesIfNeeded(ctx context.Context, venueID int64) {
 
 // validateAdminToken checks the Authorization header for a valid admin token
 func validateAdminToken(r *http.Request, cfg *config.Config) bool {
-	if !cfg.HasAdminToken() {
-		// If no admin token is configured, check for a query param (for development)
-		token := r.URL.Query().Get("token")
-		return token != "" && cfg.ValidateAdminToken(token)
-	}
+	token := adminTokenFromRequest(r)
+	return token != "" && cfg.ValidateAdminToken(token)
+}
 
+// adminTokenFromRequest returns the admin token from the Authorization header,
+// or the token query param when there is no header
+func adminTokenFromRequest(r *http.Request) string {
 	authHeader := r.Header.Get("Authorization")
 	if authHeader == "" {
 		// Also check query param as fallback
-		token := r.URL.Query().Get("token")
-		return cfg.ValidateAdminToken(token)
+		return r.URL.Query().Get("token")
 	}
 
 	// Expect "Bearer <token>"
 	parts := strings.SplitN(authHeader, " ", 2)
 	if len(parts) != 2 || parts[0] != "Bearer" {
-		return false
+		return ""
+	}
+	return parts[1]
+}
+
+// checkRedisVersion verifies the Redis server is new enough for the store,
+// warning about an old or unreachable server, or exiting in strict mode
+func checkRedisVersion(cfg *config.Config) {
+	if cfg.RedisMinVersion == "" {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	version, err := store.CheckServerVersion(ctx, cfg.RedisMinVersion)
+	if err == nil {
+		appendLog("Connected to Redis " + version)
+		return
+	}
+
+	if cfg.RedisVersionStrict {
+		log.Fatalf("Redis version check failed: %v", err)
+	}
+	appendLog("Warning: Redis version check failed, some features may not work: " + err.Error())
+}
+
+// validateCookieImport checks a cookie import's venue and cookie set
+func validateCookieImport(cfg *config.Config, req CookieImportRequest) error {
+	if req.VenueID == 0 {
+		return errors.New("venue_id is required")
+	}
+	if req.CookieSet < 0 || req.CookieSet >= cfg.CookieSetsPerVenue {
+		return errors.New("cookie_set must be between 0 and " + strconv.Itoa(cfg.CookieSetsPerVenue-1))
+	}
+	return nil
+}
+
+// importCookies validates a cookie import and saves it to the store
+func importCookies(ctx context.Context, cfg *config.Config, req CookieImportRequest) error {
+	if err := validateCookieImport(cfg, req); err != nil {
+		return err
+	}
+
+	// Convert to http.Cookie
+	httpCookies := make([]*http.Cookie, len(req.Cookies))
+	for i, c := range req.Cookies {
+		httpCookies[i] = &http.Cookie{
+			Name:   c.Name,
+			Value:  c.Value,
+			Domain: c.Domain,
+			Path:   c.Path,
+		}
+	}
+
+	ttl := 24 * time.Hour
+	if req.TTLHours > 0 {
+		ttl = time.Duration(req.TTLHours) * time.Hour
+	}
+
+	if err := store.SaveCookieSet(ctx, req.VenueID, req.CookieSet, httpCookies, req.UserAgent, ttl); err != nil {
+		appendLog("Failed to save cookies for venue " + strconv.FormatInt(req.VenueID, 10) + ": " + err.Error())
+		return err
 	}
 
-	return cfg.ValidateAdminToken(parts[1])
+	appendLog("Imported " + strconv.Itoa(len(httpCookies)) + " cookies for venue " + strconv.FormatInt(req.VenueID, 10))
+	return nil
+}
+
+// ownsReservation reports whether the session's user scheduled the reservation
+func ownsReservation(session map[string]string, res *store.ScheduledReservation) bool {
+	authToken := session["auth_token"]
+	return authToken != "" && subtle.ConstantTimeCompare([]byte(authToken), []byte(res.AuthToken)) == 1
+}
+
+// exportReservation copies a reservation for export, encrypting its auth token
+func exportReservation(res *store.ScheduledReservation) (ExportedReservation, error) {
+	exported := ExportedReservation{ScheduledReservation: *res}
+	exported.AuthToken = ""
+	exported.AuthTokens = nil
+	encrypted, err := securecookie.EncodeMulti("auth_token", res.AuthToken, sessionCodecs...)
+	if err != nil {
+		return ExportedReservation{}, err
+	}
+	exported.EncryptedAuthToken = encrypted
+	if len(res.AuthTokens) > 0 {
+		encrypted, err := securecookie.EncodeMulti("auth_tokens", res.AuthTokens, sessionCodecs...)
+		if err != nil {
+			return ExportedReservation{}, err
+		}
+		exported.EncryptedAuthTokens = encrypted
+	}
+	return exported, nil
+}
+
+// storedCredentials is a Resy login kept with a scheduled reservation
+type storedCredentials struct {
+	Email    string
+	Password string
+}
+
+// encryptCredentials encrypts a Resy login for storing with a scheduled reservation
+func encryptCredentials(email, password string) (string, error) {
+	return securecookie.EncodeMulti("credentials", storedCredentials{Email: email, Password: password}, credentialCodecs...)
+}
+
+// refreshLogin logs in with a scheduled reservation's stored credentials for a
+// fresh auth token
+func refreshLogin(appCtx app.AppCtx, res *store.ScheduledReservation) (api.LoginResponse, error) {
+	var creds storedCredentials
+	if err := securecookie.DecodeMulti("credentials", res.EncryptedCredentials, &creds, credentialCodecs...); err != nil {
+		return api.LoginResponse{}, errors.New("could not decrypt stored credentials; they were saved under different keys")
+	}
+	loginResp, err := appCtx.API.Login(api.LoginParam{Email: creds.Email, Password: creds.Password})
+	if err != nil {
+		return api.LoginResponse{}, err
+	}
+	return *loginResp, nil
+}
+
+// importReservation validates an exported reservation and decrypts its auth tokens.
+// A plain auth_token is accepted when no encrypted token is present.
+func importReservation(exported ExportedReservation) (*store.ScheduledReservation, error) {
+	res := exported.ScheduledReservation
+	if res.ID == "" || res.VenueID == 0 || res.PartySize <= 0 || res.RunTime.IsZero() {
+		return nil, errors.New("id, venue_id, party_size and run_time are required")
+	}
+
+	if exported.EncryptedAuthToken != "" {
+		var authToken string
+		if err := securecookie.DecodeMulti("auth_token", exported.EncryptedAuthToken, &authToken, sessionCodecs...); err != nil {
+			return nil, errors.New("could not decrypt auth token; export was made under different keys or is too old")
+		}
+		res.AuthToken = authToken
+	}
+	if exported.EncryptedAuthTokens != "" {
+		authTokens := make(map[string]string)
+		if err := securecookie.DecodeMulti("auth_tokens", exported.EncryptedAuthTokens, &authTokens, sessionCodecs...); err != nil {
+			return nil, errors.New("could not decrypt auth tokens; export was made under different keys or is too old")
+		}
+		res.AuthTokens = authTokens
+	}
+	if res.AuthToken == "" {
+		return nil, errors.New("auth token is missing")
+	}
+
+	return &res, nil
+}
+
+// sendReserveError maps a Reserve error to a JSON error response
+func sendReserveError(w http.ResponseWriter, err error) {
+	var resp ReserveResponse
+	statusCode := http.StatusInternalServerError
+
+	// Check for specific error types using errors.Is/As
+	var netErr *api.NetworkError
+	if errors.As(err, &netErr) {
+		appendLog("Network error details - Step: " + netErr.Step + ", Status: " + strconv.Itoa(netErr.Status) + ", Message: " + netErr.Message)
+		resp.Error = "Network error at " + netErr.Step + " step: " + netErr.Message
+	} else if errors.Is(err, api.ErrTimeout) {
+		resp.Error = "Resy took too long to respond. Please try again; a retry often succeeds."
+		statusCode = http.StatusGatewayTimeout
+	} else if errors.Is(err, syscall.ECONNREFUSED) {
+		resp.Error = "Could not connect to Resy (connection refused); it may be down. Please try again later."
+		statusCode = http.StatusBadGateway
+	} else if errors.Is(err, api.ErrNetwork) {
+		resp.Error = "Network error. Please try again later."
+	} else if errors.Is(err, api.ErrNoTable) {
+		resp.Error = "No available tables found for the selected time."
+		resp.AvailableSlots = availableSlotsFromError(err)
+		if len(resp.AvailableSlots) > 0 {
+			openTimes := make([]string, 0, len(resp.AvailableSlots))
+			for _, slot := range resp.AvailableSlots {
+				slotTime := slot.Time
+				if slot.TableType != "" {
+					slotTime += " (" + slot.TableType + ")"
+				}
+				openTimes = append(openTimes, slotTime)
+			}
+			resp.Error += " Open slots: " + strings.Join(openTimes, ", ")
+		}
+		resp.NotifyAvailable = notifyAvailableFromError(err)
+		if resp.NotifyAvailable {
+			resp.Error += " The restaurant offers a notify list for this date."
+		}
+		if failure := bookFailureFromError(err); failure != "" {
+			resp.Error += " A matching slot couldn't be booked: " + failure
+		}
+		statusCode = http.StatusBadRequest
+	} else if errors.Is(err, api.ErrImperva) {
+		resp.Error = "Imperva challenge: please refresh cookies via /admin/cookies/import"
+		statusCode = http.StatusServiceUnavailable
+	} else if errors.Is(err, api.ErrNoCookies) {
+		resp.Error = "No cookies stored for this restaurant: wait for the next cookie refresh or import them via /admin/cookies/import"
+		statusCode = http.StatusServiceUnavailable
+	} else if errors.Is(err, api.ErrServiceUnavailable) {
+		resp.Error = "Resy is temporarily unavailable, possibly for maintenance. Please try again later."
+		statusCode = http.StatusServiceUnavailable
+	} else if errors.Is(err, api.ErrNoOffer) {
+		resp.Error = "No reservations available for this date."
+		statusCode = http.StatusBadRequest
+	} else if errors.Is(err, api.ErrAlreadyBooked) {
+		resp.Error = "You already have a reservation at this restaurant for this date."
+		statusCode = http.StatusConflict
+	} else if errors.Is(err, api.ErrPartyTooLarge) {
+		resp.Error = "This party size is larger than the restaurant accepts online. Please call the restaurant to book a large party."
+		statusCode = http.StatusBadRequest
+	} else if errors.Is(err, api.ErrPaymentDeclined) {
+		resp.Error = "Resy declined payment for every matching slot. Check the payment method on your Resy account."
+		var declinedErr *api.PaymentDeclinedError
+		if errors.As(err, &declinedErr) && declinedErr.Reason != "" {
+			resp.Error += " Resy said: " + declinedErr.Reason
+		}
+		statusCode = http.StatusPaymentRequired
+	} else {
+		resp.Error = "An unexpected error occurred: " + err.Error()
+	}
+
+	resp.Retryable = api.IsRetryable(err)
+	sendJSONResponse(w, resp, statusCode)
+}
+
+// previewReservation runs a read-only find for a scheduled reservation and
+// reports what it would book if it ran now. The real attempt happens at
+// requestTime, when availability may differ.
+func previewReservation(appCtx app.AppCtx, reserveParam api.ReserveParam, requestTime time.Time) *ReservationPreview {
+	reserveParam.ListMatches = true
+
+	preview := &ReservationPreview{}
+	listResp, err := appCtx.API.Reserve(reserveParam)
+	switch {
+	case err == nil:
+		preview.Matches = toAvailableSlots(listResp.Matches)
+		preview.WouldBook = formatResponseTime(listResp.ReservationTime)
+		preview.Message = "If it ran now, this reservation would book " + preview.WouldBook +
+			". The real attempt runs at " + formatResponseTime(requestTime) + ", when availability may differ."
+	case errors.Is(err, api.ErrNoTable), errors.Is(err, api.ErrNoOffer):
+		preview.AvailableSlots = availableSlotsFromError(err)
+		preview.Message = "Nothing matching is open now. Booking will be attempted at " + formatResponseTime(requestTime) + "."
+	default:
+		appendLog("Reservation preview failed: " + err.Error())
+		preview.Error = err.Error()
+		preview.Message = "Could not check availability now. The reservation is scheduled anyway."
+	}
+	return preview
+}
+
+// availableSlotsFromError returns the open slots attached to a no-table error, if any
+func availableSlotsFromError(err error) []AvailableSlot {
+	var noTableErr *api.NoTableError
+	if !errors.As(err, &noTableErr) {
+		return nil
+	}
+	return toAvailableSlots(noTableErr.Available)
+}
+
+// bookFailureFromError returns why the last matching slot couldn't be booked,
+// from a no-table error, or "" if no slot was tried
+func bookFailureFromError(err error) string {
+	var noTableErr *api.NoTableError
+	if !errors.As(err, &noTableErr) {
+		return ""
+	}
+	return noTableErr.BookFailure
+}
+
+// toAvailableSlots converts API slots for a JSON response, with times in NYC
+func toAvailableSlots(available []api.AvailableSlot) []AvailableSlot {
+	slots := make([]AvailableSlot, 0, len(available))
+	for _, slot := range available {
+		slots = append(slots, AvailableSlot{
+			Time:        slot.Time.In(nycLocation).Format("3:04 PM"),
+			TableType:   slot.TableType,
+			ConfigToken: slot.ConfigToken,
+			Deposit:     slot.Deposit,
+			PartySize:   slot.PartySize,
+		})
+	}
+	return slots
+}
+
+// dropBudget returns the request budget shared by every Reserve call of one
+// scheduled attempt, or nil if the reservation has none
+func dropBudget(res *store.ScheduledReservation) *api.DropBudget {
+	if res.DropBudget == nil {
+		return nil
+	}
+	maxDuration, err := res.DropBudget.Validate()
+	if err != nil {
+		appendLog("Ignoring invalid drop budget of reservation " + res.ID + ": " + err.Error())
+		return nil
+	}
+	return api.NewDropBudget(res.DropBudget.MaxRequests, maxDuration)
+}
+
+// recordBookingAttempt counts a booking attempt towards the venue's statistics.
+// Stats are best effort, so a Redis failure is only logged.
+func recordBookingAttempt(venueID int64, err error) {
+	if statsErr := store.RecordBookingAttempt(context.Background(), venueID, err == nil); statsErr != nil {
+		appendLog("Warning: failed to record booking stats for venue " + strconv.FormatInt(venueID, 10) + ": " + statsErr.Error())
+	}
+}
+
+// notifyAvailableFromError reports whether a no-table error says the venue offers a notify option
+func notifyAvailableFromError(err error) bool {
+	var noTableErr *api.NoTableError
+	return errors.As(err, &noTableErr) && noTableErr.NotifyAvailable
 }
 
 // Helper function to send JSON responses
@@ -853,8 +3108,8 @@ func getCookieValue(r *http.Request, name string) (string, error) {
 		return "", err
 	}
 	value := make(map[string]string)
-	if err = s.Decode("session", cookie.Value, &value); err != nil {
-		return "", err
+	if err = securecookie.DecodeMulti("session", cookie.Value, &value, sessionCodecs...); err != nil {
+		return "", errSessionExpired
 	}
 	return value[name], nil
 }
@@ -865,14 +3120,50 @@ func getSession(r *http.Request) (map[string]string, error) {
 		return nil, err
 	}
 	value := make(map[string]string)
-	if err = s.Decode("session", cookie.Value, &value); err != nil {
-		return nil, err
+	if err = securecookie.DecodeMulti("session", cookie.Value, &value, sessionCodecs...); err != nil {
+		// Signed with a key we no longer have (or tampered with)
+		return nil, errSessionExpired
 	}
 	return value, nil
 }
 
-// parseTimeNYC parses a datetime-local format string as NYC time and returns UTC
+// sessionAuthTokens returns the extra login tokens stored in a session, if any
+func sessionAuthTokens(session map[string]string) map[string]string {
+	if session["auth_tokens"] == "" {
+		return nil
+	}
+	var authTokens map[string]string
+	if err := json.Unmarshal([]byte(session["auth_tokens"]), &authTokens); err != nil {
+		return nil
+	}
+	return authTokens
+}
+
+// clearSessionCookie tells the browser to drop an undecodable session cookie
+func clearSessionCookie(w http.ResponseWriter) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     "session",
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+	})
+}
+
+// parseTimeNYC parses a time string and returns UTC. RFC3339 times keep their
+// own offset; datetime-local strings, with or without seconds, are NYC time.
 func parseTimeNYC(timeStr string) (time.Time, error) {
+	// RFC3339 with an explicit offset: "2025-12-25T19:00:00-05:00" or "...Z"
+	if t, err := time.Parse(time.RFC3339, timeStr); err == nil {
+		return t.UTC(), nil
+	}
+
+	// datetime-local format with seconds: "2025-12-25T19:00:00"
+	if t, err := time.ParseInLocation("2006-01-02T15:04:05", timeStr, nycLocation); err == nil {
+		return t.UTC(), nil
+	}
+
 	// datetime-local format: "2025-12-25T19:00"
 	t, err := time.ParseInLocation("2006-01-02T15:04", timeStr, nycLocation)
 	if err != nil {
@@ -881,12 +3172,156 @@ func parseTimeNYC(timeStr string) (time.Time, error) {
 	return t.UTC(), nil // Convert to UTC for storage/processing
 }
 
-// appendLog adds a log message to both the standard log and in-memory slice
-func appendLog(message string) {
-	// Prevent unbounded memory growth by trimming old entries
-	if len(logLines) >= maxLogLines {
-		logLines = logLines[1:] // Remove oldest entry
+// parseTimeWindow parses earliest_time and latest_time, each either HH:MM on the
+// reservation's NYC date or a full time in parseTimeNYC's formats. Either may be
+// empty to leave that side of the window open; both empty means no window.
+func parseTimeWindow(earliest, latest string, reservationTime time.Time) (time.Time, time.Time, error) {
+	parseBound := func(name, value string) (time.Time, error) {
+		if value == "" {
+			return time.Time{}, nil
+		}
+		t, err := parseTimeNYC(value)
+		if err != nil {
+			clock, clockErr := time.Parse("15:04", value)
+			if clockErr != nil {
+				return time.Time{}, errors.New("invalid " + name + ": use HH:MM, YYYY-MM-DDTHH:MM or RFC3339")
+			}
+			day := reservationTime.In(nycLocation)
+			t = time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, nycLocation).UTC()
+		}
+		// Slots are only searched on the reservation date
+		if t.In(nycLocation).Format("2006-01-02") != reservationTime.In(nycLocation).Format("2006-01-02") {
+			return time.Time{}, errors.New(name + " must be on the reservation date")
+		}
+		return t, nil
+	}
+
+	earliestTime, err := parseBound("earliest_time", strings.TrimSpace(earliest))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	latestTime, err := parseBound("latest_time", strings.TrimSpace(latest))
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	if !earliestTime.IsZero() && !latestTime.IsZero() && latestTime.Before(earliestTime) {
+		return time.Time{}, time.Time{}, errors.New("latest_time must not be before earliest_time")
+	}
+	return earliestTime, latestTime, nil
+}
+
+// onDate moves t to day's NYC date, keeping its NYC time of day. A zero t, an
+// open window bound, stays zero.
+func onDate(t, day time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	clock, date := t.In(nycLocation), day.In(nycLocation)
+	return time.Date(date.Year(), date.Month(), date.Day(), clock.Hour(), clock.Minute(), clock.Second(), 0, nycLocation).UTC()
+}
+
+// resolveRequestTime works out when a scheduled reservation should run: either
+// the explicit request_time, or a drop given as drop_at or drop_days_before and
+// drop_time, less the drop lead
+func resolveRequestTime(req ReserveRequest, reservationTime time.Time, defaultLead time.Duration) (time.Time, error) {
+	specs := 0
+	for _, set := range []bool{req.RequestTime != "", req.DropAt != "", req.DropDaysBefore != nil} {
+		if set {
+			specs++
+		}
+	}
+	if specs > 1 {
+		return time.Time{}, errors.New("use only one of request_time, drop_at or drop_days_before")
+	}
+	if req.DropTime != "" && req.DropDaysBefore == nil {
+		return time.Time{}, errors.New("drop_time requires drop_days_before")
+	}
+
+	if req.DropAt == "" && req.DropDaysBefore == nil {
+		requestTime, err := parseTimeNYC(req.RequestTime)
+		if err != nil {
+			return time.Time{}, errors.New("invalid request time format, use YYYY-MM-DDTHH:MM or RFC3339")
+		}
+		return requestTime, nil
+	}
+
+	var dropAt time.Time
+	if req.DropAt != "" {
+		var err error
+		dropAt, err = parseTimeNYC(req.DropAt)
+		if err != nil {
+			return time.Time{}, errors.New("invalid drop_at format, use YYYY-MM-DDTHH:MM or RFC3339")
+		}
+	} else {
+		if *req.DropDaysBefore < 0 {
+			return time.Time{}, errors.New("drop_days_before must not be negative")
+		}
+		clock, err := time.Parse("15:04", req.DropTime)
+		if err != nil {
+			return time.Time{}, errors.New("invalid drop_time format, use HH:MM")
+		}
+		// Count back calendar days in NYC so the drop keeps its wall-clock time across DST changes
+		day := reservationTime.In(nycLocation).AddDate(0, 0, -*req.DropDaysBefore)
+		dropAt = time.Date(day.Year(), day.Month(), day.Day(), clock.Hour(), clock.Minute(), 0, 0, nycLocation).UTC()
+	}
+
+	lead := defaultLead
+	if req.DropLead != "" {
+		var err error
+		lead, err = time.ParseDuration(req.DropLead)
+		if err != nil {
+			return time.Time{}, errors.New("invalid drop_lead format, use a duration such as 2s or 500ms")
+		}
+	}
+	return dropAt.Add(-lead), nil
+}
+
+// bookingMismatch describes how the party size and date Resy reported for a
+// booking differ from what was requested, or returns "" if they match or weren't reported
+func bookingMismatch(resp *api.ReserveResponse, partySize int, reservationTime time.Time) string {
+	var mismatches []string
+	// A flexible party is checked against the size its slot was booked for
+	if resp.BookedPartySize != 0 {
+		partySize = resp.BookedPartySize
+	}
+	if resp.ConfirmedPartySize != 0 && resp.ConfirmedPartySize != partySize {
+		mismatches = append(mismatches, "booked for party of "+strconv.Itoa(resp.ConfirmedPartySize)+", requested "+strconv.Itoa(partySize))
+	}
+	if resp.VenueMismatch {
+		mismatches = append(mismatches, "requested venue wasn't listed, booked at the first venue Resy listed ("+strconv.FormatInt(resp.BookedVenueID, 10)+")")
+	}
+	requestedDate := reservationTime.In(nycLocation).Format("2006-01-02")
+	if resp.ConfirmedDate != "" && resp.ConfirmedDate != requestedDate {
+		mismatches = append(mismatches, "booked for "+resp.ConfirmedDate+", requested "+requestedDate)
+	}
+	return strings.Join(mismatches, "; ")
+}
+
+// formatResponseTime formats a time in NYC for display using the configured response time format
+func formatResponseTime(t time.Time) string {
+	return t.In(nycLocation).Format(config.Get().ResponseTimeFormat)
+}
+
+// formatRFC3339 formats a time in NYC as RFC3339, for clients that parse response times
+func formatRFC3339(t time.Time) string {
+	return t.In(nycLocation).Format(time.RFC3339)
+}
+
+// toTableFlexibility converts per-table-type tolerances in minutes to durations
+func toTableFlexibility(minutes map[string]int) map[api.TableType]time.Duration {
+	if len(minutes) == 0 {
+		return nil
 	}
-	logLines = append(logLines, time.Now().Format("2006-01-02 15:04:05")+" "+message)
+	flexibility := make(map[api.TableType]time.Duration, len(minutes))
+	for tableType, m := range minutes {
+		flexibility[api.TableType(tableType)] = time.Duration(m) * time.Minute
+	}
+	return flexibility
+}
+
+// appendLog adds a log message, with secrets masked, to both the standard log and in-memory ring
+func appendLog(message string) {
+	message = logging.RedactSensitive(message)
+	logLines.Add(time.Now().Format("2006-01-02 15:04:05") + " " + message)
 	log.Println(message)
 }
@@ -0,0 +1,62 @@
+package notify
+
+import (
+	"errors"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notifier sends a message to one recipient
+type Notifier interface {
+	Send(to, subject, body string) error
+}
+
+// SMTPNotifier sends plain-text email through an SMTP server
+type SMTPNotifier struct {
+	Host     string
+	Port     int
+	Username string // Empty sends without authenticating
+	Password string
+	From     string
+}
+
+// NewSMTPNotifier returns a Notifier that sends email through host:port as from
+func NewSMTPNotifier(host string, port int, username, password, from string) *SMTPNotifier {
+	return &SMTPNotifier{
+		Host:     host,
+		Port:     port,
+		Username: username,
+		Password: password,
+		From:     from,
+	}
+}
+
+// Send emails body to to. The server must offer STARTTLS before credentials are
+// sent, which net/smtp enforces for hosts other than localhost.
+func (n *SMTPNotifier) Send(to, subject, body string) error {
+	// Header values can't contain line breaks, or they could add headers of their own
+	if strings.ContainsAny(to+subject+n.From, "\r\n") {
+		return errors.New("email address or subject contains a line break")
+	}
+
+	var auth smtp.Auth
+	if n.Username != "" {
+		auth = smtp.PlainAuth("", n.Username, n.Password, n.Host)
+	}
+
+	var msg strings.Builder
+	msg.WriteString("From: " + n.From + "\r\n")
+	msg.WriteString("To: " + to + "\r\n")
+	msg.WriteString("Subject: " + subject + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	addr := net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+	return smtp.SendMail(addr, auth, n.From, []string{to}, []byte(msg.String()))
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// routeEntry records a registered path pattern and the methods its handler
+// accepts. "*" means the handler takes any method.
+type routeEntry struct {
+	Pattern string
+	Methods string
+}
+
+// registeredRoutes lists every route added with handleRoute, in registration order
+var registeredRoutes []routeEntry
+
+// handleRoute registers handler on the default mux and records the route so it
+// can be logged at startup. methods is informational only; handlers still check
+// r.Method themselves.
+func handleRoute(pattern, methods string, handler http.HandlerFunc) {
+	http.HandleFunc(pattern, handler)
+	registeredRoutes = append(registeredRoutes, routeEntry{Pattern: pattern, Methods: methods})
+}
+
+// logRoutes writes the given routes to the log, sorted by pattern
+func logRoutes(routes []routeEntry) {
+	sorted := make([]routeEntry, len(routes))
+	copy(sorted, routes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Pattern < sorted[j].Pattern })
+
+	width := 0
+	for _, rt := range sorted {
+		width = max(width, len(rt.Methods))
+	}
+	appendLog("Registered routes:")
+	for _, rt := range sorted {
+		appendLog("  " + rt.Methods + strings.Repeat(" ", width-len(rt.Methods)) + "  " + rt.Pattern)
+	}
+}
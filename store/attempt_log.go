@@ -0,0 +1,91 @@
+package store
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// AttemptLogEntry is one step of a scheduled reservation's booking attempt
+type AttemptLogEntry struct {
+	Time    time.Time `json:"time"`
+	Step    string    `json:"step"` // e.g. "started", "reserve", "fallback", "booked", "failed"
+	Message string    `json:"message,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// maxAttemptLogEntries caps a reservation's attempt log; older entries are dropped
+const maxAttemptLogEntries = 200
+
+// attemptLogTTL is how long a reservation's attempt log is kept after its last
+// entry (0 disables attempt logs)
+var attemptLogTTL time.Duration
+
+// SetAttemptLogTTL sets how long attempt logs are kept. 0 disables them.
+func SetAttemptLogTTL(d time.Duration) {
+	attemptLogTTL = d
+}
+
+// AppendAttemptLog adds an entry to a reservation's attempt log, recording
+// which auth token owns the log so it can still be checked once the
+// reservation itself is gone
+func AppendAttemptLog(ctx context.Context, res *ScheduledReservation, entry AttemptLogEntry) error {
+	if attemptLogTTL <= 0 {
+		return nil
+	}
+	jsonData, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	key := AttemptLogKey(res.ID)
+	pipe := GetClient().TxPipeline()
+	pipe.RPush(ctx, key, jsonData)
+	pipe.LTrim(ctx, key, -maxAttemptLogEntries, -1)
+	pipe.Expire(ctx, key, attemptLogTTL)
+	pipe.Set(ctx, AttemptLogOwnerKey(res.ID), attemptLogOwner(res.AuthToken), attemptLogTTL)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// GetAttemptLog returns a reservation's attempt log, oldest entry first, if
+// authToken owns it. Logs that don't exist or belong to someone else are
+// reported as ErrReservationNotFound.
+func GetAttemptLog(ctx context.Context, id string, authToken string) ([]AttemptLogEntry, error) {
+	owner, err := GetClient().Get(ctx, AttemptLogOwnerKey(id)).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrReservationNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	if authToken == "" || subtle.ConstantTimeCompare([]byte(owner), []byte(attemptLogOwner(authToken))) != 1 {
+		return nil, ErrReservationNotFound
+	}
+
+	items, err := GetClient().LRange(ctx, AttemptLogKey(id), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]AttemptLogEntry, 0, len(items))
+	for _, item := range items {
+		var entry AttemptLogEntry
+		if err := json.Unmarshal([]byte(item), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// attemptLogOwner hashes an auth token, so attempt logs can be matched to
+// their owner without keeping the token itself
+func attemptLogOwner(authToken string) string {
+	sum := sha256.Sum256([]byte(authToken))
+	return hex.EncodeToString(sum[:])
+}
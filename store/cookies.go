@@ -3,8 +3,14 @@ package store
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/redis/go-redis/v9"
 )
 
 // CookieData represents stored cookie information for a venue
@@ -14,8 +20,55 @@ type CookieData struct {
 	ExpiresAt time.Time      `json:"expires_at"`
 }
 
+// ErrNoCookies is returned when a venue has no stored cookie set
+var ErrNoCookies = errors.New("no cookies stored for venue")
+
+// defaultCookieDomain is used for cookies imported without a domain
+const defaultCookieDomain = ".resy.com"
+
+// NormalizeCookieDomain returns a cookie domain in a canonical form:
+// lower case, without a port or trailing dot, and with a leading dot.
+// A cookie's Domain attribute always covers subdomains (RFC 6265), so
+// "resy.com" and ".resy.com" are the same domain. An empty domain
+// becomes .resy.com.
+func NormalizeCookieDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if i := strings.LastIndex(domain, ":"); i >= 0 {
+		domain = domain[:i]
+	}
+	domain = strings.Trim(domain, ".")
+	if domain == "" {
+		return defaultCookieDomain
+	}
+	return "." + domain
+}
+
+// CookieDomainMatches reports whether a cookie with the given domain
+// should be sent to host, i.e. host is the domain or a subdomain of it.
+// A cookie for .resy.com applies to api.resy.com, but one for
+// .www.resy.com does not.
+func CookieDomainMatches(domain, host string) bool {
+	domain = strings.TrimPrefix(NormalizeCookieDomain(domain), ".")
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+// normalizeCookieDomains rewrites each cookie's domain in canonical form
+func normalizeCookieDomains(cookies []*http.Cookie) {
+	for _, c := range cookies {
+		c.Domain = NormalizeCookieDomain(c.Domain)
+	}
+}
+
 // SaveCookies stores cookies for a venue with a TTL
 func SaveCookies(ctx context.Context, venueID int64, cookies []*http.Cookie, userAgent string, ttl time.Duration) error {
+	return SaveCookieSet(ctx, venueID, 0, cookies, userAgent, ttl)
+}
+
+// SaveCookieSet stores one of a venue's cookie sets with a TTL
+func SaveCookieSet(ctx context.Context, venueID int64, set int, cookies []*http.Cookie, userAgent string, ttl time.Duration) error {
+	normalizeCookieDomains(cookies)
+
 	data := CookieData{
 		Cookies:   cookies,
 		UserAgent: userAgent,
@@ -27,12 +80,17 @@ func SaveCookies(ctx context.Context, venueID int64, cookies []*http.Cookie, use
 		return err
 	}
 
-	return GetClient().Set(ctx, CookieKey(venueID), jsonData, ttl).Err()
+	return GetClient().Set(ctx, CookieSetKey(venueID, set), jsonData, ttl).Err()
 }
 
 // GetCookies retrieves cookies for a venue
 func GetCookies(ctx context.Context, venueID int64) (*CookieData, error) {
-	jsonData, err := GetClient().Get(ctx, CookieKey(venueID)).Bytes()
+	return GetCookieSet(ctx, venueID, 0)
+}
+
+// GetCookieSet retrieves one of a venue's cookie sets
+func GetCookieSet(ctx context.Context, venueID int64, set int) (*CookieData, error) {
+	jsonData, err := GetClient().Get(ctx, CookieSetKey(venueID, set)).Bytes()
 	if err != nil {
 		return nil, err
 	}
@@ -41,18 +99,30 @@ func GetCookies(ctx context.Context, venueID int64) (*CookieData, error) {
 	if err := json.Unmarshal(jsonData, &data); err != nil {
 		return nil, err
 	}
+	// Sets saved before domains were normalized may still hold raw domains
+	normalizeCookieDomains(data.Cookies)
 
 	return &data, nil
 }
 
 // DeleteCookies removes cookies for a venue
 func DeleteCookies(ctx context.Context, venueID int64) error {
-	return GetClient().Del(ctx, CookieKey(venueID)).Err()
+	return DeleteCookieSet(ctx, venueID, 0)
+}
+
+// DeleteCookieSet removes one of a venue's cookie sets
+func DeleteCookieSet(ctx context.Context, venueID int64, set int) error {
+	return GetClient().Del(ctx, CookieSetKey(venueID, set)).Err()
 }
 
 // CookieExists checks if cookies exist for a venue
 func CookieExists(ctx context.Context, venueID int64) (bool, error) {
-	result, err := GetClient().Exists(ctx, CookieKey(venueID)).Result()
+	return CookieSetExists(ctx, venueID, 0)
+}
+
+// CookieSetExists checks if one of a venue's cookie sets exists
+func CookieSetExists(ctx context.Context, venueID int64, set int) (bool, error) {
+	result, err := GetClient().Exists(ctx, CookieSetKey(venueID, set)).Result()
 	if err != nil {
 		return false, err
 	}
@@ -61,8 +131,90 @@ func CookieExists(ctx context.Context, venueID int64) (bool, error) {
 
 // GetCookieTTL returns the remaining TTL for a venue's cookies
 func GetCookieTTL(ctx context.Context, venueID int64) (time.Duration, error) {
-	return GetClient().TTL(ctx, CookieKey(venueID)).Result()
+	return GetCookieSetTTL(ctx, venueID, 0)
 }
 
+// GetCookieSetTTL returns the remaining TTL for one of a venue's cookie sets
+func GetCookieSetTTL(ctx context.Context, venueID int64, set int) (time.Duration, error) {
+	return GetClient().TTL(ctx, CookieSetKey(venueID, set)).Result()
+}
 
+// SetActiveCookieSet records which of a venue's cookie sets requests should use
+func SetActiveCookieSet(ctx context.Context, venueID int64, set int) error {
+	return GetClient().Set(ctx, CookieActiveSetKey(venueID), set, 0).Err()
+}
+
+// GetHealthyCookieSet returns the venue's active cookie set, or the next stored
+// set after it if the active one is gone, along with the index of the set used.
+// It returns ErrNoCookies if none of the venue's sets are stored.
+func GetHealthyCookieSet(ctx context.Context, venueID int64, poolSize int) (*CookieData, int, error) {
+	if poolSize < 1 {
+		poolSize = 1
+	}
 
+	start, err := GetClient().Get(ctx, CookieActiveSetKey(venueID)).Int()
+	if err != nil || start < 0 || start >= poolSize {
+		start = 0
+	}
+
+	var lastErr error = redis.Nil
+	for i := 0; i < poolSize; i++ {
+		set := (start + i) % poolSize
+		data, err := GetCookieSet(ctx, venueID, set)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if set != start {
+			if err := SetActiveCookieSet(ctx, venueID, set); err != nil {
+				return nil, -1, err
+			}
+		}
+		return data, set, nil
+	}
+
+	if errors.Is(lastErr, redis.Nil) {
+		return nil, -1, ErrNoCookies
+	}
+	return nil, -1, lastErr
+}
+
+// SetCookieRefreshDisabled turns automatic cookie refresh off or back on for a venue
+func SetCookieRefreshDisabled(ctx context.Context, venueID int64, disabled bool) error {
+	if disabled {
+		return GetClient().SAdd(ctx, CookieRefreshDisabledKey, venueID).Err()
+	}
+	return GetClient().SRem(ctx, CookieRefreshDisabledKey, venueID).Err()
+}
+
+// IsCookieRefreshDisabled reports whether automatic cookie refresh is off for a venue
+func IsCookieRefreshDisabled(ctx context.Context, venueID int64) (bool, error) {
+	return GetClient().SIsMember(ctx, CookieRefreshDisabledKey, venueID).Result()
+}
+
+// ListVenuesWithCookies returns, by venue ID, every venue with any cookie keys
+// in Redis, found by scanning them
+func ListVenuesWithCookies(ctx context.Context) ([]int64, error) {
+	seen := make(map[int64]bool)
+	iter := GetClient().Scan(ctx, 0, CookieKeyPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		// cookies:{venueID}, cookies:{venueID}:{set} or cookies:{venueID}:active;
+		// other keys under the prefix, such as the refresh-disabled set, don't parse
+		venuePart, _, _ := strings.Cut(strings.TrimPrefix(iter.Val(), CookieKeyPrefix), ":")
+		venueID, err := strconv.ParseInt(venuePart, 10, 64)
+		if err != nil {
+			continue
+		}
+		seen[venueID] = true
+	}
+	if err := iter.Err(); err != nil {
+		return nil, err
+	}
+
+	venueIDs := make([]int64, 0, len(seen))
+	for venueID := range seen {
+		venueIDs = append(venueIDs, venueID)
+	}
+	sort.Slice(venueIDs, func(i, j int) bool { return venueIDs[i] < venueIDs[j] })
+	return venueIDs, nil
+}
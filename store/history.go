@@ -0,0 +1,73 @@
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// ReservationOutcome records how a scheduled reservation's attempt ended
+type ReservationOutcome struct {
+	ReservationID     string    `json:"reservation_id"`
+	VenueID           int64     `json:"venue_id"`
+	ReservationTime   time.Time `json:"reservation_time"` // The time booked, or the time asked for
+	PartySize         int       `json:"party_size"`
+	Status            string    `json:"status"` // "booked", "failed", "missed" or "skipped"
+	Error             string    `json:"error,omitempty"`
+	ResyReservationID string    `json:"resy_reservation_id,omitempty"` // Resy's confirmation, when booked
+	FinishedAt        time.Time `json:"finished_at"`
+}
+
+// historyPageSize is how many outcomes ScanReservationHistory reads from Redis at a time
+const historyPageSize = 500
+
+// maxHistoryEntries caps the reservation history; older outcomes are dropped
+// (0 disables the history)
+var maxHistoryEntries int64
+
+// SetReservationHistorySize sets how many outcomes the reservation history
+// keeps. 0 disables it.
+func SetReservationHistorySize(n int) {
+	maxHistoryEntries = int64(n)
+}
+
+// RecordReservationOutcome adds a finished attempt to the reservation history
+func RecordReservationOutcome(ctx context.Context, outcome ReservationOutcome) error {
+	if maxHistoryEntries <= 0 {
+		return nil
+	}
+	jsonData, err := json.Marshal(outcome)
+	if err != nil {
+		return err
+	}
+
+	pipe := GetClient().TxPipeline()
+	pipe.RPush(ctx, ReservationHistoryKey, jsonData)
+	pipe.LTrim(ctx, ReservationHistoryKey, -maxHistoryEntries, -1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// ScanReservationHistory calls fn with each recorded outcome, oldest first,
+// reading a page at a time so the whole history is never held in memory. It
+// stops at the first error fn returns.
+func ScanReservationHistory(ctx context.Context, fn func(ReservationOutcome) error) error {
+	for start := int64(0); ; start += historyPageSize {
+		items, err := GetClient().LRange(ctx, ReservationHistoryKey, start, start+historyPageSize-1).Result()
+		if err != nil {
+			return err
+		}
+		for _, item := range items {
+			var outcome ReservationOutcome
+			if err := json.Unmarshal([]byte(item), &outcome); err != nil {
+				continue
+			}
+			if err := fn(outcome); err != nil {
+				return err
+			}
+		}
+		if len(items) < historyPageSize {
+			return nil
+		}
+	}
+}
@@ -3,39 +3,161 @@ package store
 import (
 	"context"
 	"fmt"
-	"os"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// TestDB is the database index used until SetOptions is called, as in test
+// runs, so they don't touch dev data on a shared Redis
+const TestDB = 15
+
+// Options configures the Redis client
+type Options struct {
+	Addr     string
+	Password string
+	DB       int // Logical database index
+	// Bounded timeouts and a few retries ride out brief network blips
+	// instead of failing the command, or hanging on a dead connection
+	DialTimeout time.Duration
+	ReadTimeout time.Duration
+	MaxRetries  int
+}
+
 var (
-	client *redis.Client
-	once   sync.Once
+	client  *redis.Client
+	once    sync.Once
+	options = Options{
+		Addr:        "localhost:6379",
+		DB:          TestDB,
+		DialTimeout: 5 * time.Second,
+		ReadTimeout: 3 * time.Second,
+		MaxRetries:  3,
+	}
 )
 
+// SetOptions sets how the Redis client connects. It must be called before the
+// first GetClient; later calls have no effect.
+func SetOptions(opts Options) {
+	options = opts
+}
+
 // GetClient returns the singleton Redis client
 func GetClient() *redis.Client {
 	once.Do(func() {
-		redisURL := os.Getenv("REDIS_URL")
-		if redisURL == "" {
-			redisURL = "localhost:6379"
-		}
-
-		redisPassword := os.Getenv("REDIS_PASSWORD")
-
 		client = redis.NewClient(&redis.Options{
-			Addr:     redisURL,
-			Password: redisPassword,
-			DB:       0,
+			Addr:        options.Addr,
+			Password:    options.Password,
+			DB:          options.DB,
+			DialTimeout: options.DialTimeout,
+			ReadTimeout: options.ReadTimeout,
+			MaxRetries:  options.MaxRetries,
 		})
 	})
 	return client
 }
 
-// Ping checks if Redis is connected
+// SetSchedulerPaused records whether the scheduler should hold off on bookings
+func SetSchedulerPaused(ctx context.Context, paused bool) error {
+	if !paused {
+		return GetClient().Del(ctx, SchedulerPausedKey).Err()
+	}
+	return GetClient().Set(ctx, SchedulerPausedKey, "1", 0).Err()
+}
+
+// IsSchedulerPaused reports whether the scheduler has been paused
+func IsSchedulerPaused(ctx context.Context) (bool, error) {
+	n, err := GetClient().Exists(ctx, SchedulerPausedKey).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// Last failed Ping, reported by the health check until a Ping succeeds
+var (
+	lastPingMu    sync.Mutex
+	lastPingErr   error
+	lastPingErrAt time.Time
+)
+
+// Ping checks if Redis is connected, remembering the error if it isn't
 func Ping(ctx context.Context) error {
-	return GetClient().Ping(ctx).Err()
+	err := GetClient().Ping(ctx).Err()
+
+	lastPingMu.Lock()
+	defer lastPingMu.Unlock()
+	if err != nil {
+		lastPingErr, lastPingErrAt = err, time.Now()
+	} else {
+		lastPingErr = nil
+	}
+	return err
+}
+
+// LastPingError returns when the last Ping failed and its error, or a nil
+// error if the last Ping succeeded
+func LastPingError() (time.Time, error) {
+	lastPingMu.Lock()
+	defer lastPingMu.Unlock()
+	return lastPingErrAt, lastPingErr
+}
+
+// PoolStats returns the Redis client's connection pool counters
+func PoolStats() *redis.PoolStats {
+	return GetClient().PoolStats()
+}
+
+// ServerVersion returns the Redis server's version, as reported by INFO server
+func ServerVersion(ctx context.Context) (string, error) {
+	info, err := GetClient().Info(ctx, "server").Result()
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(info, "\n") {
+		if version, ok := strings.CutPrefix(strings.TrimSpace(line), "redis_version:"); ok {
+			return version, nil
+		}
+	}
+	return "", fmt.Errorf("redis_version missing from INFO server")
+}
+
+// CheckServerVersion returns the Redis server's version, and an error if it
+// couldn't be read or is older than minVersion (e.g. "6.0")
+func CheckServerVersion(ctx context.Context, minVersion string) (string, error) {
+	version, err := ServerVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	if compareVersions(version, minVersion) < 0 {
+		return version, fmt.Errorf("redis %s is older than the required %s", version, minVersion)
+	}
+	return version, nil
+}
+
+// compareVersions compares dotted version strings numerically, returning -1, 0
+// or 1. Missing or non-numeric parts count as 0.
+func compareVersions(a, b string) int {
+	partsA, partsB := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(partsA) || i < len(partsB); i++ {
+		var numA, numB int
+		if i < len(partsA) {
+			numA, _ = strconv.Atoi(partsA[i])
+		}
+		if i < len(partsB) {
+			numB, _ = strconv.Atoi(partsB[i])
+		}
+		if numA != numB {
+			if numA < numB {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
 }
 
 // Close closes the Redis connection
@@ -48,9 +170,16 @@ func Close() error {
 
 // Key prefixes
 const (
-	CookieKeyPrefix      = "cookies:"
-	ReservationKeyPrefix = "reservations:"
-	PendingSetKey        = "reservations:pending"
+	CookieKeyPrefix          = "cookies:"
+	ReservationKeyPrefix     = "reservations:"
+	PendingSetKey            = "reservations:pending"
+	SchedulerPausedKey       = "scheduler:paused"
+	CookieRefreshDisabledKey = "cookies:refresh_disabled" // Set of venue IDs the cookie refresh skips
+	StatsKeyPrefix           = "stats:venue:"
+	StatsVenuesKey           = "stats:venues" // Set of venue IDs with booking statistics
+	BookedKeyPrefix          = "booked:"
+	AttemptLogKeyPrefix      = "attempts:"
+	ReservationHistoryKey    = "history:reservations" // List of finished reservation attempts, oldest first
 )
 
 // CookieKey returns the Redis key for a venue's cookies
@@ -58,10 +187,46 @@ func CookieKey(venueID int64) string {
 	return fmt.Sprintf("%s%d", CookieKeyPrefix, venueID)
 }
 
-// ReservationKey returns the Redis key for a reservation
-func ReservationKey(id string) string {
-	return fmt.Sprintf("%s%s", ReservationKeyPrefix, id)
+// VenuePendingSetKey returns the Redis key for a venue's pending reservation queue
+func VenuePendingSetKey(venueID int64) string {
+	return fmt.Sprintf("%s:venue:%d", PendingSetKey, venueID)
+}
+
+// CookieSetKey returns the Redis key for one of a venue's cookie sets.
+// Set 0 is the venue's primary cookie key, so single-set setups are unchanged.
+func CookieSetKey(venueID int64, set int) string {
+	if set == 0 {
+		return CookieKey(venueID)
+	}
+	return fmt.Sprintf("%s%d:%d", CookieKeyPrefix, venueID, set)
+}
+
+// CookieActiveSetKey returns the Redis key holding the index of a venue's active cookie set
+func CookieActiveSetKey(venueID int64) string {
+	return fmt.Sprintf("%s%d:active", CookieKeyPrefix, venueID)
+}
+
+// VenueStatsKey returns the Redis key for a venue's booking statistics
+func VenueStatsKey(venueID int64) string {
+	return fmt.Sprintf("%s%d", StatsKeyPrefix, venueID)
+}
+
+// BookedReservationKey returns the Redis key for a booked reservation's record
+func BookedReservationKey(id string) string {
+	return fmt.Sprintf("%s%s", BookedKeyPrefix, id)
 }
 
+// AttemptLogKey returns the Redis key for a reservation's attempt log
+func AttemptLogKey(id string) string {
+	return fmt.Sprintf("%s%s", AttemptLogKeyPrefix, id)
+}
 
+// AttemptLogOwnerKey returns the Redis key for the owner of a reservation's attempt log
+func AttemptLogOwnerKey(id string) string {
+	return fmt.Sprintf("%s%s:owner", AttemptLogKeyPrefix, id)
+}
 
+// ReservationKey returns the Redis key for a reservation
+func ReservationKey(id string) string {
+	return fmt.Sprintf("%s%s", ReservationKeyPrefix, id)
+}
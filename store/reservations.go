@@ -2,23 +2,162 @@ package store
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/redis/go-redis/v9"
 )
 
+// ErrReservationNotFound is returned when no reservation has the given ID
+var ErrReservationNotFound = errors.New("reservation not found")
+
 // ScheduledReservation represents a reservation scheduled for future execution
 type ScheduledReservation struct {
-	ID               string    `json:"id"`
-	VenueID          int64     `json:"venue_id"`
-	ReservationTime  time.Time `json:"reservation_time"`
-	PartySize        int       `json:"party_size"`
-	TablePreferences []string  `json:"table_preferences"`
-	AuthToken        string    `json:"auth_token"`
-	RunTime          time.Time `json:"run_time"` // When to attempt the reservation
-	CreatedAt        time.Time `json:"created_at"`
+	ID                string            `json:"id"`
+	VenueID           int64             `json:"venue_id"`
+	ReservationTime   time.Time         `json:"reservation_time"`
+	ReservationTimes  []time.Time       `json:"reservation_times,omitempty"` // All acceptable times, most preferred first, when there are several; the first is ReservationTime
+	PartySize         int               `json:"party_size"`
+	TablePreferences  []string          `json:"table_preferences"`
+	TableFlexibility  map[string]int    `json:"table_flexibility,omitempty"`       // Minutes of tolerance per table type
+	AllowClosest      bool              `json:"allow_closest,omitempty"`           // Book the closest slot when the exact time is taken
+	MaxTimeWindow     int               `json:"max_time_window_minutes,omitempty"` // With AllowClosest, minutes the closest slot may be off; 0 means 30
+	Recurrence        *Recurrence       `json:"recurrence,omitempty"`              // Repeat weekly after each attempt
+	FallbackDates     []string          `json:"fallback_dates,omitempty"`          // Other NYC dates (YYYY-MM-DD) to try in order, at the same time of day
+	FindPartySize     int               `json:"find_party_size,omitempty"`         // Party size to search slots with, if not PartySize
+	PartySizes        []int             `json:"party_sizes,omitempty"`             // Other party sizes to search at once, booking the best slot across all
+	Note              string            `json:"note,omitempty"`                    // Free-form note for the user's own organization
+	Labels            map[string]string `json:"labels,omitempty"`                  // Free-form tags, e.g. {"occasion": "anniversary"}
+	Priority          int               `json:"priority,omitempty"`                // Higher runs first when several are due at once
+	DropBudget        *DropBudget       `json:"drop_budget,omitempty"`             // Caps the Resy requests and time one attempt may use
+	Watch             *Watch            `json:"watch,omitempty"`                   // Keep polling for a cancellation until a table is booked
+	ResyReservationID string            `json:"resy_reservation_id,omitempty"`     // Resy's ID for the booking, once booked
+	ResyToken         string            `json:"resy_token,omitempty"`              // Cancels the booking, once booked
+	BookedVenueID     int64             `json:"booked_venue_id,omitempty"`         // Venue actually booked, when Resy didn't list VenueID
+	AuthToken         string            `json:"auth_token"`
+	AuthTokens        map[string]string `json:"auth_tokens,omitempty"` // Other login tokens, see api.LoginResponse
+	RunTime           time.Time         `json:"run_time"`              // When to attempt the reservation
+	CreatedAt         time.Time         `json:"created_at"`
+	// Resy email and password, encrypted under the session keys, to log in
+	// again right before the attempt instead of using a stale AuthToken
+	EncryptedCredentials string `json:"encrypted_credentials,omitempty"`
+	// Address the outcome is emailed to, when SMTP is configured
+	NotifyEmail string `json:"notify_email,omitempty"`
+	// Book any slot between these on the reservation date instead of around
+	// ReservationTime; a zero bound leaves that side open
+	EarliestTime time.Time `json:"earliest_time,omitzero"`
+	LatestTime   time.Time `json:"latest_time,omitzero"`
+}
+
+// Times returns the reservation's acceptable times, most preferred first
+func (r *ScheduledReservation) Times() []time.Time {
+	if len(r.ReservationTimes) > 0 {
+		return r.ReservationTimes
+	}
+	return []time.Time{r.ReservationTime}
+}
+
+// Recurrence repeats a scheduled reservation every week. It gives the day and
+// time the booking attempt runs; the reservation time keeps its offset from it.
+type Recurrence struct {
+	DayOfWeek string `json:"day_of_week"` // e.g. "friday" or "fri"
+	Time      string `json:"time"`        // HH:MM, 24-hour
+}
+
+// DropBudget caps the Resy requests and time one scheduled attempt may use,
+// across find retries, fallback dates, details and book
+type DropBudget struct {
+	MaxRequests int    `json:"max_requests,omitempty"` // 0 means no request limit
+	MaxDuration string `json:"max_duration,omitempty"` // e.g. "30s"; empty means no time limit
+}
+
+// Validate checks the budget's limits and returns its duration
+func (b *DropBudget) Validate() (time.Duration, error) {
+	if b.MaxRequests < 0 {
+		return 0, fmt.Errorf("invalid max_requests %d", b.MaxRequests)
+	}
+	if b.MaxDuration == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(b.MaxDuration)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid max_duration %q, use e.g. \"30s\"", b.MaxDuration)
+	}
+	return d, nil
+}
+
+// Watch keeps a scheduled reservation polling for a cancellation: while no
+// table matches, the attempt runs again every PollInterval until Until. Its
+// RunTime is the next poll.
+type Watch struct {
+	Until        time.Time `json:"until"`
+	PollInterval string    `json:"poll_interval"` // e.g. "2m"
+}
+
+// Interval returns how long to wait between polls, or 0 if PollInterval is invalid
+func (w *Watch) Interval() time.Duration {
+	d, err := time.ParseDuration(w.PollInterval)
+	if err != nil || d < 0 {
+		return 0
+	}
+	return d
+}
+
+// Validate checks the recurrence's day of week and time
+func (r *Recurrence) Validate() error {
+	if _, ok := parseWeekday(r.DayOfWeek); !ok {
+		return fmt.Errorf("invalid day_of_week %q", r.DayOfWeek)
+	}
+	if _, err := time.Parse("15:04", r.Time); err != nil {
+		return fmt.Errorf("invalid time %q, use HH:MM", r.Time)
+	}
+	return nil
+}
+
+// NextRunTime returns the first time after after that falls on the recurrence's
+// day of week and time, in loc
+func (r *Recurrence) NextRunTime(after time.Time, loc *time.Location) (time.Time, error) {
+	if err := r.Validate(); err != nil {
+		return time.Time{}, err
+	}
+	weekday, _ := parseWeekday(r.DayOfWeek)
+	clock, _ := time.Parse("15:04", r.Time)
+
+	local := after.In(loc)
+	next := time.Date(local.Year(), local.Month(), local.Day(), clock.Hour(), clock.Minute(), 0, 0, loc)
+	next = next.AddDate(0, 0, (int(weekday)-int(next.Weekday())+7)%7)
+	if !next.After(after) {
+		next = next.AddDate(0, 0, 7)
+	}
+	return next.UTC(), nil
+}
+
+// parseWeekday parses a full or three-letter English day name
+func parseWeekday(name string) (time.Weekday, bool) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for d := time.Sunday; d <= time.Saturday; d++ {
+		full := strings.ToLower(d.String())
+		if name == full || name == full[:3] {
+			return d, true
+		}
+	}
+	return 0, false
+}
+
+// reservationExpiry is how long after its RunTime a reservation's data is kept
+// (0 keeps it until deleted), so reservations the scheduler never processed
+// don't linger forever
+var reservationExpiry time.Duration
+
+// SetReservationExpiry sets how long after its RunTime a saved reservation's
+// data expires. 0 disables expiry.
+func SetReservationExpiry(d time.Duration) {
+	reservationExpiry = d
 }
 
 // SaveReservation stores a scheduled reservation in Redis
@@ -28,15 +167,27 @@ func SaveReservation(ctx context.Context, res *ScheduledReservation) error {
 		return err
 	}
 
-	// Store the reservation data
+	// Store the reservation data, expiring once it's too late to book it
 	key := ReservationKey(res.ID)
-	if err := GetClient().Set(ctx, key, jsonData, 0).Err(); err != nil {
+	var ttl time.Duration
+	if reservationExpiry > 0 {
+		ttl = max(time.Until(res.RunTime), 0) + reservationExpiry
+	}
+	if err := GetClient().Set(ctx, key, jsonData, ttl).Err(); err != nil {
 		return err
 	}
 
 	// Add to the pending sorted set with RunTime as score for efficient polling
 	score := float64(res.RunTime.Unix())
-	return GetClient().ZAdd(ctx, PendingSetKey, redis.Z{
+	if err := GetClient().ZAdd(ctx, PendingSetKey, redis.Z{
+		Score:  score,
+		Member: res.ID,
+	}).Err(); err != nil {
+		return err
+	}
+
+	// Also add to the venue's own queue so venues can be processed independently
+	return GetClient().ZAdd(ctx, VenuePendingSetKey(res.VenueID), redis.Z{
 		Score:  score,
 		Member: res.ID,
 	}).Err()
@@ -45,7 +196,9 @@ func SaveReservation(ctx context.Context, res *ScheduledReservation) error {
 // GetReservation retrieves a reservation by ID
 func GetReservation(ctx context.Context, id string) (*ScheduledReservation, error) {
 	jsonData, err := GetClient().Get(ctx, ReservationKey(id)).Bytes()
-	if err != nil {
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrReservationNotFound
+	} else if err != nil {
 		return nil, err
 	}
 
@@ -57,8 +210,30 @@ func GetReservation(ctx context.Context, id string) (*ScheduledReservation, erro
 	return &res, nil
 }
 
+// bookedRetention is how long after its reservation time a booked record is kept
+const bookedRetention = 24 * time.Hour
+
+// SaveBookedReservation keeps a booked reservation, with Resy's reservation ID
+// and token, until a day after its reservation time so it can still be looked
+// up or cancelled once it leaves the schedule
+func SaveBookedReservation(ctx context.Context, res *ScheduledReservation) error {
+	jsonData, err := json.Marshal(res)
+	if err != nil {
+		return err
+	}
+	ttl := max(time.Until(res.ReservationTime), 0) + bookedRetention
+	return GetClient().Set(ctx, BookedReservationKey(res.ID), jsonData, ttl).Err()
+}
+
 // DeleteReservation removes a reservation from Redis
 func DeleteReservation(ctx context.Context, id string) error {
+	// Remove from the venue's queue, if the reservation data is still around
+	if res, err := GetReservation(ctx, id); err == nil {
+		if err := GetClient().ZRem(ctx, VenuePendingSetKey(res.VenueID), id).Err(); err != nil {
+			return err
+		}
+	}
+
 	// Remove from sorted set
 	if err := GetClient().ZRem(ctx, PendingSetKey, id).Err(); err != nil {
 		return err
@@ -68,6 +243,13 @@ func DeleteReservation(ctx context.Context, id string) error {
 	return GetClient().Del(ctx, ReservationKey(id)).Err()
 }
 
+// dropOrphan removes a queue entry whose reservation data is gone, e.g. expired
+func dropOrphan(ctx context.Context, id string, queues ...string) {
+	for _, queue := range append(queues, PendingSetKey) {
+		GetClient().ZRem(ctx, queue, id)
+	}
+}
+
 // GetPendingReservations returns reservations that are due to run (RunTime <= now)
 func GetPendingReservations(ctx context.Context) ([]*ScheduledReservation, error) {
 	now := float64(time.Now().Unix())
@@ -84,7 +266,10 @@ func GetPendingReservations(ctx context.Context) ([]*ScheduledReservation, error
 	reservations := make([]*ScheduledReservation, 0, len(ids))
 	for _, id := range ids {
 		res, err := GetReservation(ctx, id)
-		if err != nil {
+		if errors.Is(err, ErrReservationNotFound) {
+			dropOrphan(ctx, id)
+			continue
+		} else if err != nil {
 			// Log but continue - reservation might have been deleted
 			continue
 		}
@@ -94,19 +279,154 @@ func GetPendingReservations(ctx context.Context) ([]*ScheduledReservation, error
 	return reservations, nil
 }
 
-// GetNextReservation returns the earliest pending reservation
+// GetUpcomingReservations returns reservations due to run after now but within
+// the given window
+func GetUpcomingReservations(ctx context.Context, within time.Duration) ([]*ScheduledReservation, error) {
+	now := time.Now()
+
+	ids, err := GetClient().ZRangeByScore(ctx, PendingSetKey, &redis.ZRangeBy{
+		Min: fmt.Sprintf("(%f", float64(now.Unix())),
+		Max: fmt.Sprintf("%f", float64(now.Add(within).Unix())),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	reservations := make([]*ScheduledReservation, 0, len(ids))
+	for _, id := range ids {
+		res, err := GetReservation(ctx, id)
+		if errors.Is(err, ErrReservationNotFound) {
+			dropOrphan(ctx, id)
+			continue
+		} else if err != nil {
+			continue
+		}
+		reservations = append(reservations, res)
+	}
+
+	return reservations, nil
+}
+
+// priorityOrder makes the next reservation the highest-priority due one rather
+// than the earliest
+var priorityOrder = true
+
+// SetPriorityOrder chooses whether due reservations are taken by Priority
+// (ties by RunTime) or strictly by RunTime
+func SetPriorityOrder(enabled bool) {
+	priorityOrder = enabled
+}
+
+// GetNextReservation returns the next pending reservation to run: the earliest,
+// or if several are due, the highest-priority one
 func GetNextReservation(ctx context.Context) (*ScheduledReservation, error) {
-	// Get the first (earliest) reservation ID from the sorted set
-	ids, err := GetClient().ZRange(ctx, PendingSetKey, 0, 0).Result()
+	return getNextFromQueue(ctx, PendingSetKey)
+}
+
+// GetNextReservationForVenue returns the next pending reservation to run for a venue
+func GetNextReservationForVenue(ctx context.Context, venueID int64) (*ScheduledReservation, error) {
+	return getNextFromQueue(ctx, VenuePendingSetKey(venueID))
+}
+
+// getNextFromQueue returns the next reservation to run from a pending queue, or
+// nil if it is empty
+func getNextFromQueue(ctx context.Context, queue string) (*ScheduledReservation, error) {
+	var orphanQueues []string
+	if queue != PendingSetKey {
+		orphanQueues = append(orphanQueues, queue)
+	}
+
+	for {
+		// Get the first (earliest) reservation ID from the sorted set
+		ids, err := GetClient().ZRange(ctx, queue, 0, 0).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		if len(ids) == 0 {
+			return nil, nil // No pending reservations
+		}
+
+		res, err := GetReservation(ctx, ids[0])
+		if errors.Is(err, ErrReservationNotFound) {
+			// Its data expired or was deleted; don't let it block the queue
+			dropOrphan(ctx, ids[0], orphanQueues...)
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if !priorityOrder || res.RunTime.After(time.Now()) {
+			return res, nil
+		}
+		return highestPriorityDue(ctx, queue, res)
+	}
+}
+
+// highestPriorityDue returns the highest-priority due reservation in a queue.
+// Ties go to the earliest, which is passed in as the queue's first entry.
+func highestPriorityDue(ctx context.Context, queue string, earliest *ScheduledReservation) (*ScheduledReservation, error) {
+	ids, err := GetClient().ZRangeByScore(ctx, queue, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: fmt.Sprintf("%f", float64(time.Now().Unix())),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	best := earliest
+	for _, id := range ids {
+		if id == earliest.ID {
+			continue
+		}
+		// IDs come in RunTime order, so only a strictly higher priority wins
+		res, err := GetReservation(ctx, id)
+		if err != nil {
+			continue
+		}
+		if res.Priority > best.Priority {
+			best = res
+		}
+	}
+	return best, nil
+}
+
+// GetPendingVenueIDs returns the venues that have pending reservations.
+// Pending reservations missing from their venue's queue (e.g. saved before
+// venue queues existed) are added to it.
+func GetPendingVenueIDs(ctx context.Context) ([]int64, error) {
+	entries, err := GetClient().ZRangeWithScores(ctx, PendingSetKey, 0, -1).Result()
 	if err != nil {
 		return nil, err
 	}
 
-	if len(ids) == 0 {
-		return nil, nil // No pending reservations
+	seen := make(map[int64]bool)
+	venueIDs := make([]int64, 0)
+	for _, entry := range entries {
+		id, ok := entry.Member.(string)
+		if !ok {
+			continue
+		}
+		res, err := GetReservation(ctx, id)
+		if errors.Is(err, ErrReservationNotFound) {
+			dropOrphan(ctx, id)
+			continue
+		} else if err != nil {
+			continue
+		}
+		if err := GetClient().ZAdd(ctx, VenuePendingSetKey(res.VenueID), redis.Z{
+			Score:  entry.Score,
+			Member: id,
+		}).Err(); err != nil {
+			return nil, err
+		}
+		if !seen[res.VenueID] {
+			seen[res.VenueID] = true
+			venueIDs = append(venueIDs, res.VenueID)
+		}
 	}
 
-	return GetReservation(ctx, ids[0])
+	return venueIDs, nil
 }
 
 // GetAllPendingReservations returns all scheduled reservations (for status endpoint)
@@ -120,7 +440,10 @@ func GetAllPendingReservations(ctx context.Context) ([]*ScheduledReservation, er
 	reservations := make([]*ScheduledReservation, 0, len(ids))
 	for _, id := range ids {
 		res, err := GetReservation(ctx, id)
-		if err != nil {
+		if errors.Is(err, ErrReservationNotFound) {
+			dropOrphan(ctx, id)
+			continue
+		} else if err != nil {
 			continue
 		}
 		reservations = append(reservations, res)
@@ -134,10 +457,77 @@ func CountPendingReservations(ctx context.Context) (int64, error) {
 	return GetClient().ZCard(ctx, PendingSetKey).Result()
 }
 
-// GenerateReservationID creates a unique ID for a reservation
-func GenerateReservationID() string {
-	return fmt.Sprintf("res_%d", time.Now().UnixNano())
+// GetOldestDueRunTime returns the RunTime of the earliest pending reservation
+// if it is already due, reporting false when nothing is due
+func GetOldestDueRunTime(ctx context.Context) (time.Time, bool, error) {
+	entries, err := GetClient().ZRangeWithScores(ctx, PendingSetKey, 0, 0).Result()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	if len(entries) == 0 {
+		return time.Time{}, false, nil
+	}
+
+	runTime := time.Unix(int64(entries[0].Score), 0)
+	if runTime.After(time.Now()) {
+		return time.Time{}, false, nil
+	}
+	return runTime, true, nil
+}
+
+// Reservation ID schemes
+const (
+	ReservationIDSchemeRandom    = "random"    // res_ followed by 128 random bits in hex (default)
+	ReservationIDSchemeUUID      = "uuid"      // res_ followed by a random (version 4) UUID
+	ReservationIDSchemeTimestamp = "timestamp" // res_<unixnano>, the original scheme; guessable
+)
+
+// ReservationIDGenerator returns a new reservation ID
+type ReservationIDGenerator func() string
+
+// reservationIDGenerators holds the available ID schemes by name
+var reservationIDGenerators = map[string]ReservationIDGenerator{
+	ReservationIDSchemeRandom: func() string {
+		return "res_" + hex.EncodeToString(randomBytes(16))
+	},
+	ReservationIDSchemeUUID: func() string {
+		b := randomBytes(16)
+		b[6] = (b[6] & 0x0f) | 0x40 // version 4
+		b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+		return fmt.Sprintf("res_%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	},
+	ReservationIDSchemeTimestamp: func() string {
+		return fmt.Sprintf("res_%d", time.Now().UnixNano())
+	},
 }
 
+// generateReservationID is the generator used by GenerateReservationID
+var generateReservationID = reservationIDGenerators[ReservationIDSchemeRandom]
 
+// RegisterReservationIDScheme adds or replaces a named reservation ID scheme
+func RegisterReservationIDScheme(name string, generator ReservationIDGenerator) {
+	reservationIDGenerators[name] = generator
+}
 
+// SetReservationIDScheme selects the scheme GenerateReservationID uses
+func SetReservationIDScheme(name string) error {
+	generator, ok := reservationIDGenerators[name]
+	if !ok {
+		return fmt.Errorf("unknown reservation ID scheme %q", name)
+	}
+	generateReservationID = generator
+	return nil
+}
+
+// GenerateReservationID creates a unique ID for a reservation
+func GenerateReservationID() string {
+	return generateReservationID()
+}
+
+// randomBytes returns n bytes from the system's secure random source
+func randomBytes(n int) []byte {
+	b := make([]byte, n)
+	rand.Read(b) // Never returns an error; crashes the program if the source fails
+	return b
+}
@@ -0,0 +1,107 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strconv"
+)
+
+// VenueStats counts booking attempts at a venue and how they ended, and the
+// Resy requests for it that ran into an Imperva challenge
+type VenueStats struct {
+	VenueID   int64 `json:"venue_id"`
+	Attempts  int64 `json:"attempts"`
+	Successes int64 `json:"successes"`
+	Failures  int64 `json:"failures"`
+	// Requests challenged by Imperva, and whether retrying with the
+	// challenge's cookies got through or the retries ran out
+	ImpervaChallenges int64 `json:"imperva_challenges"`
+	ImpervaResolved   int64 `json:"imperva_resolved"`
+	ImpervaUnresolved int64 `json:"imperva_unresolved"`
+}
+
+// Stats hash fields
+const (
+	statsFieldAttempts  = "attempts"
+	statsFieldSuccesses = "successes"
+	statsFieldFailures  = "failures"
+
+	statsFieldImpervaChallenges = "imperva_challenges"
+	statsFieldImpervaResolved   = "imperva_resolved"
+	statsFieldImpervaUnresolved = "imperva_unresolved"
+)
+
+// RecordBookingAttempt counts one booking attempt at a venue and its outcome
+func RecordBookingAttempt(ctx context.Context, venueID int64, success bool) error {
+	outcome := statsFieldFailures
+	if success {
+		outcome = statsFieldSuccesses
+	}
+
+	pipe := GetClient().TxPipeline()
+	pipe.HIncrBy(ctx, VenueStatsKey(venueID), statsFieldAttempts, 1)
+	pipe.HIncrBy(ctx, VenueStatsKey(venueID), outcome, 1)
+	pipe.SAdd(ctx, StatsVenuesKey, venueID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// RecordImpervaChallenge counts one request for a venue that Imperva challenged,
+// and whether retrying resolved the challenge
+func RecordImpervaChallenge(ctx context.Context, venueID int64, resolved bool) error {
+	outcome := statsFieldImpervaUnresolved
+	if resolved {
+		outcome = statsFieldImpervaResolved
+	}
+
+	pipe := GetClient().TxPipeline()
+	pipe.HIncrBy(ctx, VenueStatsKey(venueID), statsFieldImpervaChallenges, 1)
+	pipe.HIncrBy(ctx, VenueStatsKey(venueID), outcome, 1)
+	pipe.SAdd(ctx, StatsVenuesKey, venueID)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetVenueStats returns a venue's booking statistics, all zero if it has none
+func GetVenueStats(ctx context.Context, venueID int64) (VenueStats, error) {
+	stats := VenueStats{VenueID: venueID}
+	fields, err := GetClient().HGetAll(ctx, VenueStatsKey(venueID)).Result()
+	if err != nil {
+		return stats, err
+	}
+	stats.Attempts, _ = strconv.ParseInt(fields[statsFieldAttempts], 10, 64)
+	stats.Successes, _ = strconv.ParseInt(fields[statsFieldSuccesses], 10, 64)
+	stats.Failures, _ = strconv.ParseInt(fields[statsFieldFailures], 10, 64)
+	stats.ImpervaChallenges, _ = strconv.ParseInt(fields[statsFieldImpervaChallenges], 10, 64)
+	stats.ImpervaResolved, _ = strconv.ParseInt(fields[statsFieldImpervaResolved], 10, 64)
+	stats.ImpervaUnresolved, _ = strconv.ParseInt(fields[statsFieldImpervaUnresolved], 10, 64)
+	return stats, nil
+}
+
+// GetAllVenueStats returns the booking statistics of every venue with any, by venue ID
+func GetAllVenueStats(ctx context.Context) ([]VenueStats, error) {
+	members, err := GetClient().SMembers(ctx, StatsVenuesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	venueIDs := make([]int64, 0, len(members))
+	for _, member := range members {
+		venueID, err := strconv.ParseInt(member, 10, 64)
+		if err != nil {
+			continue
+		}
+		venueIDs = append(venueIDs, venueID)
+	}
+	sort.Slice(venueIDs, func(i, j int) bool { return venueIDs[i] < venueIDs[j] })
+
+	all := make([]VenueStats, 0, len(venueIDs))
+	for _, venueID := range venueIDs {
+		stats, err := GetVenueStats(ctx, venueID)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, stats)
+	}
+	return all, nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/21Bruce/resolved-server/api"
+	"github.com/21Bruce/resolved-server/config"
+	"github.com/21Bruce/resolved-server/store"
+)
+
+// Webhook events sent when a scheduled reservation has been attempted
+const (
+	webhookEventBooked  = "reservation.booked"
+	webhookEventFailed  = "reservation.failed"
+	webhookEventMissed  = "reservation.missed"
+	webhookEventSkipped = "reservation.skipped"
+)
+
+// webhookTimeout bounds each webhook delivery
+const webhookTimeout = 10 * time.Second
+
+// WebhookPayload is the JSON body posted to WEBHOOK_URL
+type WebhookPayload struct {
+	Event           string            `json:"event"`
+	SentAt          string            `json:"sent_at"` // RFC3339, lets receivers reject replays
+	ReservationID   string            `json:"reservation_id"`
+	VenueID         int64             `json:"venue_id"`
+	ReservationTime string            `json:"reservation_time"` // RFC3339; the booked slot when booked
+	PartySize       int               `json:"party_size"`
+	Note            string            `json:"note,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	ResyID          string            `json:"resy_reservation_id,omitempty"` // Resy's ID for the booking, when booked
+	ResyToken       string            `json:"resy_token,omitempty"`          // Cancels the booking, when booked
+	VenueMismatch   bool              `json:"venue_mismatch,omitempty"`      // Booked at another venue because Resy didn't list venue_id
+	BookedVenueID   int64             `json:"booked_venue_id,omitempty"`     // With venue_mismatch, the venue booked
+	Error           string            `json:"error,omitempty"`
+	Retryable       bool              `json:"retryable,omitempty"`
+}
+
+// notifyReservationOutcome posts the outcome of a scheduled reservation to the
+// configured webhook, and emails it when the reservation has an address, in the
+// background. reserveResp is the booking when it
+// succeeded; err is why it didn't.
+func notifyReservationOutcome(event string, res *store.ScheduledReservation, reserveResp *api.ReserveResponse, err error) {
+	emailReservationOutcome(event, res, reserveResp, err)
+
+	cfg := config.Get()
+	if cfg.WebhookURL == "" {
+		return
+	}
+
+	payload := WebhookPayload{
+		Event:           event,
+		SentAt:          formatRFC3339(time.Now()),
+		ReservationID:   res.ID,
+		VenueID:         res.VenueID,
+		ReservationTime: formatRFC3339(res.ReservationTime),
+		PartySize:       res.PartySize,
+		Note:            res.Note,
+		Labels:          res.Labels,
+	}
+	if reserveResp != nil {
+		payload.ReservationTime = formatRFC3339(reserveResp.ReservationTime)
+		payload.ResyID = reserveResp.ReservationID
+		payload.ResyToken = reserveResp.ResyToken
+		if reserveResp.VenueMismatch {
+			payload.VenueMismatch = true
+			payload.BookedVenueID = reserveResp.BookedVenueID
+		}
+	}
+	if err != nil {
+		payload.Error = err.Error()
+		payload.Retryable = api.IsRetryable(err)
+	}
+
+	body, marshalErr := json.Marshal(payload)
+	if marshalErr != nil {
+		appendLog("Failed to encode webhook for reservation " + res.ID + ": " + marshalErr.Error())
+		return
+	}
+
+	go sendWebhook(cfg.WebhookURL, []byte(cfg.WebhookSecret), body, res.ID)
+}
+
+// sendWebhook delivers a webhook body, signed with secret when one is set
+func sendWebhook(url string, secret []byte, body []byte, resID string) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		appendLog("Failed to create webhook request for reservation " + resID + ": " + err.Error())
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(secret) > 0 {
+		req.Header.Set("X-Signature", signWebhook(secret, body))
+	}
+
+	client := &http.Client{Timeout: webhookTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		appendLog("Webhook for reservation " + resID + " failed: " + err.Error())
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		appendLog("Webhook for reservation " + resID + " was rejected with HTTP " + strconv.Itoa(resp.StatusCode))
+	}
+}
+
+// signWebhook returns the X-Signature value for a body: "sha256=" followed by
+// the hex HMAC-SHA256 of the body under secret
+func signWebhook(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}